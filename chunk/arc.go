@@ -0,0 +1,142 @@
+package chunk
+
+import (
+	"container/list"
+)
+
+// ARC is the adaptive replacement cache policy. Chunks that were used once
+// are kept in recent and chunks that were used again in frequent, reads within
+// the correlation period of the previous read are no new use. The ids of
+// chunks evicted from both queues are remembered in ghost queues. A request
+// for a remembered chunk adapts the target size of recent, so the policy
+// balances recency and frequency and a full scan only cycles through recent.
+type ARC struct {
+	policyQueues
+	recent        *list.List
+	frequent      *list.List
+	recentGhost   *ghostList
+	frequentGhost *ghostList
+	target        int
+}
+
+// NewARC creates a new ARC policy
+func NewARC(maxChunks int) *ARC {
+	return &ARC{
+		policyQueues:  newPolicyQueues(maxChunks),
+		recent:        list.New(),
+		frequent:      list.New(),
+		recentGhost:   newGhostList(),
+		frequentGhost: newGhostList(),
+	}
+}
+
+// Pop removes the buffer that should be reused next
+func (p *ARC) Pop() int {
+	return p.PopFor(blankRequestID)
+}
+
+// PopFor removes the buffer that should be reused for a chunk
+func (p *ARC) PopFor(id RequestID) int {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if index, done := p.pending(); done {
+		return index
+	}
+
+	size := p.maxSize
+	inFrequentGhost := false
+	switch {
+	case p.recentGhost.contains(id):
+		delta := 1
+		if p.frequentGhost.Len() > p.recentGhost.Len() {
+			delta = p.frequentGhost.Len() / p.recentGhost.Len()
+		}
+		p.target += delta
+		if p.target > size {
+			p.target = size
+		}
+	case p.frequentGhost.contains(id):
+		inFrequentGhost = true
+		delta := 1
+		if p.recentGhost.Len() > p.frequentGhost.Len() {
+			delta = p.recentGhost.Len() / p.frequentGhost.Len()
+		}
+		p.target -= delta
+		if p.target < 0 {
+			p.target = 0
+		}
+	default:
+		if p.recent.Len()+p.recentGhost.Len() >= size {
+			if p.recent.Len() >= size {
+				// recent fills the whole cache, evict without remembering
+				return p.untrack(p.recent.Front().Value.(*policyEntry))
+			}
+			p.recentGhost.removeOldest()
+		} else if p.recent.Len()+p.frequent.Len()+p.recentGhost.Len()+p.frequentGhost.Len() >= 2*size {
+			p.frequentGhost.removeOldest()
+		}
+	}
+	return p.replace(inFrequentGhost)
+}
+
+// replace evicts a buffer from recent or frequent depending on the target
+func (p *ARC) replace(inFrequentGhost bool) int {
+	recent := p.recent.Len()
+	if item := p.recent.Front(); nil != item && (recent > p.target || (inFrequentGhost && recent == p.target) || 0 == p.frequent.Len()) {
+		e := item.Value.(*policyEntry)
+		p.recentGhost.add(e.id, p.maxSize)
+		return p.untrack(e)
+	}
+	if item := p.frequent.Front(); nil != item {
+		e := item.Value.(*policyEntry)
+		p.frequentGhost.add(e.id, p.maxSize)
+		return p.untrack(e)
+	}
+	return -1
+}
+
+// Touch moves a buffer to the back of frequent if the read is a new reference
+// or to the back of its queue
+func (p *ARC) Touch(item *list.Element) bool {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	e := entry(item)
+	if nil == e || (p.recent != e.queue && p.frequent != e.queue) {
+		return false
+	}
+	queue := e.queue
+	reference := p.reference(e)
+	if reference {
+		queue = p.frequent
+	}
+	p.moveToBack(e, queue)
+	return reference
+}
+
+// Push adds a buffer that has just been filled
+func (p *ARC) Push(index int) *list.Element {
+	return p.PushID(index, blankRequestID)
+}
+
+// PushID adds a buffer to frequent if the chunk was evicted recently or to recent
+func (p *ARC) PushID(index int, id RequestID) *list.Element {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.recentGhost.contains(id) || p.frequentGhost.contains(id) {
+		p.recentGhost.remove(id)
+		p.frequentGhost.remove(id)
+		return p.track(index, id, p.frequent)
+	}
+	return p.track(index, id, p.recent)
+}
+
+// Restore adds a buffer that was loaded from the journal, buffers with hits
+// are restored to frequent
+func (p *ARC) Restore(index int, id RequestID, hits uint32) *list.Element {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if hits > 0 {
+		return p.restore(index, id, p.frequent)
+	}
+	return p.restore(index, id, p.recent)
+}
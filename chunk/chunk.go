@@ -3,6 +3,7 @@ package chunk
 import (
 	"container/list"
 	"hash/crc32"
+	"sync/atomic"
 )
 
 // Chunk of memory
@@ -17,6 +18,9 @@ type chunkHeader struct {
 	id       RequestID
 	size     uint32
 	checksum uint32
+	// accessed and hits are the state of the eviction policy
+	accessed uint64
+	hits     uint32
 }
 
 func (c *Chunk) valid(id RequestID) bool {
@@ -29,11 +33,21 @@ func (c *Chunk) valid(id RequestID) bool {
 	return c.clean
 }
 
-func (c *Chunk) update(id RequestID, bytes []byte) {
+func (c *Chunk) update(id RequestID, bytes []byte, accessed uint64) {
 	c.id = id
 	c.size = uint32(copy(c.bytes, bytes))
 	c.checksum = c.calculateChecksum()
 	c.clean = true
+	atomic.StoreUint64(&c.accessed, accessed)
+	atomic.StoreUint32(&c.hits, 0)
+}
+
+// touch records an access, it is called concurrently while reading
+func (c *Chunk) touch(accessed uint64, hit bool) {
+	atomic.StoreUint64(&c.accessed, accessed)
+	if hit {
+		atomic.AddUint32(&c.hits, 1)
+	}
 }
 
 func (c *Chunk) calculateChecksum() uint32 {
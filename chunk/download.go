@@ -1,6 +1,7 @@
 package chunk
 
 import (
+	"context"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -20,21 +21,37 @@ import (
 type Downloader struct {
 	Client     *drive.Client
 	BufferSize int64
-	queue      chan *Request
-	callbacks  map[RequestID][]DownloadCallback
+	queue      *downloadQueue
+	downloads  map[RequestID]*download
 	lock       sync.Mutex
-	storage    *Storage
+	storage    ChunkStorage
 }
 
 type DownloadCallback func(error, []byte)
 
-// NewDownloader creates a new download manager
-func NewDownloader(threads int, client *drive.Client, storage *Storage, bufferSize int64) (*Downloader, error) {
+// download are the reads waiting for a queued or running chunk download
+type download struct {
+	req     *Request
+	waiters []*waiter
+	preload bool
+	cancel  context.CancelFunc
+}
+
+// waiter is a read waiting for a chunk download, done is closed after the
+// callback has been called
+type waiter struct {
+	callback DownloadCallback
+	done     chan struct{}
+}
+
+// NewDownloader creates a new download manager, chunks are only passed to the
+// callbacks if storage is nil
+func NewDownloader(threads int, client *drive.Client, storage ChunkStorage, bufferSize int64) (*Downloader, error) {
 	manager := Downloader{
 		Client:     client,
 		BufferSize: bufferSize,
-		queue:      make(chan *Request, 100),
-		callbacks:  make(map[RequestID][]DownloadCallback, 100),
+		queue:      newDownloadQueue(threads, maxQueuedPreloads),
+		downloads:  make(map[RequestID]*download, 100),
 		storage:    storage,
 	}
 
@@ -45,19 +62,83 @@ func NewDownloader(threads int, client *drive.Client, storage *Storage, bufferSi
 	return &manager, nil
 }
 
-// Download starts a new download request
-func (d *Downloader) Download(req *Request, callback DownloadCallback) {
+// Download starts a new download request, requests with a callback are
+// downloaded before the preload requests. The callback is dropped when the
+// context is cancelled and the download is aborted if no other read is
+// waiting for the chunk.
+func (d *Downloader) Download(ctx context.Context, req *Request, callback DownloadCallback) {
+	// fail fast if only cached chunks can be served
+	if !d.Client.Online() {
+		if nil != callback {
+			callback(fmt.Errorf("Could not download chunk %v, Google Drive API is not reachable", req.id), nil)
+		}
+		req.done()
+		return
+	}
+
 	d.lock.Lock()
-	callbacks, exists := d.callbacks[req.id]
+	defer d.lock.Unlock()
+	dl, exists := d.downloads[req.id]
+	if !exists {
+		dl = &download{req: req}
+		d.downloads[req.id] = dl
+	}
 	if nil != callback {
-		d.callbacks[req.id] = append(callbacks, callback)
-	} else if !exists {
-		d.callbacks[req.id] = callbacks
+		w := &waiter{callback: callback}
+		if nil != ctx.Done() {
+			w.done = make(chan struct{})
+			go d.abandon(ctx, req.id, dl, w)
+		}
+		dl.waiters = append(dl.waiters, w)
+		req.priority = PriorityForeground
+	} else {
+		dl.preload = true
 	}
-	if !exists {
-		d.queue <- req
+	if exists {
+		// the chunk is already downloaded by another request, a read waiting
+		// for a queued preload moves it to the front
+		d.queue.promote(req.id, req.priority)
+		req.done()
+		return
 	}
-	d.lock.Unlock()
+	for _, dropped := range d.queue.push(req) {
+		Log.Debugf("Dropping preload %v, too many preloads are queued", dropped.id)
+		delete(d.downloads, dropped.id)
+		dropped.done()
+	}
+}
+
+// abandon drops the callback of a read when its context is cancelled, the
+// download is aborted if no other read or preload is waiting for the chunk.
+// Reads of the chunk after the abort start a new download.
+func (d *Downloader) abandon(ctx context.Context, id RequestID, dl *download, w *waiter) {
+	select {
+	case <-w.done:
+		return
+	case <-ctx.Done():
+	}
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	found := false
+	for i, other := range dl.waiters {
+		if other == w {
+			dl.waiters = append(dl.waiters[:i], dl.waiters[i+1:]...)
+			found = true
+			break
+		}
+	}
+	if !found || len(dl.waiters) > 0 || dl.preload || d.downloads[id] != dl {
+		return
+	}
+
+	Log.Debugf("Aborting download %v, the read has been interrupted", id)
+	delete(d.downloads, id)
+	if nil != dl.cancel {
+		dl.cancel()
+		return
+	}
+	d.queue.remove(id)
 }
 
 func (d *Downloader) thread(n int) {
@@ -67,24 +148,82 @@ func (d *Downloader) thread(n int) {
 		buffer = make([]byte, d.BufferSize)
 	}
 	for {
-		req := <-d.queue
-		d.download(d.Client.GetNativeClient(), req, buffer)
+		req := d.queue.pop()
+		ctx, cancel := context.WithCancel(context.Background())
+		dl := d.start(req, cancel)
+		if nil == dl {
+			cancel()
+			d.queue.finish(req, false)
+			continue
+		}
+		d.download(ctx, d.Client.GetNativeClient(), req, dl, buffer)
+		cancel()
+		d.queue.finish(req, true)
 	}
 }
 
-func (d *Downloader) download(client *http.Client, req *Request, buffer []byte) {
-	Log.Debugf("Starting download %v (preload: %v)", req.id, req.preload)
-	err := downloadFromAPI(client, req, buffer, 0)
+// start marks the download of a request as running, cancel aborts it. It
+// returns nil if the download has been dropped or aborted.
+func (d *Downloader) start(req *Request, cancel context.CancelFunc) *download {
+	if d.drop(req) {
+		return nil
+	}
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	dl, exists := d.downloads[req.id]
+	if !exists || nil != dl.cancel {
+		// the download has been aborted before it started or the chunk is
+		// downloaded by a request that has been queued again
+		req.done()
+		return nil
+	}
+	dl.cancel = cancel
+	return dl
+}
 
+// drop removes a cancelled preload request unless a read is waiting for the chunk
+func (d *Downloader) drop(req *Request) bool {
+	if !req.cancelled() {
+		return false
+	}
 	d.lock.Lock()
-	callbacks := d.callbacks[req.id]
-	for _, callback := range callbacks {
-		callback(err, buffer)
+	defer d.lock.Unlock()
+	dl, exists := d.downloads[req.id]
+	if exists && len(dl.waiters) > 0 {
+		return false
+	}
+	Log.Debugf("Dropping cancelled preload %v", req.id)
+	if exists && dl.req == req {
+		delete(d.downloads, req.id)
+	}
+	req.done()
+	return true
+}
+
+// download downloads a chunk and passes it to the waiters of the download,
+// reads of an aborted download have started a new download already
+func (d *Downloader) download(ctx context.Context, client *http.Client, req *Request, dl *download, buffer []byte) {
+	Log.Debugf("Starting download %v (priority: %v)", req.id, req.priority)
+	err := downloadFromAPI(ctx, client, req, buffer, 0)
+
+	d.lock.Lock()
+	for _, w := range dl.waiters {
+		w.callback(err, buffer)
+		if nil != w.done {
+			close(w.done)
+		}
+	}
+	if d.downloads[req.id] == dl {
+		delete(d.downloads, req.id)
 	}
-	delete(d.callbacks, req.id)
 	d.lock.Unlock()
+	req.done()
 
-	if nil != err {
+	if nil != ctx.Err() {
+		Log.Debugf("Aborted download %v", req.id)
+		return
+	}
+	if nil != err || nil == d.storage {
 		return
 	}
 
@@ -93,10 +232,14 @@ func (d *Downloader) download(client *http.Client, req *Request, buffer []byte)
 	}
 }
 
-func downloadFromAPI(client *http.Client, request *Request, buffer []byte, delay int64) error {
+func downloadFromAPI(ctx context.Context, client *http.Client, request *Request, buffer []byte, delay int64) error {
 	// sleep if request is throttled
 	if delay > 0 {
-		time.Sleep(time.Duration(delay) * time.Second)
+		select {
+		case <-time.After(time.Duration(delay) * time.Second):
+		case <-ctx.Done():
+			return fmt.Errorf("Download of %v (%v) has been aborted", request.object.ObjectID, request.object.Name)
+		}
 	}
 
 	downloadURL := request.object.DownloadURL
@@ -108,6 +251,7 @@ func downloadFromAPI(client *http.Client, request *Request, buffer []byte, delay
 		Log.Debugf("%v", err)
 		return fmt.Errorf("Could not create request object %v (%v) from API", request.object.ObjectID, request.object.Name)
 	}
+	req = req.WithContext(ctx)
 	req.Header.Add("Range", fmt.Sprintf("bytes=%v-%v", request.offsetStart, request.offsetEnd-1))
 
 	Log.Tracef("Sending HTTP Request %v", req)
@@ -147,7 +291,7 @@ func downloadFromAPI(client *http.Client, request *Request, buffer []byte, delay
 			} else {
 				delay = delay * 2
 			}
-			return downloadFromAPI(client, request, buffer, delay)
+			return downloadFromAPI(ctx, client, request, buffer, delay)
 		}
 
 		// return an error if other error occurred
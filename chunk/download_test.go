@@ -0,0 +1,118 @@
+package chunk
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/plexdrive/plexdrive/config"
+	"github.com/plexdrive/plexdrive/drive"
+)
+
+// waitForDownloads waits until the downloader has no queued or running downloads
+func waitForDownloads(t *testing.T, d *Downloader) {
+	for i := 0; i < 100; i++ {
+		d.lock.Lock()
+		n := len(d.downloads)
+		d.lock.Unlock()
+		if 0 == n && 0 == d.queue.len(PriorityForeground) {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("Expected the download to be aborted")
+}
+
+func TestDownloadAbort(t *testing.T) {
+	dir, err := ioutil.TempDir("", "plexdrive")
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	started := make(chan struct{}, 1)
+	aborted := make(chan struct{}, 1)
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if 1 < atomic.AddInt32(&requests, 1) {
+			http.ServeContent(w, r, "file", time.Now(), bytes.NewReader(make([]byte, 1024)))
+			return
+		}
+		started <- struct{}{}
+		// the first chunk never arrives
+		<-r.Context().Done()
+		aborted <- struct{}{}
+	}))
+	defer server.Close()
+
+	token := `{"access_token":"test","token_type":"Bearer","expiry":"2100-01-01T00:00:00Z"}`
+	ioutil.WriteFile(filepath.Join(dir, "token.json"), []byte(token), 0600)
+	client, err := drive.NewAPIClient(&config.Config{}, dir, "")
+	if nil != err {
+		t.Fatal(err)
+	}
+	object := &drive.APIObject{ObjectID: "file", Size: 1 << 20, DownloadURL: server.URL + "/file?alt=media"}
+	request := func() *Request {
+		return &Request{id: buildRequestID(object, 0), object: object, offsetEnd: 1024}
+	}
+	called := func(error, []byte) {
+		t.Error("Expected the callback of an interrupted read to be dropped")
+	}
+
+	// an interrupted read drops its queued download
+	d, err := NewDownloader(0, client, nil, 1024)
+	if nil != err {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	d.Download(ctx, request(), called)
+	cancel()
+	waitForDownloads(t, d)
+
+	// a running download is aborted when the last waiting read is interrupted
+	d, err = NewDownloader(1, client, nil, 1024)
+	if nil != err {
+		t.Fatal(err)
+	}
+	ctx1, cancel1 := context.WithCancel(context.Background())
+	ctx2, cancel2 := context.WithCancel(context.Background())
+	d.Download(ctx1, request(), called)
+	d.Download(ctx2, request(), called)
+	<-started
+
+	cancel1()
+	select {
+	case <-aborted:
+		t.Fatal("Expected the download to continue for the other read")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// a read retried right after the abort starts a new download
+	cancel2()
+	waitForDownloads(t, d)
+	retried := make(chan error, 1)
+	d.Download(context.Background(), request(), func(err error, _ []byte) {
+		retried <- err
+	})
+	select {
+	case <-aborted:
+	case <-time.After(time.Second):
+		t.Fatal("Expected the download to be aborted")
+	}
+	select {
+	case err := <-retried:
+		if nil != err {
+			t.Fatalf("Expected the retried read to succeed: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Expected the retried read to be answered")
+	}
+	waitForDownloads(t, d)
+}
@@ -0,0 +1,225 @@
+package chunk
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+
+	. "github.com/claudetech/loggo/default"
+	"github.com/plexdrive/plexdrive/drive"
+)
+
+// Fetcher copies whole files to local disk with parallel ranged downloads
+type Fetcher struct {
+	downloader       *Downloader
+	threads          int
+	rangeSize        int64
+	acknowledgeAbuse bool
+}
+
+// fetchProgress is stored next to the partial file to resume interrupted copies
+type fetchProgress struct {
+	ObjectID   string
+	RevisionID string
+	Size       uint64
+	RangeSize  int64
+	Done       []bool
+}
+
+// fetchResult is the result of one range download
+type fetchResult struct {
+	index int
+	err   error
+}
+
+// NewFetcher creates a new fetcher downloading ranges of the given size
+func NewFetcher(client *drive.Client, threads int, rangeSize int64, ackAbuse bool) (*Fetcher, error) {
+	if threads < 1 {
+		threads = 1
+	}
+	downloader, err := NewDownloader(threads, client, nil, rangeSize)
+	if nil != err {
+		return nil, err
+	}
+
+	return &Fetcher{
+		downloader:       downloader,
+		threads:          threads,
+		rangeSize:        rangeSize,
+		acknowledgeAbuse: ackAbuse,
+	}, nil
+}
+
+// Fetch copies the content of an object to the destination file, the content
+// is written to a .part file first and verified against the MD5 checksum
+func (f *Fetcher) Fetch(object *drive.APIObject, dest string) error {
+	if object.IsDir {
+		return fmt.Errorf("Object %v (%v) is a folder", object.ObjectID, object.Name)
+	}
+	partPath := dest + ".part"
+	progressPath := dest + ".part.json"
+
+	numRanges := int((int64(object.Size) + f.rangeSize - 1) / f.rangeSize)
+	progress := loadFetchProgress(progressPath)
+	if nil == progress || progress.ObjectID != object.ObjectID || progress.RevisionID != object.RevisionID ||
+		progress.Size != object.Size || progress.RangeSize != f.rangeSize || len(progress.Done) != numRanges {
+		progress = &fetchProgress{
+			ObjectID:   object.ObjectID,
+			RevisionID: object.RevisionID,
+			Size:       object.Size,
+			RangeSize:  f.rangeSize,
+			Done:       make([]bool, numRanges),
+		}
+		os.Remove(partPath)
+	} else {
+		Log.Infof("Resuming download of %v (%v)", object.ObjectID, object.Name)
+	}
+
+	part, err := os.OpenFile(partPath, os.O_RDWR|os.O_CREATE, 0644)
+	if nil != err {
+		Log.Debugf("%v", err)
+		return fmt.Errorf("Could not open file %v", partPath)
+	}
+	defer part.Close()
+	if err := part.Truncate(int64(object.Size)); nil != err {
+		Log.Debugf("%v", err)
+		return fmt.Errorf("Could not allocate file %v", partPath)
+	}
+
+	pending := make([]int, 0, numRanges)
+	for i, done := range progress.Done {
+		if !done {
+			pending = append(pending, i)
+		}
+	}
+
+	// keep the number of queued requests low, the download queue is bounded
+	results := make(chan fetchResult, numRanges)
+	inflight := 0
+	completed := numRanges - len(pending)
+	var fetchErr error
+	for len(pending) > 0 || inflight > 0 {
+		for nil == fetchErr && len(pending) > 0 && inflight < 2*f.threads {
+			f.fetchRange(object, part, pending[0], results)
+			pending = pending[1:]
+			inflight++
+		}
+
+		result := <-results
+		inflight--
+		if nil != result.err {
+			if nil == fetchErr {
+				fetchErr = result.err
+			}
+			continue
+		}
+
+		// the progress must not be ahead of the data on disk
+		progress.Done[result.index] = true
+		completed++
+		if err := part.Sync(); nil != err {
+			Log.Debugf("%v", err)
+		} else if err := storeFetchProgress(progressPath, progress); nil != err {
+			Log.Debugf("%v", err)
+		}
+		Log.Infof("Downloaded %v of %v ranges of %v (%v)", completed, numRanges, object.ObjectID, object.Name)
+	}
+	if nil != fetchErr {
+		return fetchErr
+	}
+
+	if err := verifyMD5(part, object); nil != err {
+		os.Remove(partPath)
+		os.Remove(progressPath)
+		return err
+	}
+
+	if err := os.Rename(partPath, dest); nil != err {
+		Log.Debugf("%v", err)
+		return fmt.Errorf("Could not move %v to %v", partPath, dest)
+	}
+	os.Remove(progressPath)
+	return nil
+}
+
+// fetchRange downloads one range of the object into the file
+func (f *Fetcher) fetchRange(object *drive.APIObject, file *os.File, index int, results chan fetchResult) {
+	offsetStart := int64(index) * f.rangeSize
+	offsetEnd := min(offsetStart+f.rangeSize, int64(object.Size))
+	request := &Request{
+		id:               buildRequestID(object, offsetStart),
+		object:           object,
+		offsetStart:      offsetStart,
+		offsetEnd:        offsetEnd,
+		priority:         PriorityForeground,
+		acknowledgeAbuse: f.acknowledgeAbuse,
+	}
+
+	f.downloader.Download(context.Background(), request, func(err error, bytes []byte) {
+		if nil != err {
+			results <- fetchResult{index: index, err: err}
+			return
+		}
+		// the buffer is reused after the callback returned and the callback
+		// holds the lock of the downloader, so a copy is written to disk
+		data := make([]byte, offsetEnd-offsetStart)
+		copy(data, bytes)
+		go func() {
+			if _, err := file.WriteAt(data, offsetStart); nil != err {
+				Log.Debugf("%v", err)
+				results <- fetchResult{index: index, err: fmt.Errorf("Could not write range %v of %v", index, object.ObjectID)}
+				return
+			}
+			results <- fetchResult{index: index}
+		}()
+	})
+}
+
+// verifyMD5 compares the content of the file with the checksum of the object
+func verifyMD5(file *os.File, object *drive.APIObject) error {
+	if "" == object.MD5Checksum {
+		Log.Warningf("Object %v (%v) has no MD5 checksum, skipping verification", object.ObjectID, object.Name)
+		return nil
+	}
+
+	hash := md5.New()
+	if _, err := io.Copy(hash, io.NewSectionReader(file, 0, int64(object.Size))); nil != err {
+		Log.Debugf("%v", err)
+		return fmt.Errorf("Could not read downloaded file to verify the MD5 checksum")
+	}
+	if checksum := hex.EncodeToString(hash.Sum(nil)); checksum != object.MD5Checksum {
+		return fmt.Errorf("MD5 checksum %v of the downloaded file doesn't match %v of %v (%v)",
+			checksum, object.MD5Checksum, object.ObjectID, object.Name)
+	}
+	return nil
+}
+
+func loadFetchProgress(path string) *fetchProgress {
+	data, err := ioutil.ReadFile(path)
+	if nil != err {
+		return nil
+	}
+	var progress fetchProgress
+	if err := json.Unmarshal(data, &progress); nil != err {
+		Log.Debugf("%v", err)
+		return nil
+	}
+	return &progress
+}
+
+// storeFetchProgress replaces the progress file atomically
+func storeFetchProgress(path string, progress *fetchProgress) error {
+	data, err := json.Marshal(progress)
+	if nil != err {
+		return err
+	}
+	if err := ioutil.WriteFile(path+".tmp", data, 0644); nil != err {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
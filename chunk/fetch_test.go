@@ -0,0 +1,95 @@
+package chunk
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/plexdrive/plexdrive/config"
+	"github.com/plexdrive/plexdrive/drive"
+)
+
+func TestFetchResume(t *testing.T) {
+	dir, err := ioutil.TempDir("", "plexdrive")
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	content := make([]byte, 10000)
+	for i := range content {
+		content[i] = byte(i % 251)
+	}
+	sum := md5.Sum(content)
+
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		http.ServeContent(w, r, "file", time.Now(), bytes.NewReader(content))
+	}))
+	defer server.Close()
+
+	token := `{"access_token":"test","token_type":"Bearer","expiry":"2100-01-01T00:00:00Z"}`
+	ioutil.WriteFile(filepath.Join(dir, "token.json"), []byte(token), 0600)
+	client, err := drive.NewAPIClient(&config.Config{}, dir, "")
+	if nil != err {
+		t.Fatal(err)
+	}
+	fetcher, err := NewFetcher(client, 4, 1024, false)
+	if nil != err {
+		t.Fatal(err)
+	}
+
+	object := &drive.APIObject{
+		ObjectID:    "file",
+		Name:        "file.mkv",
+		Size:        uint64(len(content)),
+		DownloadURL: server.URL + "/file?alt=media",
+		MD5Checksum: hex.EncodeToString(sum[:]),
+		RevisionID:  "1",
+	}
+	dest := filepath.Join(dir, "file.mkv")
+
+	// an interrupted copy with the first 8 ranges on disk
+	part := make([]byte, len(content))
+	copy(part, content[:8*1024])
+	ioutil.WriteFile(dest+".part", part, 0644)
+	progress := &fetchProgress{ObjectID: "file", RevisionID: "1", Size: object.Size, RangeSize: 1024, Done: make([]bool, 10)}
+	for i := 0; i < 8; i++ {
+		progress.Done[i] = true
+	}
+	storeFetchProgress(dest+".part.json", progress)
+
+	if err := fetcher.Fetch(object, dest); nil != err {
+		t.Fatal(err)
+	}
+	if 2 != atomic.LoadInt32(&requests) {
+		t.Fatalf("Expected only the missing ranges to be downloaded, got %v requests", requests)
+	}
+	if data, _ := ioutil.ReadFile(dest); !bytes.Equal(content, data) {
+		t.Fatalf("Downloaded file doesn't match the content")
+	}
+	if _, err := os.Stat(dest + ".part.json"); !os.IsNotExist(err) {
+		t.Fatalf("Expected progress file to be removed")
+	}
+
+	// a corrupt partial file fails the checksum verification
+	os.Remove(dest)
+	part[0]++
+	ioutil.WriteFile(dest+".part", part, 0644)
+	storeFetchProgress(dest+".part.json", progress)
+	if err := fetcher.Fetch(object, dest); nil == err {
+		t.Fatalf("Expected checksum mismatch")
+	}
+	if _, err := os.Stat(dest + ".part"); !os.IsNotExist(err) {
+		t.Fatalf("Expected corrupt partial file to be removed")
+	}
+}
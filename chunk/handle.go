@@ -0,0 +1,96 @@
+package chunk
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+
+	. "github.com/claudetech/loggo/default"
+	"github.com/plexdrive/plexdrive/drive"
+)
+
+// cancelToken cancels the preload requests of a handle
+type cancelToken struct {
+	cancelled int32
+}
+
+func (t *cancelToken) cancel() {
+	atomic.StoreInt32(&t.cancelled, 1)
+}
+
+func (t *cancelToken) isCancelled() bool {
+	return nil != t && 1 == atomic.LoadInt32(&t.cancelled)
+}
+
+// Handle is an open file, it tracks the read position and the preload
+// requests of the file. The preload requests are cancelled when the handle
+// is released or seeks away from the preloaded chunks.
+type Handle struct {
+	object    *drive.APIObject
+	stream    string
+	readAhead *readAhead
+	lock      sync.Mutex
+	token     *cancelToken
+	position  int64
+	inflight  int32
+}
+
+// Open creates a handle to read a file
+func (m *Manager) Open(object *drive.APIObject) *Handle {
+	return &Handle{
+		object:    object,
+		stream:    fmt.Sprintf("%v#%v", object.ObjectID, atomic.AddUint64(&m.handles, 1)),
+		readAhead: newReadAhead(m.ChunkSize, m.LoadAhead),
+		token:     &cancelToken{},
+	}
+}
+
+// Object returns the file of the handle
+func (h *Handle) Object() *drive.APIObject {
+	return h.object
+}
+
+// Position returns the offset following the last read
+func (h *Handle) Position() int64 {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	return h.position
+}
+
+// Inflight returns the number of pending preload requests
+func (h *Handle) Inflight() int {
+	return int(atomic.LoadInt32(&h.inflight))
+}
+
+// Release cancels all pending preload requests
+func (h *Handle) Release() {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.token.cancel()
+	Log.Tracef("Released handle of %v, cancelled %v preloads", h.object.ObjectID, h.Inflight())
+}
+
+// read registers a read and returns the number of chunks to read ahead and
+// the token of the preload requests
+func (h *Handle) read(offset, size int64) (int, *cancelToken) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	loadAhead, seeked := h.readAhead.record(offset, size)
+	if seeked {
+		// the preloaded chunks won't be read anymore
+		h.token.cancel()
+		h.token = &cancelToken{}
+	}
+	h.position = offset + size
+	return loadAhead, h.token
+}
+
+// preloadQueued counts a new pending preload request
+func (h *Handle) preloadQueued() {
+	atomic.AddInt32(&h.inflight, 1)
+}
+
+// preloadDone counts a finished or cancelled preload request
+func (h *Handle) preloadDone() {
+	atomic.AddInt32(&h.inflight, -1)
+}
@@ -0,0 +1,51 @@
+package chunk
+
+import (
+	"testing"
+
+	"github.com/plexdrive/plexdrive/drive"
+)
+
+func TestHandleCancelsPreloads(t *testing.T) {
+	m := &Manager{ChunkSize: 1 << 20, LoadAhead: 4}
+	h := m.Open(&drive.APIObject{ObjectID: "file", Size: 1 << 30})
+
+	_, token := h.read(0, 4096)
+	preload := &Request{preload: true, handle: h, token: token}
+	h.preloadQueued()
+
+	// reads near the position keep the preloads
+	if _, next := h.read(4096, 4096); next != token || preload.cancelled() {
+		t.Fatal("Expected a sequential read to keep the preloads")
+	}
+
+	// a far seek cancels the preloads
+	_, next := h.read(100<<20, 4096)
+	if !preload.cancelled() {
+		t.Fatal("Expected a far seek to cancel the preloads")
+	}
+	if next.isCancelled() {
+		t.Fatal("Expected the preloads after the seek not to be cancelled")
+	}
+	if (100<<20)+4096 != h.Position() {
+		t.Fatalf("Expected the position after the last read got %v", h.Position())
+	}
+
+	// the downloader drops cancelled preloads nobody waits for
+	d := &Downloader{downloads: map[RequestID]*download{preload.id: {req: preload, preload: true}}}
+	if !d.drop(preload) {
+		t.Fatal("Expected the cancelled preload to be dropped")
+	}
+	if 0 != h.Inflight() {
+		t.Fatalf("Expected no pending preloads got %v", h.Inflight())
+	}
+
+	// a release cancels the remaining preloads unless a read waits for them
+	waiting := &Request{id: RequestID{1}, preload: true, handle: h, token: next}
+	h.preloadQueued()
+	h.Release()
+	d.downloads[waiting.id] = &download{req: waiting, waiters: []*waiter{{callback: func(error, []byte) {}}}}
+	if !waiting.cancelled() || d.drop(waiting) {
+		t.Fatal("Expected the cancelled preload to be downloaded for the waiting read")
+	}
+}
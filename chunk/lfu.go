@@ -0,0 +1,87 @@
+package chunk
+
+import (
+	"container/list"
+)
+
+// lfuAgingInterval is the number of evictions, in multiples of the number of
+// chunks, after which the hits of all chunks are halved
+const lfuAgingInterval = 4
+
+// LFU evicts the least frequently used chunk, ties are broken by recency.
+// Only new references count as hits, see policyQueues.reference. The hits of all chunks are halved regularly so that chunks which were
+// popular a long time ago eventually age out.
+type LFU struct {
+	policyQueues
+	entries   *list.List
+	evictions int
+}
+
+// NewLFU creates a new LFU policy
+func NewLFU(maxChunks int) *LFU {
+	return &LFU{
+		policyQueues: newPolicyQueues(maxChunks),
+		entries:      list.New(),
+	}
+}
+
+// Pop removes the least frequently used buffer
+func (p *LFU) Pop() int {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if index, done := p.pending(); done {
+		return index
+	}
+
+	var victim *policyEntry
+	for item := p.entries.Front(); nil != item; item = item.Next() {
+		e := item.Value.(*policyEntry)
+		if nil == victim || e.hits < victim.hits || (e.hits == victim.hits && e.accessed < victim.accessed) {
+			victim = e
+		}
+	}
+	if nil == victim {
+		return -1
+	}
+
+	p.evictions++
+	if p.evictions >= lfuAgingInterval*p.maxSize {
+		p.evictions = 0
+		for item := p.entries.Front(); nil != item; item = item.Next() {
+			item.Value.(*policyEntry).hits /= 2
+		}
+	}
+	return p.untrack(victim)
+}
+
+// Touch increases the hits of a buffer if the read is a new reference
+func (p *LFU) Touch(item *list.Element) bool {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	e := entry(item)
+	if nil == e || p.entries != e.queue {
+		return false
+	}
+	reference := p.reference(e)
+	if reference {
+		e.hits++
+	}
+	p.moveToBack(e, p.entries)
+	return reference
+}
+
+// Push adds a buffer that has just been filled
+func (p *LFU) Push(index int) *list.Element {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return p.track(index, blankRequestID, p.entries)
+}
+
+// Restore adds a buffer that was loaded from the journal
+func (p *LFU) Restore(index int, id RequestID, hits uint32) *list.Element {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	item := p.restore(index, id, p.entries)
+	entry(item).hits = hits
+	return item
+}
@@ -1,6 +1,8 @@
 package chunk
 
 import (
+	"context"
+	"crypto/sha256"
 	"encoding/binary"
 	"encoding/hex"
 	"fmt"
@@ -15,12 +17,14 @@ type Manager struct {
 	ChunkSize        int64
 	LoadAhead        int
 	downloader       *Downloader
-	storage          *Storage
+	storage          ChunkStorage
 	queue            chan *QueueEntry
 	acknowledgeAbuse bool
+	handles          uint64
 }
 
 type QueueEntry struct {
+	ctx      context.Context
 	request  *Request
 	response chan Response
 }
@@ -41,8 +45,32 @@ type Request struct {
 	chunkOffset      int64
 	chunkOffsetEnd   int64
 	sequence         int
+	priority         Priority
 	preload          bool
 	acknowledgeAbuse bool
+	handle           *Handle
+	token            *cancelToken
+}
+
+// cancelled checks if a preload request has been cancelled by its handle
+func (r *Request) cancelled() bool {
+	return r.preload && r.token.isCancelled()
+}
+
+// stream returns the key of the stream the request belongs to, requests of
+// an open file belong to its handle and all other requests to the file
+func (r *Request) stream() string {
+	if nil != r.handle {
+		return r.handle.stream
+	}
+	return r.object.ObjectID
+}
+
+// done marks a preload request as finished or cancelled
+func (r *Request) done() {
+	if r.preload && nil != r.handle {
+		r.handle.preloadDone()
+	}
 }
 
 // Response represetns a chunk response
@@ -54,13 +82,15 @@ type Response struct {
 
 // NewManager creates a new chunk manager
 func NewManager(
-	chunkFile string,
+	chunkFiles []ChunkFile,
 	chunkSize int64,
 	loadAhead,
 	checkThreads int,
 	loadThreads int,
 	client *drive.Client,
 	maxChunks int,
+	ramChunks int,
+	evictionPolicy string,
 	ackAbuse bool) (*Manager, error) {
 
 	pageSize := int64(os.Getpagesize())
@@ -79,7 +109,7 @@ func NewManager(
 		return nil, fmt.Errorf("max-chunks must be greater than 2 and bigger than the load ahead value")
 	}
 
-	storage, err := NewStorage(chunkSize, maxChunks, maxMmapSize, chunkFile)
+	storage, err := newChunkStorage(chunkFiles, chunkSize, maxMmapSize, maxChunks, ramChunks, evictionPolicy)
 	if nil != err {
 		return nil, err
 	}
@@ -109,8 +139,55 @@ func NewManager(
 	return &manager, nil
 }
 
-// GetChunk loads one chunk and starts the preload for the next chunks
-func (m *Manager) GetChunk(object *drive.APIObject, offset, size int64) ([]byte, error) {
+// newChunkStorage creates the storage of the chunk files, a RAM storage of
+// maxChunks chunks without chunk files or a RAM tier of ramChunks chunks in
+// front of the chunk files
+func newChunkStorage(chunkFiles []ChunkFile, chunkSize, maxMmapSize int64, maxChunks, ramChunks int, evictionPolicy string) (ChunkStorage, error) {
+	var disk ChunkStorage
+	switch len(chunkFiles) {
+	case 0:
+		policy, err := NewEvictionPolicy(evictionPolicy, maxChunks)
+		if nil != err {
+			return nil, err
+		}
+		return NewStorage(chunkSize, maxChunks, maxMmapSize, "", policy)
+	case 1:
+		policy, err := NewEvictionPolicy(evictionPolicy, chunkFiles[0].MaxChunks)
+		if nil != err {
+			return nil, err
+		}
+		storage, err := NewStorage(chunkSize, chunkFiles[0].MaxChunks, maxMmapSize, chunkFiles[0].Path, policy)
+		if nil != err {
+			return nil, err
+		}
+		disk = storage
+	default:
+		storage, err := NewShardedStorage(chunkFiles, chunkSize, maxMmapSize, evictionPolicy)
+		if nil != err {
+			return nil, err
+		}
+		disk = storage
+	}
+
+	// Keep the hot chunks of the disk cache in RAM
+	if ramChunks <= 0 {
+		return disk, nil
+	}
+	policy, err := NewEvictionPolicy(evictionPolicy, ramChunks)
+	if nil != err {
+		return nil, err
+	}
+	ram, err := NewStorage(chunkSize, ramChunks, maxMmapSize, "", policy)
+	if nil != err {
+		return nil, err
+	}
+	return NewTieredStorage(ram, disk), nil
+}
+
+// GetChunk loads one chunk of an open file and starts the preload for the next
+// chunks, the read is abandoned with the error of the context when it is cancelled
+func (m *Manager) GetChunk(ctx context.Context, handle *Handle, offset, size int64) ([]byte, error) {
+	object := handle.object
 	maxOffset := int64(object.Size)
 	if offset > maxOffset {
 		return nil, fmt.Errorf("Tried to read past EOF of %v at offset %v", object.ObjectID, offset)
@@ -120,18 +197,29 @@ func (m *Manager) GetChunk(object *drive.APIObject, offset, size int64) ([]byte,
 		size = int64(object.Size) - offset
 	}
 
+	loadAhead, token := handle.read(offset, size)
 	ranges := splitChunkRanges(offset, size, m.ChunkSize)
 	numRanges := len(ranges)
 	responses := make(chan Response, numRanges)
 
 	last := numRanges - 1
 	for i, r := range ranges {
-		m.requestChunk(object, r.offset, r.size, i, i == last, responses)
+		if i == last {
+			m.requestChunk(ctx, handle, token, r.offset, r.size, i, loadAhead, responses)
+		} else {
+			m.requestChunk(ctx, handle, token, r.offset, r.size, i, 0, responses)
+		}
 	}
 
 	data := make([]byte, size, size)
 	for i := 0; i < cap(responses); i++ {
-		res := <-responses
+		var res Response
+		select {
+		case res = <-responses:
+		case <-ctx.Done():
+			// late responses don't block, the channel is buffered
+			return nil, ctx.Err()
+		}
 		if nil != res.Error {
 			return nil, res.Error
 		}
@@ -147,13 +235,29 @@ func (m *Manager) GetChunk(object *drive.APIObject, offset, size int64) ([]byte,
 	return data, nil
 }
 
+// Streams returns the download statistics of the recently active streams
+func (m *Manager) Streams() []StreamStats {
+	return m.downloader.queue.stats()
+}
+
+// buildRequestID identifies a chunk by the MD5 checksum of the file and the
+// offset, files without MD5 checksum like Google Docs are identified by the
+// revision of the file instead
 func buildRequestID(object *drive.APIObject, offset int64) (id RequestID) {
-	hex.Decode(id[:], []byte(object.MD5Checksum))
+	if n, err := hex.Decode(id[:16], []byte(object.MD5Checksum)); nil != err || 16 != n {
+		key := fmt.Sprintf("%v:%v", object.FileID(), object.RevisionID)
+		if "" == object.RevisionID {
+			key = fmt.Sprintf("%v:%v:%v", object.FileID(), object.Size, object.LastModified.UnixNano())
+		}
+		sum := sha256.Sum256([]byte(key))
+		copy(id[:16], sum[:])
+	}
 	binary.BigEndian.PutUint64(id[16:], uint64(offset))
 	return
 }
 
-func (m *Manager) requestChunk(object *drive.APIObject, offset, size int64, sequence int, preload bool, response chan Response) {
+func (m *Manager) requestChunk(ctx context.Context, handle *Handle, token *cancelToken, offset, size int64, sequence int, loadAhead int, response chan Response) {
+	object := handle.object
 	chunkOffset := offset % m.ChunkSize
 	offsetStart := offset - chunkOffset
 	offsetEnd := offsetStart + m.ChunkSize
@@ -166,20 +270,19 @@ func (m *Manager) requestChunk(object *drive.APIObject, offset, size int64, sequ
 		chunkOffset:      chunkOffset,
 		chunkOffsetEnd:   chunkOffset + size,
 		sequence:         sequence,
+		priority:         PriorityForeground,
 		preload:          false,
 		acknowledgeAbuse: m.acknowledgeAbuse,
+		handle:           handle,
 	}
 
 	m.queue <- &QueueEntry{
+		ctx:      ctx,
 		request:  request,
 		response: response,
 	}
 
-	if !preload {
-		return
-	}
-
-	for i := m.ChunkSize; i < (m.ChunkSize * int64(m.LoadAhead+1)); i += m.ChunkSize {
+	for i := m.ChunkSize; i < (m.ChunkSize * int64(loadAhead+1)); i += m.ChunkSize {
 		aheadOffsetStart := offsetStart + i
 		aheadOffsetEnd := aheadOffsetStart + m.ChunkSize
 		if uint64(aheadOffsetStart) < object.Size && uint64(aheadOffsetEnd) < object.Size {
@@ -188,9 +291,14 @@ func (m *Manager) requestChunk(object *drive.APIObject, offset, size int64, sequ
 				object:      object,
 				offsetStart: aheadOffsetStart,
 				offsetEnd:   aheadOffsetEnd,
+				priority:    PriorityPreload,
 				preload:     true,
+				handle:      handle,
+				token:       token,
 			}
+			handle.preloadQueued()
 			m.queue <- &QueueEntry{
+				ctx:     context.Background(),
 				request: request,
 			}
 		}
@@ -218,15 +326,21 @@ func splitChunkRanges(offset, size, chunkSize int64) []byteRange {
 func (m *Manager) thread() {
 	for {
 		queueEntry := <-m.queue
-		m.checkChunk(queueEntry.request, queueEntry.response)
+		m.checkChunk(queueEntry.ctx, queueEntry.request, queueEntry.response)
 	}
 }
 
-func (m *Manager) checkChunk(req *Request, response chan Response) {
+func (m *Manager) checkChunk(ctx context.Context, req *Request, response chan Response) {
 	if nil == response {
-		if nil == m.storage.Load(req.id) {
-			m.downloader.Download(req, nil)
+		if req.cancelled() || nil != m.storage.Load(req.id) {
+			req.done()
+			return
 		}
+		m.downloader.Download(ctx, req, nil)
+		return
+	}
+	if nil != ctx.Err() {
+		// the read has been abandoned
 		return
 	}
 
@@ -238,7 +352,7 @@ func (m *Manager) checkChunk(req *Request, response chan Response) {
 		return
 	}
 
-	m.downloader.Download(req, func(err error, bytes []byte) {
+	m.downloader.Download(ctx, req, func(err error, bytes []byte) {
 		response <- Response{
 			Sequence: req.sequence,
 			Error:    err,
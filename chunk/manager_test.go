@@ -1,6 +1,11 @@
 package chunk
 
-import "testing"
+import (
+	"encoding/binary"
+	"testing"
+
+	"github.com/plexdrive/plexdrive/drive"
+)
 
 func TestSplitChunkRanges(t *testing.T) {
 	testcases := []struct {
@@ -51,3 +56,29 @@ func TestSplitChunkRanges(t *testing.T) {
 		}
 	}
 }
+
+func TestBuildRequestID(t *testing.T) {
+	withMD5 := &drive.APIObject{ObjectID: "a", MD5Checksum: "0123456789abcdef0123456789abcdef", RevisionID: "1"}
+	copied := &drive.APIObject{ObjectID: "b", MD5Checksum: "0123456789abcdef0123456789abcdef", RevisionID: "2"}
+	if buildRequestID(withMD5, 0) != buildRequestID(copied, 0) {
+		t.Fatal("Expected files with the same MD5 checksum to share their chunks")
+	}
+
+	doc := &drive.APIObject{ObjectID: "c", RevisionID: "1"}
+	otherDoc := &drive.APIObject{ObjectID: "d", RevisionID: "1"}
+	newRevision := &drive.APIObject{ObjectID: "c", RevisionID: "2"}
+	shortcut := &drive.APIObject{ObjectID: "e", TargetID: "c", RevisionID: "1"}
+	id := buildRequestID(doc, 4096)
+	if id == buildRequestID(otherDoc, 4096) {
+		t.Fatal("Expected files without MD5 checksum to have distinct chunks")
+	}
+	if id == buildRequestID(newRevision, 4096) {
+		t.Fatal("Expected revisions of a file without MD5 checksum to have distinct chunks")
+	}
+	if id != buildRequestID(shortcut, 4096) {
+		t.Fatal("Expected a shortcut to share the chunks of its target")
+	}
+	if 4096 != binary.BigEndian.Uint64(id[16:]) {
+		t.Fatalf("Expected offset 4096 in request id %v", id)
+	}
+}
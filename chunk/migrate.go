@@ -0,0 +1,350 @@
+package chunk
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"sort"
+	"unsafe"
+
+	. "github.com/claudetech/loggo/default"
+)
+
+// migratedChunk is a chunk of the new layout that is assembled from the
+// byte ranges of one or more chunks of the old layout
+type migratedChunk struct {
+	header chunkHeader
+	// parts are the ranges of the chunk in the chunk file
+	parts []byteRange
+	// sources are the old chunk indices of the parts
+	sources []int
+	slot    int
+}
+
+// journalMigration moves the chunks of a chunk file with another number of
+// chunks or another chunk size into the current layout
+type journalMigration struct {
+	s            *Storage
+	oldChunkSize int64
+	oldMaxChunks int
+	oldHeaders   []chunkHeader
+	verified     map[int]bool
+	chunks       []*migratedChunk
+	slots        []*migratedChunk
+}
+
+// migrateJournal keeps the chunks of a chunk file whose number of chunks or
+// chunk size has changed. Chunks stay in place while the file grows, the most
+// recently used chunks are compacted into the remaining chunks when it
+// shrinks and chunks are split or merged if the chunk size changes by an
+// integer factor. It returns false if the file doesn't need to be migrated.
+func (s *Storage) migrateJournal(currentSize int64) (bool, error) {
+	toc := make([]byte, tocSize, tocSize)
+	if _, err := s.ChunkFile.ReadAt(toc, currentSize-tocSize); nil != err {
+		return false, fmt.Errorf("Failed to read journal header: %v", err)
+	}
+	if !s.checkJournal(toc, true) {
+		return false, nil
+	}
+	h := (*journalHeader)(unsafe.Pointer(&toc[0]))
+	if h.maxChunks == uint32(s.MaxChunks) && h.chunkSize == uint32(s.ChunkSize) {
+		return false, nil
+	}
+
+	m := journalMigration{
+		s:            s,
+		oldChunkSize: int64(h.chunkSize),
+		oldMaxChunks: int(h.maxChunks),
+		verified:     make(map[int]bool),
+		slots:        make([]*migratedChunk, s.MaxChunks),
+	}
+	oldJournalOffset := m.oldChunkSize * int64(m.oldMaxChunks)
+	if currentSize != oldJournalOffset+int64(headerSize*m.oldMaxChunks)+tocSize {
+		return false, fmt.Errorf("Chunk cache file size %v B doesn't match the journal", currentSize)
+	}
+	if m.oldChunkSize%s.ChunkSize != 0 && s.ChunkSize%m.oldChunkSize != 0 {
+		return false, fmt.Errorf("Chunk size %v B is no multiple or fraction of the cached chunk size %v B", s.ChunkSize, m.oldChunkSize)
+	}
+	Log.Infof("Migrating chunk cache from %v chunks of %v B to %v chunks of %v B",
+		m.oldMaxChunks, m.oldChunkSize, s.MaxChunks, s.ChunkSize)
+
+	journal := make([]byte, headerSize*m.oldMaxChunks)
+	if _, err := s.ChunkFile.ReadAt(journal, oldJournalOffset); nil != err {
+		return false, fmt.Errorf("Failed to read journal: %v", err)
+	}
+	m.oldHeaders = make([]chunkHeader, m.oldMaxChunks)
+	for i := range m.oldHeaders {
+		m.oldHeaders[i] = *(*chunkHeader)(unsafe.Pointer(&journal[i*headerSize]))
+	}
+
+	// Invalidate the journal, an aborted migration discards the chunks
+	if _, err := s.ChunkFile.WriteAt(make([]byte, tocSize), currentSize-tocSize); nil != err {
+		return false, fmt.Errorf("Failed to invalidate journal header: %v", err)
+	}
+
+	switch {
+	case m.oldChunkSize > s.ChunkSize:
+		m.split()
+	case m.oldChunkSize < s.ChunkSize:
+		m.merge()
+	default:
+		m.keep()
+	}
+	if err := m.place(); nil != err {
+		return false, err
+	}
+	if err := m.writeJournal(); nil != err {
+		return false, err
+	}
+	return true, nil
+}
+
+// keep takes over all chunks of the same chunk size
+func (m *journalMigration) keep() {
+	for i, h := range m.oldHeaders {
+		if blankRequestID == h.id || int64(h.size) > m.oldChunkSize {
+			continue
+		}
+		m.chunks = append(m.chunks, &migratedChunk{
+			header:  h,
+			parts:   []byteRange{{int64(i) * m.oldChunkSize, int64(h.size)}},
+			sources: []int{i},
+		})
+	}
+}
+
+// split divides every chunk into chunks of the smaller chunk size
+func (m *journalMigration) split() {
+	for i, h := range m.oldHeaders {
+		if blankRequestID == h.id || int64(h.size) > m.oldChunkSize {
+			continue
+		}
+		offset := int64(binary.BigEndian.Uint64(h.id[16:]))
+		for start := int64(0); start < int64(h.size); start += m.s.ChunkSize {
+			c := migratedChunk{
+				header:  h,
+				parts:   []byteRange{{int64(i)*m.oldChunkSize + start, min(m.s.ChunkSize, int64(h.size)-start)}},
+				sources: []int{i},
+			}
+			binary.BigEndian.PutUint64(c.header.id[16:], uint64(offset+start))
+			c.header.size = uint32(c.parts[0].size)
+			m.chunks = append(m.chunks, &c)
+		}
+	}
+}
+
+// merge combines the chunks of a file into chunks of the bigger chunk size,
+// chunks can only be merged if all their parts are cached
+func (m *journalMigration) merge() {
+	factor := int(m.s.ChunkSize / m.oldChunkSize)
+	groups := make(map[RequestID][]int)
+	for i, h := range m.oldHeaders {
+		if blankRequestID == h.id || int64(h.size) > m.oldChunkSize {
+			continue
+		}
+		offset := int64(binary.BigEndian.Uint64(h.id[16:]))
+		if 0 != offset%m.oldChunkSize {
+			continue
+		}
+		id := h.id
+		binary.BigEndian.PutUint64(id[16:], uint64(offset-offset%m.s.ChunkSize))
+		group, exists := groups[id]
+		if !exists {
+			group = make([]int, factor)
+			for j := range group {
+				group[j] = -1
+			}
+			groups[id] = group
+		}
+		group[(offset%m.s.ChunkSize)/m.oldChunkSize] = i
+	}
+
+	for id, group := range groups {
+		c := migratedChunk{
+			header: chunkHeader{id: id},
+		}
+		complete := false
+		for _, i := range group {
+			if -1 == i {
+				break
+			}
+			h := m.oldHeaders[i]
+			c.parts = append(c.parts, byteRange{int64(i) * m.oldChunkSize, int64(h.size)})
+			c.sources = append(c.sources, i)
+			c.header.size += h.size
+			c.header.hits += h.hits
+			if h.accessed > c.header.accessed {
+				c.header.accessed = h.accessed
+			}
+			// a part that isn't full is the end of the file
+			if int64(h.size) < m.oldChunkSize {
+				complete = true
+				break
+			}
+		}
+		if complete || len(c.parts) == factor {
+			m.chunks = append(m.chunks, &c)
+		}
+	}
+}
+
+// place moves the most recently used chunks into the slots of the new layout
+func (m *journalMigration) place() error {
+	sort.Slice(m.chunks, func(i, j int) bool {
+		return m.chunks[i].header.accessed > m.chunks[j].header.accessed
+	})
+	if len(m.chunks) > m.s.MaxChunks {
+		Log.Infof("Discarding %v least recently used chunks", len(m.chunks)-m.s.MaxChunks)
+		m.chunks = m.chunks[:m.s.MaxChunks]
+	}
+
+	// Chunks that are already aligned to a slot stay in place
+	pending := make([]*migratedChunk, 0)
+	for _, c := range m.chunks {
+		c.slot = -1
+		if 1 == len(c.parts) && 0 == c.parts[0].offset%m.s.ChunkSize {
+			if slot := int(c.parts[0].offset / m.s.ChunkSize); slot < m.s.MaxChunks {
+				c.slot = slot
+				m.slots[slot] = c
+				continue
+			}
+		}
+		pending = append(pending, c)
+	}
+
+	// blockers counts the pending chunks whose data lies in a slot, chunks
+	// are only moved into empty slots without blockers
+	blockers := make([]int, m.s.MaxChunks)
+	free := make([]int, 0)
+	block := func(c *migratedChunk, delta int) {
+		for _, p := range c.parts {
+			last := min((p.offset+p.size-1)/m.s.ChunkSize, int64(m.s.MaxChunks-1))
+			for slot := p.offset / m.s.ChunkSize; slot <= last; slot++ {
+				blockers[slot] += delta
+				if 0 == blockers[slot] && nil == m.slots[slot] {
+					free = append(free, int(slot))
+				}
+			}
+		}
+	}
+	for _, c := range pending {
+		block(c, 1)
+	}
+	for slot := range m.slots {
+		if 0 == blockers[slot] && nil == m.slots[slot] {
+			free = append(free, slot)
+		}
+	}
+	nextSlot := func() int {
+		for len(free) > 0 {
+			slot := free[len(free)-1]
+			free = free[:len(free)-1]
+			if 0 == blockers[slot] && nil == m.slots[slot] {
+				return slot
+			}
+		}
+		return -1
+	}
+
+	buffer := make([]byte, m.s.ChunkSize)
+	for len(pending) > 0 {
+		c := pending[0]
+		block(c, -1)
+		slot := nextSlot()
+		if -1 == slot {
+			// all empty slots hold data of pending chunks, discard the least
+			// recently used pending chunk to free its slots
+			block(c, 1)
+			discarded := pending[len(pending)-1]
+			pending = pending[:len(pending)-1]
+			block(discarded, -1)
+			Log.Debugf("Discarding chunk %v, no slot available", discarded.header.id)
+			continue
+		}
+		pending = pending[1:]
+
+		if err := m.read(c, buffer); nil != err {
+			Log.Debugf("Discarding chunk %v: %v", c.header.id, err)
+			free = append(free, slot)
+			continue
+		}
+		if _, err := m.s.ChunkFile.WriteAt(buffer[:c.header.size], int64(slot)*m.s.ChunkSize); nil != err {
+			return fmt.Errorf("Failed to move chunk %v: %v", c.header.id, err)
+		}
+		c.slot = slot
+		m.slots[slot] = c
+	}
+
+	// Recalculate the checksums of split chunks that stayed in place
+	for _, c := range m.slots {
+		if nil == c || c.header.size == m.oldHeaders[c.sources[0]].size || c.parts[0].offset != int64(c.slot)*m.s.ChunkSize {
+			continue
+		}
+		if err := m.read(c, buffer); nil != err {
+			Log.Debugf("Discarding chunk %v: %v", c.header.id, err)
+			m.slots[c.slot] = nil
+		}
+	}
+	return nil
+}
+
+// read verifies the old chunks of a chunk and reads its data into the buffer
+// to calculate the new checksum
+func (m *journalMigration) read(c *migratedChunk, buffer []byte) error {
+	for _, i := range c.sources {
+		if err := m.verify(i); nil != err {
+			return err
+		}
+	}
+	n := int64(0)
+	for _, p := range c.parts {
+		if _, err := m.s.ChunkFile.ReadAt(buffer[n:n+p.size], p.offset); nil != err {
+			return err
+		}
+		n += p.size
+	}
+	c.header.checksum = crc32.Checksum(buffer[:n], crc32Table)
+	return nil
+}
+
+// verify checks the checksum of an old chunk
+func (m *journalMigration) verify(index int) error {
+	valid, exists := m.verified[index]
+	if !exists {
+		h := m.oldHeaders[index]
+		data := make([]byte, h.size)
+		if _, err := m.s.ChunkFile.ReadAt(data, int64(index)*m.oldChunkSize); nil != err {
+			return err
+		}
+		valid = h.checksum == crc32.Checksum(data, crc32Table)
+		m.verified[index] = valid
+	}
+	if !valid {
+		return fmt.Errorf("Bad checksum of old chunk %v", index)
+	}
+	return nil
+}
+
+// writeJournal resizes the chunk file and writes the journal of the new layout
+func (m *journalMigration) writeJournal() error {
+	journalOffset := m.s.ChunkSize * int64(m.s.MaxChunks)
+	journal := make([]byte, int64(headerSize*m.s.MaxChunks)+tocSize)
+	kept := 0
+	for slot, c := range m.slots {
+		if nil == c {
+			continue
+		}
+		*(*chunkHeader)(unsafe.Pointer(&journal[slot*headerSize])) = c.header
+		kept++
+	}
+	m.s.initJournal(journal[len(journal)-int(tocSize):])
+
+	if err := m.s.ChunkFile.Truncate(journalOffset); nil != err {
+		return fmt.Errorf("Could not resize chunk cache file: %v", err)
+	}
+	if _, err := m.s.ChunkFile.WriteAt(journal, journalOffset); nil != err {
+		return fmt.Errorf("Failed to write journal: %v", err)
+	}
+	Log.Infof("Kept %v chunks", kept)
+	return nil
+}
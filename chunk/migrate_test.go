@@ -0,0 +1,156 @@
+package chunk
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"unsafe"
+)
+
+// fileChunkID builds the request id of a chunk of a test file
+func fileChunkID(file byte, offset int64) RequestID {
+	var id RequestID
+	id[0] = file
+	binary.BigEndian.PutUint64(id[16:], uint64(offset))
+	return id
+}
+
+// fileChunk returns the content of a chunk of a test file, every page of a
+// file has its own content
+func fileChunk(file byte, offset, size int64) []byte {
+	pageSize := int64(os.Getpagesize())
+	data := make([]byte, 0, size)
+	for page := offset / pageSize; int64(len(data)) < size; page++ {
+		data = append(data, bytes.Repeat([]byte{file + byte(page)}, int(pageSize))...)
+	}
+	return data[:size]
+}
+
+func migrateStorage(t *testing.T, chunkFile string, chunkSize int64, maxChunks int) *Storage {
+	storage, err := NewStorage(chunkSize, maxChunks, 1<<30, chunkFile, NewStack(maxChunks))
+	if nil != err {
+		t.Fatal(err)
+	}
+	return storage
+}
+
+func TestMigrateJournal(t *testing.T) {
+	dir, err := ioutil.TempDir("", "plexdrive-migrate")
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	chunkFile := filepath.Join(dir, "chunks.dat")
+	pageSize := int64(os.Getpagesize())
+
+	// 4 chunks of file 1 and 2 chunks of file 2, the last chunk of file 2 isn't full
+	storage := migrateStorage(t, chunkFile, 2*pageSize, 8)
+	for i := int64(0); i < 4; i++ {
+		storage.Store(fileChunkID(1, i*2*pageSize), fileChunk(1, i*2*pageSize, 2*pageSize))
+	}
+	storage.Store(fileChunkID(2, 0), fileChunk(2, 0, 2*pageSize))
+	storage.Store(fileChunkID(2, 2*pageSize), fileChunk(2, 2*pageSize, pageSize/2))
+
+	check := func(storage *Storage, file byte, offset, size int64) {
+		// loaded chunks span the whole buffer
+		if b := storage.Load(fileChunkID(file, offset)); int64(len(b)) < size || !bytes.Equal(fileChunk(file, offset, size), b[:size]) {
+			t.Fatalf("Expected chunk %v:%v to be kept", file, offset)
+		}
+	}
+
+	// grow keeps all chunks
+	storage = migrateStorage(t, chunkFile, 2*pageSize, 16)
+	for i := int64(0); i < 4; i++ {
+		check(storage, 1, i*2*pageSize, 2*pageSize)
+	}
+	check(storage, 2, 2*pageSize, pageSize/2)
+
+	// split divides every chunk
+	storage = migrateStorage(t, chunkFile, pageSize, 32)
+	for i := int64(0); i < 8; i++ {
+		check(storage, 1, i*pageSize, pageSize)
+	}
+	check(storage, 2, 2*pageSize, pageSize/2)
+
+	// merge combines the chunks again
+	storage = migrateStorage(t, chunkFile, 4*pageSize, 8)
+	check(storage, 1, 0, 4*pageSize)
+	check(storage, 1, 4*pageSize, 4*pageSize)
+	check(storage, 2, 0, 2*pageSize+pageSize/2)
+
+	// shrink keeps the most recently used chunks
+	storage.Load(fileChunkID(1, 4*pageSize))
+	storage = migrateStorage(t, chunkFile, 4*pageSize, 1)
+	check(storage, 1, 4*pageSize, 4*pageSize)
+	if nil != storage.Load(fileChunkID(1, 0)) {
+		t.Fatal("Expected the least recently used chunk to be discarded")
+	}
+}
+
+// writeLegacyChunkFile writes a chunk file with a journal of the legacy
+// version that contains the given chunks in their order
+func writeLegacyChunkFile(t *testing.T, chunkFile string, chunkSize int64, maxChunks int, ids []RequestID) {
+	data := make([]byte, chunkSize*int64(maxChunks)+int64(legacyHeaderSize*maxChunks)+tocSize)
+	journal := data[chunkSize*int64(maxChunks):]
+	for i, id := range ids {
+		chunk := fileChunk(id[0], int64(binary.BigEndian.Uint64(id[16:])), chunkSize)
+		copy(data[int64(i)*chunkSize:], chunk)
+		*(*legacyChunkHeader)(unsafe.Pointer(&journal[i*legacyHeaderSize])) = legacyChunkHeader{
+			id:       id,
+			size:     uint32(chunkSize),
+			checksum: crc32.Checksum(chunk, crc32Table),
+		}
+	}
+	toc := journal[legacyHeaderSize*maxChunks:]
+	h := (*journalHeader)(unsafe.Pointer(&toc[0]))
+	*h = journalHeader{
+		magic:      journalMagic,
+		version:    legacyJournalVersion,
+		headerSize: uint8(legacyHeaderSize),
+		maxChunks:  uint32(maxChunks),
+		chunkSize:  uint32(chunkSize),
+	}
+	h.checksum = crc32.Checksum(toc[:12], crc32Table)
+	if err := ioutil.WriteFile(chunkFile, data, 0600); nil != err {
+		t.Fatal(err)
+	}
+}
+
+func TestUpgradeJournal(t *testing.T) {
+	dir, err := ioutil.TempDir("", "plexdrive-upgrade")
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	chunkFile := filepath.Join(dir, "chunks.dat")
+	pageSize := int64(os.Getpagesize())
+
+	// the previous version stored chunks of files without MD5 with a blank checksum
+	writeLegacyChunkFile(t, chunkFile, pageSize, 4, []RequestID{
+		fileChunkID(1, 0),
+		fileChunkID(0, pageSize),
+		fileChunkID(1, pageSize),
+		fileChunkID(2, 0),
+	})
+	storage := migrateStorage(t, chunkFile, pageSize, 4)
+	if nil != storage.Load(fileChunkID(0, pageSize)) {
+		t.Fatal("Expected the chunk without MD5 checksum to be discarded")
+	}
+	for _, id := range []RequestID{fileChunkID(1, 0), fileChunkID(1, pageSize), fileChunkID(2, 0)} {
+		offset := int64(binary.BigEndian.Uint64(id[16:]))
+		if b := storage.Load(id); !bytes.Equal(fileChunk(id[0], offset, pageSize), b) {
+			t.Fatalf("Expected chunk %v:%v to be kept", id[0], offset)
+		}
+	}
+
+	// a journal of the previous version with another layout is migrated after the upgrade
+	writeLegacyChunkFile(t, chunkFile, pageSize, 4, []RequestID{fileChunkID(1, 0)})
+	storage = migrateStorage(t, chunkFile, pageSize, 8)
+	if b := storage.Load(fileChunkID(1, 0)); int64(len(b)) < pageSize || !bytes.Equal(fileChunk(1, 0, pageSize), b[:pageSize]) {
+		t.Fatal("Expected chunk 1:0 to be kept")
+	}
+}
@@ -0,0 +1,253 @@
+package chunk
+
+import (
+	"container/list"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// correlationPeriod is the time in which the reads of a chunk count as one
+// reference, the kernel reads a chunk in many small reads
+var correlationPeriod = 10 * time.Second
+
+// policyClock gets the time of a read
+var policyClock = time.Now
+
+// EvictionPolicy decides which chunk buffer is reused next. A policy tracks
+// the indices of all buffers and follows the contract of Stack: Pop fails
+// until all buffers are tracked, and purged buffers are reused first.
+type EvictionPolicy interface {
+	// Len gets the number of tracked buffers
+	Len() int
+	// Pop removes the buffer that should be reused next
+	Pop() int
+	// Touch records a read of a buffer and reports if it counted as a new
+	// reference to the chunk
+	Touch(item *list.Element) bool
+	// Push adds a buffer that has just been filled
+	Push(index int) *list.Element
+	// Prepend adds a list of unused buffers, they are reused first
+	Prepend(items *list.List)
+	// Purge marks a buffer to be reused next
+	Purge(item *list.Element)
+	// Restore adds a buffer that was loaded from the journal with the number
+	// of hits since it was filled, buffers are restored from the least to the
+	// most recently used
+	Restore(index int, id RequestID, hits uint32) *list.Element
+}
+
+// keyedPolicy is implemented by policies that remember the ids of evicted
+// chunks to detect that they are requested again
+type keyedPolicy interface {
+	// PopFor removes the buffer that should be reused for a chunk
+	PopFor(id RequestID) int
+	// PushID adds a buffer that has just been filled with a chunk
+	PushID(index int, id RequestID) *list.Element
+}
+
+// EvictionPolicies are the names of all eviction policies
+var EvictionPolicies = []string{"lru", "lfu", "2q", "arc"}
+
+// NewEvictionPolicy creates an eviction policy by name
+func NewEvictionPolicy(name string, maxChunks int) (EvictionPolicy, error) {
+	switch name {
+	case "lru":
+		return NewStack(maxChunks), nil
+	case "lfu":
+		return NewLFU(maxChunks), nil
+	case "2q":
+		return NewTwoQueue(maxChunks), nil
+	case "arc":
+		return NewARC(maxChunks), nil
+	default:
+		return nil, fmt.Errorf("Unknown chunk eviction policy %v (available: lru, lfu, 2q, arc)", name)
+	}
+}
+
+// policyEntry is a buffer tracked by a policy, the handles returned to the
+// storage reference the entry
+type policyEntry struct {
+	index    int
+	id       RequestID
+	hits     uint32
+	accessed uint64
+	// read is the time of the last read, filled marks a buffer that wasn't
+	// read since it was filled
+	read    time.Time
+	filled  bool
+	queue   *list.List
+	element *list.Element
+}
+
+// policyQueues contains the state shared by all queue based policies
+type policyQueues struct {
+	lock    sync.Mutex
+	maxSize int
+	size    int
+	clock   uint64
+	free    *list.List
+}
+
+func newPolicyQueues(maxSize int) policyQueues {
+	return policyQueues{
+		maxSize: maxSize,
+		free:    list.New(),
+	}
+}
+
+// entry gets the entry of a handle
+func entry(item *list.Element) *policyEntry {
+	if nil == item {
+		return nil
+	}
+	e, _ := item.Value.(*policyEntry)
+	return e
+}
+
+// track adds a new entry to the back of a queue
+func (p *policyQueues) track(index int, id RequestID, queue *list.List) *list.Element {
+	p.size++
+	e := &policyEntry{
+		index:  index,
+		id:     id,
+		filled: true,
+	}
+	p.moveToBack(e, queue)
+	return &list.Element{Value: e}
+}
+
+// restore adds an entry that was loaded from the journal, its next read is a
+// new reference
+func (p *policyQueues) restore(index int, id RequestID, queue *list.List) *list.Element {
+	item := p.track(index, id, queue)
+	entry(item).filled = false
+	return item
+}
+
+// reference records a read of an entry and reports if it is a new reference.
+// The first read after the buffer was filled belongs to the request that
+// filled it and reads within the correlation period of the previous read
+// belong to the same reference, so a scan never counts as a hit.
+func (p *policyQueues) reference(e *policyEntry) bool {
+	now := policyClock()
+	correlated := e.filled || now.Sub(e.read) < correlationPeriod
+	e.filled = false
+	e.read = now
+	return !correlated
+}
+
+// untrack removes an entry and returns its index
+func (p *policyQueues) untrack(e *policyEntry) int {
+	p.size--
+	e.queue.Remove(e.element)
+	e.queue = nil
+	e.element = nil
+	return e.index
+}
+
+// moveToBack moves an entry to the back of a queue
+func (p *policyQueues) moveToBack(e *policyEntry, queue *list.List) {
+	p.clock++
+	e.accessed = p.clock
+	if queue == e.queue {
+		queue.MoveToBack(e.element)
+		return
+	}
+	if nil != e.queue {
+		e.queue.Remove(e.element)
+	}
+	e.queue = queue
+	e.element = queue.PushBack(e)
+}
+
+// pending checks if a buffer can't be popped yet or returns a free buffer
+func (p *policyQueues) pending() (int, bool) {
+	if p.size < p.maxSize {
+		return -1, true
+	}
+	if item := p.free.Front(); nil != item {
+		return p.untrack(item.Value.(*policyEntry)), true
+	}
+	return -1, false
+}
+
+// Len gets the number of tracked buffers
+func (p *policyQueues) Len() int {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return p.size
+}
+
+// Prepend adds a list of unused buffers, they are reused first
+func (p *policyQueues) Prepend(items *list.List) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	for item := items.Back(); nil != item; item = item.Prev() {
+		p.size++
+		e := &policyEntry{
+			index: item.Value.(int),
+			queue: p.free,
+		}
+		e.element = p.free.PushFront(e)
+	}
+}
+
+// Purge marks a buffer to be reused next
+func (p *policyQueues) Purge(item *list.Element) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	e := entry(item)
+	if nil == e || nil == e.queue {
+		return
+	}
+	e.queue.Remove(e.element)
+	e.queue = p.free
+	e.element = p.free.PushFront(e)
+}
+
+// ghostList remembers the ids of recently evicted chunks
+type ghostList struct {
+	ids      *list.List
+	elements map[RequestID]*list.Element
+}
+
+func newGhostList() *ghostList {
+	return &ghostList{
+		ids:      list.New(),
+		elements: make(map[RequestID]*list.Element),
+	}
+}
+
+func (g *ghostList) Len() int {
+	return g.ids.Len()
+}
+
+func (g *ghostList) contains(id RequestID) bool {
+	_, exists := g.elements[id]
+	return exists
+}
+
+// add remembers an id and forgets the oldest ids above the max size
+func (g *ghostList) add(id RequestID, maxSize int) {
+	if blankRequestID == id || g.contains(id) {
+		return
+	}
+	g.elements[id] = g.ids.PushBack(id)
+	for g.ids.Len() > maxSize {
+		g.removeOldest()
+	}
+}
+
+func (g *ghostList) remove(id RequestID) {
+	if element, exists := g.elements[id]; exists {
+		g.ids.Remove(element)
+		delete(g.elements, id)
+	}
+}
+
+func (g *ghostList) removeOldest() {
+	if element := g.ids.Front(); nil != element {
+		g.remove(element.Value.(RequestID))
+	}
+}
@@ -0,0 +1,180 @@
+package chunk
+
+import (
+	"container/list"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func testRequestID(n int) RequestID {
+	var id RequestID
+	// the blank id marks an empty buffer
+	id[0] = 1
+	id[1] = byte(n)
+	id[2] = byte(n >> 8)
+	return id
+}
+
+// fakePolicyClock replaces the clock of the policies and returns a function
+// that advances it past the correlation period
+func fakePolicyClock() func() {
+	now := time.Now()
+	policyClock = func() time.Time {
+		return now
+	}
+	return func() {
+		now = now.Add(correlationPeriod)
+	}
+}
+
+// fillPolicy simulates the storage with n chunks and returns a function that
+// requests a chunk with the given number of reads and reports if it was
+// cached, the kernel reads a chunk in many small reads
+func fillPolicy(policy EvictionPolicy, n int) func(id RequestID, reads int) bool {
+	empty := list.New()
+	for i := 0; i < n; i++ {
+		empty.PushBack(i)
+	}
+	policy.Prepend(empty)
+
+	items := make(map[RequestID]*list.Element)
+	indices := make(map[int]RequestID)
+	return func(id RequestID, reads int) bool {
+		if item, exists := items[id]; exists {
+			for i := 0; i < reads; i++ {
+				policy.Touch(item)
+			}
+			return true
+		}
+		var index int
+		if keyed, ok := policy.(keyedPolicy); ok {
+			index = keyed.PopFor(id)
+		} else {
+			index = policy.Pop()
+		}
+		if -1 == index {
+			panic("no buffer available")
+		}
+		if old, exists := indices[index]; exists {
+			delete(items, old)
+		}
+		indices[index] = id
+		if keyed, ok := policy.(keyedPolicy); ok {
+			items[id] = keyed.PushID(index, id)
+		} else {
+			items[id] = policy.Push(index)
+		}
+		// the first read fills the buffer
+		for i := 1; i < reads; i++ {
+			policy.Touch(items[id])
+		}
+		return false
+	}
+}
+
+func TestScanResistance(t *testing.T) {
+	advance := fakePolicyClock()
+	defer func() { policyClock = time.Now }()
+	for _, name := range []string{"lfu", "2q", "arc"} {
+		policy, err := NewEvictionPolicy(name, 8)
+		if nil != err {
+			t.Fatal(err)
+		}
+		request := fillPolicy(policy, 8)
+
+		// a hot set of 4 chunks is requested repeatedly
+		for round := 0; round < 4; round++ {
+			for i := 0; i < 4; i++ {
+				request(testRequestID(i), 8)
+			}
+			advance()
+		}
+		// a scan reads 32 chunks once, every chunk in many reads
+		for i := 100; i < 132; i++ {
+			request(testRequestID(i), 8)
+		}
+		for i := 0; i < 4; i++ {
+			if !request(testRequestID(i), 1) {
+				t.Errorf("%v: expected hot chunk %v to survive the scan", name, i)
+			}
+		}
+		if 8 != policy.Len() {
+			t.Errorf("%v: expected 8 tracked buffers got %v", name, policy.Len())
+		}
+	}
+}
+
+func TestPolicyPurge(t *testing.T) {
+	for _, name := range EvictionPolicies {
+		policy, err := NewEvictionPolicy(name, 2)
+		if nil != err {
+			t.Fatal(err)
+		}
+		if -1 != policy.Pop() {
+			t.Fatalf("%v: expected -1 while not all buffers are tracked", name)
+		}
+		policy.Push(0)
+		item := policy.Push(1)
+		policy.Purge(item)
+		if v := policy.Pop(); 1 != v {
+			t.Fatalf("%v: expected purged buffer 1 got %v", name, v)
+		}
+		if v := policy.Pop(); -1 != v {
+			t.Fatalf("%v: expected -1 got %v", name, v)
+		}
+	}
+}
+
+func TestUnknownPolicy(t *testing.T) {
+	if _, err := NewEvictionPolicy("fifo", 2); nil == err {
+		t.Fatal("Expected an error for an unknown policy")
+	}
+}
+
+func TestRestorePolicy(t *testing.T) {
+	advance := fakePolicyClock()
+	defer func() { policyClock = time.Now }()
+	dir, err := ioutil.TempDir("", "plexdrive-policy")
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	chunkFile := filepath.Join(dir, "chunks.dat")
+	chunkSize := int64(os.Getpagesize())
+	data := make([]byte, chunkSize)
+
+	storage, err := NewStorage(chunkSize, 4, 1<<30, chunkFile, NewARC(4))
+	if nil != err {
+		t.Fatal(err)
+	}
+	for i := 0; i < 4; i++ {
+		if err := storage.Store(testRequestID(i), data); nil != err {
+			t.Fatal(err)
+		}
+	}
+	// chunk 0 is hot and chunk 1 is the most recently stored
+	storage.Load(testRequestID(0))
+	advance()
+	storage.Load(testRequestID(0))
+
+	restored, err := NewStorage(chunkSize, 4, 1<<30, chunkFile, NewARC(4))
+	if nil != err {
+		t.Fatal(err)
+	}
+	for i := 4; i < 7; i++ {
+		if err := restored.Store(testRequestID(i), data); nil != err {
+			t.Fatal(err)
+		}
+	}
+	if nil == restored.Load(testRequestID(0)) {
+		t.Fatal("Expected hot chunk 0 to be restored")
+	}
+	for i := 1; i < 4; i++ {
+		if nil != restored.Load(testRequestID(i)) {
+			t.Fatalf("Expected chunk %v to be evicted", i)
+		}
+	}
+}
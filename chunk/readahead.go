@@ -0,0 +1,72 @@
+package chunk
+
+import (
+	"sync"
+)
+
+const (
+	// sequentialGap is the distance to the end of the last read up to which
+	// a read still counts as sequential, the kernel reorders parallel reads
+	sequentialGap = 1 << 20
+	// sequentialReads is the number of sequential reads after which the
+	// stream is considered sequential and chunks are read ahead
+	sequentialReads = 4
+)
+
+// readAhead tracks the reads of an open file to adapt the number of chunks
+// that are read ahead. Sequential reads grow the read ahead up to the
+// maximum each time they reach a new chunk, random reads disable it.
+type readAhead struct {
+	lock       sync.Mutex
+	chunkSize  int64
+	maxWindow  int
+	nextOffset int64
+	lastChunk  int64
+	reads      int
+	window     int
+}
+
+func newReadAhead(chunkSize int64, maxWindow int) *readAhead {
+	return &readAhead{
+		chunkSize: chunkSize,
+		maxWindow: maxWindow,
+		lastChunk: -1,
+	}
+}
+
+// record registers a read and returns the number of chunks to read ahead and
+// if the read seeked away from the chunks that have been read ahead
+func (r *readAhead) record(offset, size int64) (int, bool) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	end := offset + size
+	seeked := r.reads > 0 && (end < r.nextOffset-sequentialGap || offset > r.nextOffset+int64(r.window+1)*r.chunkSize)
+	if r.reads > 0 && offset <= r.nextOffset+sequentialGap && end >= r.nextOffset-sequentialGap {
+		r.reads++
+		if end > r.nextOffset {
+			r.nextOffset = end
+		}
+	} else {
+		r.reads = 1
+		r.window = 0
+		r.nextOffset = end
+		r.lastChunk = offset / r.chunkSize
+	}
+
+	if r.reads < sequentialReads {
+		return r.window, seeked
+	}
+	chunk := (end - 1) / r.chunkSize
+	if 0 == r.window {
+		r.window = 1
+		r.lastChunk = chunk
+	} else if chunk > r.lastChunk {
+		r.window *= 2
+		r.lastChunk = chunk
+	}
+	if r.window > r.maxWindow {
+		r.window = r.maxWindow
+	}
+	return r.window, seeked
+}
@@ -0,0 +1,51 @@
+package chunk
+
+import "testing"
+
+func TestReadAhead(t *testing.T) {
+	const chunkSize = 10 << 20
+	const readSize = 128 << 10
+	r := newReadAhead(chunkSize, 8)
+
+	// the first reads of a stream don't read ahead
+	offset := int64(0)
+	for i := 0; i < sequentialReads-1; i++ {
+		if window, _ := r.record(offset, readSize); 0 != window {
+			t.Fatalf("Expected no read ahead after %v reads got %v", i+1, window)
+		}
+		offset += readSize
+	}
+
+	// sequential reads grow the read ahead with every new chunk
+	expected := []int{1, 2, 4, 8, 8}
+	for _, e := range expected {
+		window := 0
+		for end := (offset/chunkSize + 1) * chunkSize; offset < end; offset += readSize {
+			window, _ = r.record(offset, readSize)
+		}
+		if e != window {
+			t.Fatalf("Expected read ahead %v at offset %v got %v", e, offset, window)
+		}
+	}
+
+	// reordered reads are still sequential
+	if window, seeked := r.record(offset+readSize, readSize); 8 != window || seeked {
+		t.Fatalf("Expected read ahead 8 for a reordered read got %v", window)
+	}
+	if window, seeked := r.record(offset, readSize); 8 != window || seeked {
+		t.Fatalf("Expected read ahead 8 for a reordered read got %v", window)
+	}
+
+	// a seek into the chunks that have been read ahead is no far seek
+	if _, seeked := r.record(offset+4*chunkSize, readSize); seeked {
+		t.Fatal("Expected a seek into the read ahead not to be far")
+	}
+
+	// a far seek disables the read ahead
+	if window, seeked := r.record(offset+100*chunkSize, readSize); 0 != window || !seeked {
+		t.Fatalf("Expected no read ahead after a far seek got %v", window)
+	}
+	if window, seeked := r.record(0, readSize); 0 != window || !seeked {
+		t.Fatalf("Expected no read ahead after a far seek got %v", window)
+	}
+}
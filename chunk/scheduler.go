@@ -0,0 +1,334 @@
+package chunk
+
+import (
+	"container/list"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Priority orders the download requests, requests with a higher priority are
+// downloaded first
+type Priority int
+
+const (
+	// PriorityPreload is the priority of chunks that are read ahead
+	PriorityPreload Priority = iota
+	// PriorityForeground is the priority of chunks a read is waiting for
+	PriorityForeground
+	numPriorities
+)
+
+func (p Priority) String() string {
+	switch p {
+	case PriorityPreload:
+		return "preload"
+	case PriorityForeground:
+		return "foreground"
+	}
+	return "unknown"
+}
+
+const (
+	// maxQueuedPreloads is the maximum number of queued preload requests, the
+	// oldest preloads of the stream with the most queued preloads are dropped
+	// when more are queued
+	maxQueuedPreloads = 100
+	// streamIdleTimeout is the time after which the statistics of a stream
+	// without downloads are removed
+	streamIdleTimeout = time.Minute
+)
+
+// StreamStats are the download statistics of a stream
+type StreamStats struct {
+	Stream     string
+	Name       string
+	Queued     int
+	Preloads   int
+	Running    int
+	Share      int
+	Downloaded uint64
+	Dropped    uint64
+	LastActive time.Time
+}
+
+// stream are the queued requests of an open file, the downloads are shared
+// fairly between the streams
+type stream struct {
+	key        string
+	name       string
+	queues     [numPriorities]*list.List
+	running    int
+	vtime      uint64
+	downloaded uint64
+	dropped    uint64
+	lastActive time.Time
+}
+
+func (s *stream) queued() int {
+	n := 0
+	for _, queue := range s.queues {
+		n += queue.Len()
+	}
+	return n
+}
+
+func (s *stream) active() bool {
+	return s.running > 0 || s.queued() > 0
+}
+
+// downloadQueue schedules the download requests by priority and shares the
+// downloads of a priority fairly between the streams. The stream with the
+// fewest running downloads is served next, so that every stream gets its
+// share of the download threads, and of those the stream that has been
+// served the least. Requests of a stream are downloaded in order.
+type downloadQueue struct {
+	lock        sync.Mutex
+	cond        *sync.Cond
+	streams     map[string]*stream
+	elements    map[RequestID]*list.Element
+	preloads    int
+	maxPreloads int
+	threads     int
+	vtime       uint64
+}
+
+func newDownloadQueue(threads, maxPreloads int) *downloadQueue {
+	q := &downloadQueue{
+		streams:     make(map[string]*stream),
+		elements:    make(map[RequestID]*list.Element),
+		maxPreloads: maxPreloads,
+		threads:     threads,
+	}
+	q.cond = sync.NewCond(&q.lock)
+	return q
+}
+
+// push queues a request and returns the preload requests that have been
+// dropped to make room for it
+func (q *downloadQueue) push(req *Request) []*Request {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	s := q.stream(req)
+	if !s.active() && s.vtime < q.vtime {
+		// an idle stream must not catch up on the downloads it didn't need
+		s.vtime = q.vtime
+	}
+	q.elements[req.id] = s.queues[req.priority].PushBack(req)
+	if PriorityPreload == req.priority {
+		q.preloads++
+	}
+	q.cond.Signal()
+
+	var dropped []*Request
+	for q.preloads > q.maxPreloads {
+		dropped = append(dropped, q.dropPreload())
+	}
+	return dropped
+}
+
+// promote raises the priority of a queued request, it returns false if the
+// request isn't queued anymore
+func (q *downloadQueue) promote(id RequestID, priority Priority) bool {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	element, exists := q.elements[id]
+	if !exists {
+		return false
+	}
+	req := element.Value.(*Request)
+	if req.priority < priority {
+		s := q.streams[req.stream()]
+		s.queues[req.priority].Remove(element)
+		if PriorityPreload == req.priority {
+			q.preloads--
+		}
+		req.priority = priority
+		q.elements[id] = s.queues[priority].PushBack(req)
+	}
+	return true
+}
+
+// remove removes a queued request, it returns false if the request isn't
+// queued anymore
+func (q *downloadQueue) remove(id RequestID) bool {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	element, exists := q.elements[id]
+	if !exists {
+		return false
+	}
+	req := element.Value.(*Request)
+	s := q.streams[req.stream()]
+	s.queues[req.priority].Remove(element)
+	delete(q.elements, id)
+	if PriorityPreload == req.priority {
+		q.preloads--
+	}
+	s.dropped++
+	return true
+}
+
+// pop waits for a queued request and returns the next request of the stream
+// that is served next, the request must be finished after the download
+func (q *downloadQueue) pop() *Request {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	for {
+		for p := numPriorities - 1; p >= 0; p-- {
+			if s := q.next(p); nil != s {
+				req := s.queues[p].Remove(s.queues[p].Front()).(*Request)
+				delete(q.elements, req.id)
+				if PriorityPreload == p {
+					q.preloads--
+				}
+				q.vtime = s.vtime
+				s.vtime++
+				s.running++
+				s.lastActive = time.Now()
+				return req
+			}
+		}
+		q.cond.Wait()
+	}
+}
+
+// finish marks the download of a popped request as done or dropped
+func (q *downloadQueue) finish(req *Request, downloaded bool) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	s := q.stream(req)
+	s.running--
+	s.lastActive = time.Now()
+	if downloaded {
+		s.downloaded++
+	} else {
+		s.dropped++
+	}
+}
+
+// stats returns the statistics of the recently active streams
+func (q *downloadQueue) stats() []StreamStats {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	q.removeIdle()
+	share := q.share()
+	stats := make([]StreamStats, 0, len(q.streams))
+	for _, s := range q.streams {
+		stat := StreamStats{
+			Stream:     s.key,
+			Name:       s.name,
+			Queued:     s.queues[PriorityForeground].Len(),
+			Preloads:   s.queues[PriorityPreload].Len(),
+			Running:    s.running,
+			Downloaded: s.downloaded,
+			Dropped:    s.dropped,
+			LastActive: s.lastActive,
+		}
+		if s.active() {
+			stat.Share = share
+		}
+		stats = append(stats, stat)
+	}
+	sort.Slice(stats, func(i, j int) bool {
+		return stats[i].Stream < stats[j].Stream
+	})
+	return stats
+}
+
+// len returns the number of queued requests of a priority
+func (q *downloadQueue) len(priority Priority) int {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	n := 0
+	for _, s := range q.streams {
+		n += s.queues[priority].Len()
+	}
+	return n
+}
+
+// stream returns the stream of a request and creates it if needed
+func (q *downloadQueue) stream(req *Request) *stream {
+	key := req.stream()
+	s, exists := q.streams[key]
+	if !exists {
+		q.removeIdle()
+		s = &stream{
+			key:        key,
+			lastActive: time.Now(),
+		}
+		if nil != req.object {
+			s.name = req.object.Name
+		}
+		for i := range s.queues {
+			s.queues[i] = list.New()
+		}
+		q.streams[key] = s
+	}
+	return s
+}
+
+// next returns the stream with queued requests of the priority that is
+// served next
+func (q *downloadQueue) next(priority Priority) *stream {
+	var next *stream
+	for _, s := range q.streams {
+		if 0 == s.queues[priority].Len() {
+			continue
+		}
+		if nil == next || s.running < next.running ||
+			(s.running == next.running && (s.vtime < next.vtime || (s.vtime == next.vtime && s.key < next.key))) {
+			next = s
+		}
+	}
+	return next
+}
+
+// dropPreload removes the oldest queued preload request of the stream with
+// the most queued preloads
+func (q *downloadQueue) dropPreload() *Request {
+	var victim *stream
+	for _, s := range q.streams {
+		if nil == victim || s.queues[PriorityPreload].Len() > victim.queues[PriorityPreload].Len() {
+			victim = s
+		}
+	}
+	preloads := victim.queues[PriorityPreload]
+	req := preloads.Remove(preloads.Front()).(*Request)
+	delete(q.elements, req.id)
+	q.preloads--
+	victim.dropped++
+	return req
+}
+
+// share returns the number of download threads every active stream is
+// guaranteed, streams take turns if there are more streams than threads
+func (q *downloadQueue) share() int {
+	active := 0
+	for _, s := range q.streams {
+		if s.active() {
+			active++
+		}
+	}
+	if 0 == active || active > q.threads {
+		return 1
+	}
+	return q.threads / active
+}
+
+// removeIdle removes the streams without downloads since the idle timeout
+func (q *downloadQueue) removeIdle() {
+	now := time.Now()
+	for key, s := range q.streams {
+		if !s.active() && now.Sub(s.lastActive) > streamIdleTimeout {
+			delete(q.streams, key)
+		}
+	}
+}
@@ -0,0 +1,89 @@
+package chunk
+
+import (
+	"testing"
+
+	"github.com/plexdrive/plexdrive/drive"
+)
+
+func testDownloadRequest(file string, i int, priority Priority) *Request {
+	return &Request{
+		id:       testRequestID(i),
+		object:   &drive.APIObject{ObjectID: file, Name: file},
+		priority: priority,
+		preload:  PriorityPreload == priority,
+	}
+}
+
+func expectPop(t *testing.T, q *downloadQueue, expected ...int) {
+	for _, e := range expected {
+		if req := q.pop(); testRequestID(e) != req.id {
+			t.Fatalf("Expected request %v got %v", testRequestID(e), req.id)
+		}
+	}
+}
+
+func TestDownloadQueuePriority(t *testing.T) {
+	q := newDownloadQueue(1, 2)
+
+	if dropped := q.push(testDownloadRequest("a", 1, PriorityPreload)); 0 != len(dropped) {
+		t.Fatalf("Expected no dropped preloads got %v", len(dropped))
+	}
+	q.push(testDownloadRequest("a", 2, PriorityPreload))
+	q.push(testDownloadRequest("a", 3, PriorityForeground))
+
+	// the oldest preloads are dropped under pressure
+	dropped := q.push(testDownloadRequest("a", 4, PriorityPreload))
+	if 1 != len(dropped) || testRequestID(1) != dropped[0].id {
+		t.Fatalf("Expected the oldest preload to be dropped got %v", dropped)
+	}
+
+	// a read waiting for a preload moves it to the front
+	if !q.promote(testRequestID(4), PriorityForeground) {
+		t.Fatal("Expected the queued preload to be promoted")
+	}
+	if q.promote(testRequestID(1), PriorityForeground) {
+		t.Fatal("Expected the dropped preload not to be promoted")
+	}
+
+	expectPop(t, q, 3, 4, 2)
+	if 0 != q.len(PriorityPreload) || 0 != q.len(PriorityForeground) {
+		t.Fatal("Expected an empty queue")
+	}
+}
+
+func TestDownloadQueueFairness(t *testing.T) {
+	q := newDownloadQueue(2, 6)
+
+	// stream a reads ahead aggressively, stream b only needs two chunks
+	for i := 0; i < 4; i++ {
+		q.push(testDownloadRequest("a", i, PriorityPreload))
+	}
+	q.push(testDownloadRequest("b", 10, PriorityPreload))
+	q.push(testDownloadRequest("b", 11, PriorityPreload))
+
+	// stream a gets one thread, stream b the other one
+	a := q.pop()
+	expectPop(t, q, 10)
+
+	// the stream with fewer running downloads is served first
+	q.finish(a, true)
+	expectPop(t, q, 1)
+	// of streams with as many running downloads the least served one is next
+	expectPop(t, q, 11, 2)
+
+	// the stream with the most queued preloads drops its oldest ones
+	for i := 4; i < 8; i++ {
+		q.push(testDownloadRequest("a", i, PriorityPreload))
+	}
+	q.push(testDownloadRequest("b", 12, PriorityPreload))
+	dropped := q.push(testDownloadRequest("b", 13, PriorityPreload))
+	if 1 != len(dropped) || testRequestID(3) != dropped[0].id {
+		t.Fatalf("Expected the oldest preload of stream a to be dropped got %v", dropped)
+	}
+
+	stats := q.stats()
+	if 2 != len(stats) || "a" != stats[0].Stream || 4 != stats[0].Preloads || 1 != stats[0].Downloaded || 1 != stats[0].Dropped || 1 != stats[0].Share {
+		t.Fatalf("Unexpected stream statistics %+v", stats)
+	}
+}
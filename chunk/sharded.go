@@ -0,0 +1,107 @@
+package chunk
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math"
+	"os"
+
+	. "github.com/claudetech/loggo/default"
+)
+
+// ChunkFile is a chunk cache file and the number of chunks it stores
+type ChunkFile struct {
+	Path      string
+	MaxChunks int
+}
+
+// ShardedStorage spreads the chunks over multiple chunk files, e.g. on
+// different disks. Every file keeps its own journal. Chunks are placed by
+// rendezvous hashing weighted by the capacity of the files, so the chunks of
+// the remaining files keep their place if a file is missing.
+type ShardedStorage struct {
+	shards  []*Storage
+	seeds   [][]byte
+	weights []float64
+}
+
+// NewShardedStorage creates a storage for each chunk file, files that can't
+// be opened are skipped together with their chunks. Multiple chunk files are
+// never created, they must exist, e.g. as empty files.
+func NewShardedStorage(files []ChunkFile, chunkSize int64, maxMmapSize int64, evictionPolicy string) (*ShardedStorage, error) {
+	s := ShardedStorage{
+		shards:  make([]*Storage, 0, len(files)),
+		seeds:   make([][]byte, 0, len(files)),
+		weights: make([]float64, 0, len(files)),
+	}
+	for _, file := range files {
+		if len(files) > 1 {
+			// a missing file usually means that its disk isn't mounted, creating
+			// it would fill the disk of the mount point instead
+			if _, err := os.Stat(file.Path); nil != err {
+				Log.Warningf("Skipping chunk cache file %v, it must be created before it can be used: %v", file.Path, err)
+				continue
+			}
+		}
+		policy, err := NewEvictionPolicy(evictionPolicy, file.MaxChunks)
+		if nil != err {
+			return nil, err
+		}
+		storage, err := NewStorage(chunkSize, file.MaxChunks, maxMmapSize, file.Path, policy)
+		if nil != err {
+			Log.Warningf("Skipping chunk cache file %v: %v", file.Path, err)
+			continue
+		}
+		s.shards = append(s.shards, storage)
+		s.seeds = append(s.seeds, []byte(file.Path))
+		s.weights = append(s.weights, float64(file.MaxChunks))
+	}
+	if 0 == len(s.shards) {
+		return nil, fmt.Errorf("Could not open any chunk cache file")
+	}
+	return &s, nil
+}
+
+// shard returns the storage of a chunk
+func (s *ShardedStorage) shard(id RequestID) *Storage {
+	best := 0
+	bestScore := math.Inf(-1)
+	for i, seed := range s.seeds {
+		h := fnv.New64a()
+		h.Write(seed)
+		h.Write(id[:])
+		// uniform value in (0, 1)
+		u := (float64(h.Sum64()>>11) + 0.5) / (1 << 53)
+		score := -s.weights[i] / math.Log(u)
+		if score > bestScore {
+			best = i
+			bestScore = score
+		}
+	}
+	return s.shards[best]
+}
+
+// Clear removes all old chunks of all files
+func (s *ShardedStorage) Clear() error {
+	for _, shard := range s.shards {
+		if err := shard.Clear(); nil != err {
+			return err
+		}
+	}
+	return nil
+}
+
+// Load a chunk from its file
+func (s *ShardedStorage) Load(id RequestID) []byte {
+	return s.shard(id).Load(id)
+}
+
+// Contains checks if a chunk is stored in its file
+func (s *ShardedStorage) Contains(id RequestID) bool {
+	return s.shard(id).Contains(id)
+}
+
+// Store stores a chunk in its file
+func (s *ShardedStorage) Store(id RequestID, bytes []byte) error {
+	return s.shard(id).Store(id, bytes)
+}
@@ -0,0 +1,70 @@
+package chunk
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestShardedStorage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "plexdrive-sharded")
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	chunkSize := int64(os.Getpagesize())
+
+	files := []ChunkFile{
+		{Path: filepath.Join(dir, "ssd1.dat"), MaxChunks: 64},
+		{Path: filepath.Join(dir, "missing", "ssd2.dat"), MaxChunks: 64},
+		{Path: filepath.Join(dir, "ssd3.dat"), MaxChunks: 64},
+		{Path: filepath.Join(dir, "ssd4.dat"), MaxChunks: 64},
+	}
+	// multiple chunk files must be created up front
+	for _, name := range []string{"ssd1.dat", "ssd3.dat"} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), nil, 0600); nil != err {
+			t.Fatal(err)
+		}
+	}
+	storage, err := NewShardedStorage(files, chunkSize, 1<<30, "lru")
+	if nil != err {
+		t.Fatal(err)
+	}
+	if 2 != len(storage.shards) {
+		t.Fatalf("Expected the missing files to be skipped, got %v files", len(storage.shards))
+	}
+
+	data := bytes.Repeat([]byte{1}, int(chunkSize))
+	for i := 0; i < 32; i++ {
+		if err := storage.Store(testRequestID(i), data); nil != err {
+			t.Fatal(err)
+		}
+	}
+	stored := make(map[*Storage]int)
+	for i := 0; i < 32; i++ {
+		if !bytes.Equal(data, storage.Load(testRequestID(i))) {
+			t.Fatalf("Expected chunk %v to be stored", i)
+		}
+		stored[storage.shard(testRequestID(i))]++
+	}
+	if 2 != len(stored) {
+		t.Fatalf("Expected the chunks to be spread over both files, got %v", stored)
+	}
+
+	if _, err := os.Stat(files[3].Path); !os.IsNotExist(err) {
+		t.Fatalf("Expected the missing file not to be created: %v", err)
+	}
+
+	// the chunks of the remaining files keep their place
+	reopened, err := NewShardedStorage(files[:1], chunkSize, 1<<30, "lru")
+	if nil != err {
+		t.Fatal(err)
+	}
+	for i := 0; i < 32; i++ {
+		if storage.shard(testRequestID(i)) == storage.shards[0] && nil == reopened.Load(testRequestID(i)) {
+			t.Fatalf("Expected chunk %v to be restored", i)
+		}
+	}
+}
@@ -5,7 +5,7 @@ import (
 	"sync"
 )
 
-// Stack is a thread safe list/stack implementation
+// Stack is a thread safe list/stack implementation and the LRU eviction policy
 type Stack struct {
 	items   *list.List
 	lock    sync.Mutex
@@ -42,13 +42,15 @@ func (s *Stack) Pop() int {
 	return item.Value.(int)
 }
 
-// Touch moves the specified item to the last position of the stack
-func (s *Stack) Touch(item *list.Element) {
+// Touch moves the specified item to the last position of the stack, every
+// read counts for LRU
+func (s *Stack) Touch(item *list.Element) bool {
 	s.lock.Lock()
 	if item != s.items.Back() {
 		s.items.MoveToBack(item)
 	}
 	s.lock.Unlock()
+	return true
 }
 
 // Push adds a new item to the last position of the stack
@@ -58,6 +60,11 @@ func (s *Stack) Push(id int) *list.Element {
 	return s.items.PushBack(id)
 }
 
+// Restore adds an item that was loaded from the journal to the last position of the stack
+func (s *Stack) Restore(id int, _ RequestID, _ uint32) *list.Element {
+	return s.Push(id)
+}
+
 // Prepend adds a list to the front of the stack
 func (s *Stack) Prepend(items *list.List) {
 	s.lock.Lock()
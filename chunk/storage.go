@@ -1,12 +1,15 @@
 package chunk
 
 import (
+	"bytes"
 	"container/list"
 	"fmt"
 	"hash/crc32"
 	"os"
 	"os/signal"
+	"sort"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 	"unsafe"
@@ -20,7 +23,12 @@ const (
 	headerSize     = int(unsafe.Sizeof(*new(chunkHeader)))
 	tocSize        = int64(unsafe.Sizeof(*new(journalHeader)))
 	journalMagic   = uint16('P'<<8 | 'D'&0xFF)
-	journalVersion = uint8(2)
+	journalVersion = uint8(3)
+	// legacyJournalVersion is the previous journal version, its chunk headers
+	// had no access statistics and chunks of files without MD5 checksum were
+	// identified by a blank checksum
+	legacyJournalVersion = uint8(2)
+	legacyHeaderSize     = int(unsafe.Sizeof(*new(legacyChunkHeader)))
 )
 
 var (
@@ -35,7 +43,8 @@ type Storage struct {
 	HeaderSize      int64
 	MaxChunks       int
 	chunks          map[RequestID]int
-	stack           *Stack
+	policy          EvictionPolicy
+	clock           uint64
 	lock            sync.RWMutex
 	buffers         []*Chunk
 	loadChunks      int
@@ -44,6 +53,14 @@ type Storage struct {
 	journal         []byte
 	mmapRegions     [][]byte
 	chunksPerRegion int64
+	// evicted is called with the bytes of a chunk before its buffer is reused
+	evicted func(id RequestID, bytes []byte)
+}
+
+type legacyChunkHeader struct {
+	id       RequestID
+	size     uint32
+	checksum uint32
 }
 
 type journalHeader struct {
@@ -56,12 +73,12 @@ type journalHeader struct {
 }
 
 // NewStorage creates a new storage
-func NewStorage(chunkSize int64, maxChunks int, maxMmapSize int64, chunkFilePath string) (*Storage, error) {
+func NewStorage(chunkSize int64, maxChunks int, maxMmapSize int64, chunkFilePath string, policy EvictionPolicy) (*Storage, error) {
 	s := Storage{
 		ChunkSize: chunkSize,
 		MaxChunks: maxChunks,
 		chunks:    make(map[RequestID]int, maxChunks),
-		stack:     NewStack(maxChunks),
+		policy:    policy,
 		buffers:   make([]*Chunk, maxChunks, maxChunks),
 		signals:   make(chan os.Signal, 1),
 	}
@@ -86,18 +103,25 @@ func NewStorage(chunkSize int64, maxChunks int, maxMmapSize int64, chunkFilePath
 		Log.Debugf("Current chunk cache file size: %v B (wanted: %v B)", currentSize, wantedSize)
 		if err := chunkFile.Truncate(currentSize); nil != err {
 			Log.Warningf("Could not truncate chunk cache, skip resizing")
-		} else if currentSize != wantedSize {
+		} else {
 			if currentSize > tocSize {
-				err = s.relocateJournal(currentSize, wantedSize, journalSize, journalOffset)
-				if nil != err {
+				if upgradedSize, err := s.upgradeJournal(currentSize); nil != err {
 					Log.Errorf("%v", err)
 				} else {
-					Log.Infof("Relocated chunk cache journal")
+					currentSize = upgradedSize
+				}
+				if migrated, err := s.migrateJournal(currentSize); nil != err {
+					Log.Errorf("%v", err)
+				} else if migrated {
+					Log.Infof("Migrated chunk cache journal")
+					currentSize = wantedSize
 				}
 			}
-			if err := chunkFile.Truncate(wantedSize); nil != err {
-				Log.Debugf("%v", err)
-				return nil, fmt.Errorf("Could not resize chunk cache file")
+			if currentSize != wantedSize {
+				if err := chunkFile.Truncate(wantedSize); nil != err {
+					Log.Debugf("%v", err)
+					return nil, fmt.Errorf("Could not resize chunk cache file")
+				}
 			}
 		}
 		Log.Infof("Created chunk cache file %v", chunkFile.Name())
@@ -115,6 +139,10 @@ func NewStorage(chunkSize int64, maxChunks int, maxMmapSize int64, chunkFilePath
 		header := journal[tocOffset:]
 		if valid := s.checkJournal(header, false); !valid {
 			s.initJournal(header)
+			// chunk headers of another journal layout can't be restored
+			for i := int64(0); i < tocOffset; i++ {
+				journal[i] = 0
+			}
 		}
 		s.journal = journal[:tocOffset]
 	}
@@ -134,48 +162,57 @@ func NewStorage(chunkSize int64, maxChunks int, maxMmapSize int64, chunkFilePath
 	return &s, nil
 }
 
-// relocateJournal moves existing journal prior to resize
-func (s *Storage) relocateJournal(currentSize, wantedSize, journalSize, journalOffset int64) error {
-	header := make([]byte, tocSize, tocSize)
-	if _, err := s.ChunkFile.ReadAt(header, currentSize-tocSize); nil != err {
-		return fmt.Errorf("Failed to read journal header: %v", err)
-	}
-
-	if valid := s.checkJournal(header, true); !valid {
-		return fmt.Errorf("Failed to validate journal header")
-	}
-
-	h := (*journalHeader)(unsafe.Pointer(&header[0]))
-	oldJournalOffset := s.ChunkSize * int64(h.maxChunks)
-	oldJournalSize := min(journalSize, currentSize-oldJournalOffset) - tocSize
-	journal := make([]byte, journalSize, journalSize)
-
-	if _, err := s.ChunkFile.ReadAt(journal[:oldJournalSize], oldJournalOffset); nil != err {
-		return fmt.Errorf("Failed to read journal: %v", err)
-	}
-
-	s.initJournal(header)
-
-	sizeWithoutJournal := currentSize - oldJournalSize - tocSize
-	if err := s.ChunkFile.Truncate(sizeWithoutJournal); nil != err {
-		return fmt.Errorf("Could not truncate chunk cache journal: %v", err)
-	}
-
-	if err := s.ChunkFile.Truncate(wantedSize); nil != err {
-		return fmt.Errorf("Could not resize chunk cache file: %v", err)
+// upgradeJournal converts the chunk headers of a journal of the previous
+// version to the current layout in place, the chunks start without access
+// statistics. Chunks of files without MD5 checksum are discarded, they shared
+// the same blank checksum and might contain the data of another file. It
+// returns the new size of the chunk file.
+func (s *Storage) upgradeJournal(currentSize int64) (int64, error) {
+	toc := make([]byte, tocSize, tocSize)
+	if _, err := s.ChunkFile.ReadAt(toc, currentSize-tocSize); nil != err {
+		return currentSize, fmt.Errorf("Failed to read journal header: %v", err)
+	}
+	h := (*journalHeader)(unsafe.Pointer(&toc[0]))
+	if h.magic != journalMagic || h.version != legacyJournalVersion || h.checksum != crc32.Checksum(toc[:12], crc32Table) {
+		return currentSize, nil
+	}
+
+	journalOffset := int64(h.chunkSize) * int64(h.maxChunks)
+	legacy := make([]byte, int(h.headerSize)*int(h.maxChunks))
+	if int64(len(legacy))+journalOffset+tocSize != currentSize || int(h.headerSize) != legacyHeaderSize {
+		return currentSize, nil
+	}
+	if _, err := s.ChunkFile.ReadAt(legacy, journalOffset); nil != err {
+		return currentSize, fmt.Errorf("Failed to read journal: %v", err)
+	}
+	journal := make([]byte, headerSize*int(h.maxChunks)+int(tocSize))
+	discarded := 0
+	for i := 0; i < int(h.maxChunks); i++ {
+		old := (*legacyChunkHeader)(unsafe.Pointer(&legacy[i*legacyHeaderSize]))
+		if blankRequestID != old.id && bytes.Equal(blankRequestID[:16], old.id[:16]) {
+			discarded++
+			continue
+		}
+		*(*chunkHeader)(unsafe.Pointer(&journal[i*headerSize])) = chunkHeader{
+			id:       old.id,
+			size:     old.size,
+			checksum: old.checksum,
+		}
 	}
 
+	h.version = journalVersion
+	h.headerSize = uint8(headerSize)
+	h.checksum = crc32.Checksum(toc[:12], crc32Table)
+	copy(journal[len(journal)-int(tocSize):], toc)
 	if _, err := s.ChunkFile.WriteAt(journal, journalOffset); nil != err {
-		return fmt.Errorf("Failed to write journal: %v", err)
+		return currentSize, fmt.Errorf("Failed to write journal: %v", err)
 	}
-	if _, err := s.ChunkFile.WriteAt(header, wantedSize-tocSize); nil != err {
-		return fmt.Errorf("Failed to write journal header: %v", err)
-	}
-	return nil
+	Log.Infof("Upgraded chunk cache journal, discarded %v chunks of files without MD5 checksum", discarded)
+	return journalOffset + int64(len(journal)), nil
 }
 
 // checkJournal verifies the journal header
-func (s *Storage) checkJournal(journal []byte, skipMaxChunks bool) bool {
+func (s *Storage) checkJournal(journal []byte, skipLayout bool) bool {
 	h := (*journalHeader)(unsafe.Pointer(&journal[0]))
 	// check magic bytes / endianess mismatch ('PD' vs 'DP')
 	if h.magic != journalMagic {
@@ -195,7 +232,10 @@ func (s *Storage) checkJournal(journal []byte, skipMaxChunks bool) bool {
 		Log.Debugf("Journal chunk header size mismatch: %v != %v", h.headerSize, headerSize)
 		return false
 	}
-	if !skipMaxChunks && h.maxChunks != uint32(s.MaxChunks) {
+	if skipLayout {
+		return true
+	}
+	if h.maxChunks != uint32(s.MaxChunks) {
 		Log.Debugf("Journal max chunks mismatch: %v != %v", h.maxChunks, s.MaxChunks)
 		return false
 	}
@@ -251,7 +291,7 @@ func (s *Storage) allocateMmapRegions(maxMmapSize int64) error {
 func (s *Storage) mmapChunks() error {
 	start := time.Now()
 	empty := list.New()
-	restored := list.New()
+	restored := make([]int, 0)
 	loadedChunks := 0
 	for i := 0; i < s.MaxChunks; i++ {
 		select {
@@ -259,7 +299,7 @@ func (s *Storage) mmapChunks() error {
 			Log.Warningf("Received signal %v, aborting chunk loader", sig)
 			return fmt.Errorf("Aborted by signal")
 		default:
-			if loaded, err := s.initChunk(i, empty, restored); nil != err {
+			if loaded, err := s.initChunk(i, empty, &restored); nil != err {
 				Log.Errorf("Failed to allocate chunk %v: %v", i, err)
 				return fmt.Errorf("Failed to initialize chunks")
 			} else if loaded {
@@ -267,8 +307,18 @@ func (s *Storage) mmapChunks() error {
 			}
 		}
 	}
-	s.stack.Prepend(restored)
-	s.stack.Prepend(empty)
+	// Restore the eviction policy from the least to the most recently used chunk
+	sort.Slice(restored, func(i, j int) bool {
+		return s.buffers[restored[i]].accessed < s.buffers[restored[j]].accessed
+	})
+	for _, index := range restored {
+		chunk := s.buffers[index]
+		chunk.item = s.policy.Restore(index, chunk.id, chunk.hits)
+		if chunk.accessed > s.clock {
+			s.clock = chunk.accessed
+		}
+	}
+	s.policy.Prepend(empty)
 	elapsed := time.Since(start)
 	if nil != s.ChunkFile {
 		Log.Infof("Loaded %v/%v cache chunks in %v", loadedChunks, s.MaxChunks, elapsed)
@@ -279,7 +329,7 @@ func (s *Storage) mmapChunks() error {
 }
 
 // initChunk tries to restore a chunk from disk
-func (s *Storage) initChunk(index int, empty *list.List, restored *list.List) (bool, error) {
+func (s *Storage) initChunk(index int, empty *list.List, restored *[]int) (bool, error) {
 	chunk, err := s.allocateChunk(index)
 	if err != nil {
 		Log.Debugf("%v", err)
@@ -296,7 +346,7 @@ func (s *Storage) initChunk(index int, empty *list.List, restored *list.List) (b
 		return false, nil
 	}
 
-	chunk.item = restored.PushBack(index)
+	*restored = append(*restored, index)
 	Log.Tracef("Load chunk %v/%v (restored: %v)", index+1, s.MaxChunks, id)
 	s.chunks[id] = index
 
@@ -354,10 +404,18 @@ func (s *Storage) Load(id RequestID) []byte {
 		return chunk.bytes
 	}
 	Log.Warningf("Load chunk %v (bad checksum: %08x <> %08x)", id, chunk.checksum, chunk.calculateChecksum())
-	s.stack.Purge(chunk.item)
+	s.policy.Purge(chunk.item)
 	return nil
 }
 
+// Contains checks if a chunk is stored without touching it
+func (s *Storage) Contains(id RequestID) bool {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	_, exists := s.chunks[id]
+	return exists
+}
+
 // Store stores a chunk in the RAM and adds it to the disk storage queue
 func (s *Storage) Store(id RequestID, bytes []byte) (err error) {
 	s.lock.RLock()
@@ -381,7 +439,7 @@ func (s *Storage) Store(id RequestID, bytes []byte) (err error) {
 		}
 		Log.Warningf("Create chunk %v(exists: overwrite)", id)
 	} else {
-		index := s.stack.Pop()
+		index := s.pop(id)
 		if -1 == index {
 			Log.Debugf("Create chunk %v (failed)", id)
 			return fmt.Errorf("No buffers available")
@@ -390,15 +448,18 @@ func (s *Storage) Store(id RequestID, bytes []byte) (err error) {
 		deleteID := chunk.id
 		if blankRequestID != deleteID {
 			delete(s.chunks, deleteID)
+			if nil != s.evicted && chunk.valid(deleteID) {
+				s.evicted(deleteID, chunk.bytes[:chunk.size])
+			}
 			Log.Debugf("Create chunk %v (reused)", id)
 		} else {
 			Log.Debugf("Create chunk %v (stored)", id)
 		}
 		s.chunks[id] = index
-		chunk.item = s.stack.Push(index)
+		chunk.item = s.push(index, id)
 	}
 
-	chunk.update(id, bytes)
+	chunk.update(id, bytes, atomic.AddUint64(&s.clock, 1))
 
 	return nil
 }
@@ -410,6 +471,23 @@ func (s *Storage) fetch(id RequestID) *Chunk {
 		return nil
 	}
 	chunk := s.buffers[index]
-	s.stack.Touch(chunk.item)
+	hit := s.policy.Touch(chunk.item)
+	chunk.touch(atomic.AddUint64(&s.clock, 1), hit)
 	return chunk
 }
+
+// pop removes the buffer that should be reused for a chunk from the eviction policy
+func (s *Storage) pop(id RequestID) int {
+	if policy, ok := s.policy.(keyedPolicy); ok {
+		return policy.PopFor(id)
+	}
+	return s.policy.Pop()
+}
+
+// push adds a filled buffer to the eviction policy
+func (s *Storage) push(index int, id RequestID) *list.Element {
+	if policy, ok := s.policy.(keyedPolicy); ok {
+		return policy.PushID(index, id)
+	}
+	return s.policy.Push(index)
+}
@@ -0,0 +1,89 @@
+package chunk
+
+import (
+	. "github.com/claudetech/loggo/default"
+)
+
+// ChunkStorage stores downloaded chunks by request id
+type ChunkStorage interface {
+	// Load returns the bytes of a chunk or nil if it is not stored
+	Load(id RequestID) []byte
+	// Contains checks if a chunk is stored without counting it as an access
+	Contains(id RequestID) bool
+	// Store copies the bytes of a chunk into the storage
+	Store(id RequestID, bytes []byte) error
+	// Clear removes all old chunks
+	Clear() error
+}
+
+// TieredStorage keeps the hot chunks in a small RAM storage in front of a
+// big disk storage. Chunks are written through to the disk, chunks that are
+// read from the disk are promoted to the RAM and chunks evicted from the RAM
+// are demoted to the disk again if the disk has evicted them meanwhile.
+type TieredStorage struct {
+	ram  *Storage
+	disk ChunkStorage
+}
+
+// NewTieredStorage creates a tiered storage of a RAM and a disk storage
+func NewTieredStorage(ram *Storage, disk ChunkStorage) *TieredStorage {
+	s := TieredStorage{
+		ram:  ram,
+		disk: disk,
+	}
+	ram.evicted = s.demote
+	return &s
+}
+
+// Clear removes all old chunks of both tiers
+func (s *TieredStorage) Clear() error {
+	if err := s.ram.Clear(); nil != err {
+		return err
+	}
+	return s.disk.Clear()
+}
+
+// Load a chunk from the RAM or promote it from the disk
+func (s *TieredStorage) Load(id RequestID) []byte {
+	if bytes := s.ram.Load(id); nil != bytes {
+		return bytes
+	}
+	bytes := s.disk.Load(id)
+	if nil == bytes {
+		return nil
+	}
+	Log.Tracef("Promote chunk %v", id)
+	if err := s.ram.Store(id, bytes); nil != err {
+		Log.Debugf("%v", err)
+		return bytes
+	}
+	if promoted := s.ram.Load(id); nil != promoted {
+		return promoted
+	}
+	return bytes
+}
+
+// Store stores a chunk in both tiers
+func (s *TieredStorage) Store(id RequestID, bytes []byte) error {
+	if err := s.disk.Store(id, bytes); nil != err {
+		Log.Warningf("Could not store chunk %v on disk: %v", id, err)
+	}
+	return s.ram.Store(id, bytes)
+}
+
+// Contains checks if a chunk is stored in one of the tiers
+func (s *TieredStorage) Contains(id RequestID) bool {
+	return s.ram.Contains(id) || s.disk.Contains(id)
+}
+
+// demote stores a chunk that is evicted from the RAM on the disk, chunks that
+// are still on the disk keep their place in its eviction order
+func (s *TieredStorage) demote(id RequestID, bytes []byte) {
+	if s.disk.Contains(id) {
+		return
+	}
+	Log.Tracef("Demote chunk %v", id)
+	if err := s.disk.Store(id, bytes); nil != err {
+		Log.Warningf("Could not demote chunk %v: %v", id, err)
+	}
+}
@@ -0,0 +1,98 @@
+package chunk
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestTieredStorage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "plexdrive-tiered")
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	chunkSize := int64(os.Getpagesize())
+
+	ram, err := NewStorage(chunkSize, 2, 1<<30, "", NewStack(2))
+	if nil != err {
+		t.Fatal(err)
+	}
+	disk, err := NewStorage(chunkSize, 4, 1<<30, filepath.Join(dir, "chunks.dat"), NewStack(4))
+	if nil != err {
+		t.Fatal(err)
+	}
+	storage := NewTieredStorage(ram, disk)
+
+	data := func(n int) []byte {
+		return bytes.Repeat([]byte{byte(n)}, int(chunkSize))
+	}
+	for i := 0; i < 3; i++ {
+		if err := storage.Store(testRequestID(i), data(i)); nil != err {
+			t.Fatal(err)
+		}
+	}
+
+	// chunk 0 has been evicted from the RAM but is kept on disk
+	if nil != ram.Load(testRequestID(0)) {
+		t.Fatal("Expected chunk 0 to be evicted from the RAM")
+	}
+	if b := storage.Load(testRequestID(0)); !bytes.Equal(data(0), b) {
+		t.Fatal("Expected chunk 0 to be loaded from the disk")
+	}
+	if b := ram.Load(testRequestID(0)); !bytes.Equal(data(0), b) {
+		t.Fatal("Expected chunk 0 to be promoted to the RAM")
+	}
+
+	// chunks that are evicted from the disk are demoted again
+	for i := 3; i < 7; i++ {
+		if err := disk.Store(testRequestID(i), data(i)); nil != err {
+			t.Fatal(err)
+		}
+	}
+	if nil != disk.Load(testRequestID(2)) {
+		t.Fatal("Expected chunk 2 to be evicted from the disk")
+	}
+	storage.Load(testRequestID(0))
+	if err := storage.Store(testRequestID(7), data(7)); nil != err {
+		t.Fatal(err)
+	}
+	if b := disk.Load(testRequestID(2)); !bytes.Equal(data(2), b) {
+		t.Fatal("Expected chunk 2 to be demoted to the disk")
+	}
+}
+
+func TestTieredStorageDemote(t *testing.T) {
+	dir, err := ioutil.TempDir("", "plexdrive-tiered")
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	chunkSize := int64(os.Getpagesize())
+
+	ram, err := NewStorage(chunkSize, 1, 1<<30, "", NewStack(1))
+	if nil != err {
+		t.Fatal(err)
+	}
+	disk, err := NewStorage(chunkSize, 2, 1<<30, filepath.Join(dir, "chunks.dat"), NewStack(2))
+	if nil != err {
+		t.Fatal(err)
+	}
+	storage := NewTieredStorage(ram, disk)
+
+	// chunk 0 is evicted from the RAM while it is still on the disk
+	data := bytes.Repeat([]byte{1}, int(chunkSize))
+	storage.Store(testRequestID(0), data)
+	storage.Store(testRequestID(1), data)
+	if !disk.Contains(testRequestID(0)) {
+		t.Fatal("Expected chunk 0 to be on the disk")
+	}
+
+	// the demotion doesn't count as an access of the disk chunk
+	disk.Store(testRequestID(2), data)
+	if disk.Contains(testRequestID(0)) || !disk.Contains(testRequestID(1)) {
+		t.Fatal("Expected the least recently used chunk 0 to be evicted from the disk")
+	}
+}
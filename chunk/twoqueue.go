@@ -0,0 +1,107 @@
+package chunk
+
+import (
+	"container/list"
+)
+
+// TwoQueue is the scan resistant 2Q policy. New chunks enter the FIFO queue
+// in, chunks evicted from in are remembered in the ghost queue out, and only
+// chunks that are requested again while they are in in or out are promoted
+// to the LRU queue main. Reads within the correlation period of the previous
+// read of a chunk are no new request, so a full scan only cycles through in.
+type TwoQueue struct {
+	policyQueues
+	in     *list.List
+	main   *list.List
+	out    *ghostList
+	maxIn  int
+	maxOut int
+}
+
+// NewTwoQueue creates a new 2Q policy
+func NewTwoQueue(maxChunks int) *TwoQueue {
+	p := TwoQueue{
+		policyQueues: newPolicyQueues(maxChunks),
+		in:           list.New(),
+		main:         list.New(),
+		out:          newGhostList(),
+		maxIn:        maxChunks / 4,
+		maxOut:       maxChunks / 2,
+	}
+	if p.maxIn < 1 {
+		p.maxIn = 1
+	}
+	if p.maxOut < 1 {
+		p.maxOut = 1
+	}
+	return &p
+}
+
+// Pop removes the buffer that should be reused next
+func (p *TwoQueue) Pop() int {
+	return p.PopFor(blankRequestID)
+}
+
+// PopFor removes the buffer that should be reused for a chunk
+func (p *TwoQueue) PopFor(id RequestID) int {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if index, done := p.pending(); done {
+		return index
+	}
+
+	if item := p.in.Front(); nil != item && (p.in.Len() > p.maxIn || 0 == p.main.Len()) {
+		e := item.Value.(*policyEntry)
+		p.out.add(e.id, p.maxOut)
+		return p.untrack(e)
+	}
+	if item := p.main.Front(); nil != item {
+		return p.untrack(item.Value.(*policyEntry))
+	}
+	return -1
+}
+
+// Touch moves a buffer to the back of main if the read is a new reference
+// or to the back of its queue
+func (p *TwoQueue) Touch(item *list.Element) bool {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	e := entry(item)
+	if nil == e || (p.in != e.queue && p.main != e.queue) {
+		return false
+	}
+	queue := e.queue
+	reference := p.reference(e)
+	if reference {
+		queue = p.main
+	}
+	p.moveToBack(e, queue)
+	return reference
+}
+
+// Push adds a buffer that has just been filled
+func (p *TwoQueue) Push(index int) *list.Element {
+	return p.PushID(index, blankRequestID)
+}
+
+// PushID adds a buffer to main if the chunk was evicted recently or to in
+func (p *TwoQueue) PushID(index int, id RequestID) *list.Element {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.out.contains(id) {
+		p.out.remove(id)
+		return p.track(index, id, p.main)
+	}
+	return p.track(index, id, p.in)
+}
+
+// Restore adds a buffer that was loaded from the journal, buffers with hits
+// are restored to main
+func (p *TwoQueue) Restore(index int, id RequestID, hits uint32) *list.Element {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if hits > 0 {
+		return p.restore(index, id, p.main)
+	}
+	return p.restore(index, id, p.in)
+}
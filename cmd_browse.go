@@ -0,0 +1,151 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	. "github.com/claudetech/loggo/default"
+	"github.com/plexdrive/plexdrive/control"
+)
+
+// runBrowseCommand prints the objects of the cache, the query path is used
+// by all commands and the predicates only by find
+func runBrowseCommand(command string, query control.FindQuery, printJSON bool, cacheFile, configPath, driveID, rootNodeID string) int {
+	client, err := control.Open(cacheFile, configPath, driveID, rootNodeID, false)
+	if nil != err {
+		Log.Errorf("%v", err)
+		return 1
+	}
+	defer client.Close()
+
+	var result interface{}
+	switch command {
+	case "ls":
+		result, err = client.List(query.Path)
+	case "stat":
+		result, err = client.Stat(query.Path)
+	case "find":
+		result, err = client.Find(query)
+	case "du":
+		result, err = client.Usage(query.Path)
+	}
+	if nil != err {
+		Log.Errorf("%v", err)
+		return 1
+	}
+
+	if printJSON {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(result); nil != err {
+			Log.Errorf("Could not encode output")
+			Log.Debugf("%v", err)
+			return 1
+		}
+		return 0
+	}
+
+	switch r := result.(type) {
+	case []*control.Entry:
+		for _, entry := range r {
+			if "ls" == command {
+				printListEntry(entry)
+			} else {
+				fmt.Println(entry.Path)
+			}
+		}
+	case *control.Entry:
+		printStatEntry(r)
+	case *control.Usage:
+		fmt.Printf("%v\t%v\t(%v files, %v folders)\n", formatSize(r.Size), r.Path, r.Files, r.Folders)
+	}
+	return 0
+}
+
+// parseFindQuery parses the predicates of find
+func parseFindQuery(path, name, fileType, minSize, maxSize, modifiedAfter, modifiedBefore string) (control.FindQuery, error) {
+	query := control.FindQuery{
+		Path: path,
+		Name: name,
+		Type: fileType,
+	}
+	if "" == query.Path {
+		query.Path = "/"
+	}
+	if "" != query.Type && "f" != query.Type && "d" != query.Type {
+		return query, fmt.Errorf("Invalid type %v (available: f, d)", query.Type)
+	}
+
+	min, err := parseSizeArg(minSize)
+	if nil != err {
+		return query, err
+	}
+	max, err := parseSizeArg(maxSize)
+	if nil != err {
+		return query, err
+	}
+	query.MinSize = uint64(min)
+	query.MaxSize = uint64(max)
+
+	if query.ModifiedAfter, err = parseTimeArg(modifiedAfter); nil != err {
+		return query, err
+	}
+	if query.ModifiedBefore, err = parseTimeArg(modifiedBefore); nil != err {
+		return query, err
+	}
+	return query, nil
+}
+
+// parseTimeArg parses a date or a RFC 3339 timestamp
+func parseTimeArg(input string) (time.Time, error) {
+	if "" == input {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse(time.RFC3339, input); nil == err {
+		return t, nil
+	}
+	t, err := time.ParseInLocation("2006-01-02", input, time.Local)
+	if nil != err {
+		Log.Debugf("%v", err)
+		return t, fmt.Errorf("Could not parse time %v", input)
+	}
+	return t, nil
+}
+
+func printListEntry(entry *control.Entry) {
+	mode := "-"
+	if entry.IsDir {
+		mode = "d"
+	}
+	fmt.Printf("%v %8v %v %v\n", mode, formatSize(entry.Size), entry.LastModified.Local().Format("2006-01-02 15:04"), entry.Name)
+}
+
+func printStatEntry(entry *control.Entry) {
+	fmt.Printf("Path:     %v\n", entry.Path)
+	fmt.Printf("ID:       %v\n", entry.ID)
+	fmt.Printf("Folder:   %v\n", entry.IsDir)
+	fmt.Printf("Size:     %v (%v bytes)\n", formatSize(entry.Size), entry.Size)
+	fmt.Printf("Modified: %v\n", entry.LastModified.Local().Format(time.RFC3339))
+	fmt.Printf("Created:  %v\n", entry.CreatedTime.Local().Format(time.RFC3339))
+	if "" != entry.MD5Checksum {
+		fmt.Printf("MD5:      %v\n", entry.MD5Checksum)
+	}
+	fmt.Printf("Parents:  %v\n", entry.Parents)
+}
+
+// formatSize formats a size with the units of parseSizeArg
+func formatSize(size uint64) string {
+	units := []string{"B", "K", "M", "G", "T"}
+	value := float64(size)
+	unit := 0
+	for value >= 1024 && unit < len(units)-1 {
+		value /= 1024
+		unit++
+	}
+	if 0 == unit {
+		return fmt.Sprintf("%v%v", size, units[unit])
+	}
+	return fmt.Sprintf("%.1f%v", value, units[unit])
+}
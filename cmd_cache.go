@@ -0,0 +1,146 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	. "github.com/claudetech/loggo/default"
+	"github.com/plexdrive/plexdrive/drive"
+)
+
+// Exit codes of cache fsck, based on the exit codes of fsck(8)
+const (
+	fsckOK           = 0
+	fsckRepaired     = 1
+	fsckInconsistent = 4
+	fsckFailed       = 8
+)
+
+// runCacheCommand runs a cache maintenance command and returns the exit code
+func runCacheCommand(command, path, cacheFile, configPath, driveID, rootNodeID string, subtreeOnly, repair bool) int {
+	switch command {
+	case "fsck":
+		return runCacheFsck(cacheFile, configPath, driveID, rootNodeID, subtreeOnly, repair)
+	case "export":
+		return runCacheExport(path, cacheFile, configPath, driveID, rootNodeID)
+	case "import":
+		return runCacheImport(path, cacheFile, configPath, driveID, rootNodeID)
+	default:
+		Log.Errorf("Cache command %v not found (available: fsck, export, import)", command)
+		return 2
+	}
+}
+
+// runCacheExport dumps the cache namespace of the mount to a file or stdout
+func runCacheExport(path, cacheFile, configPath, driveID, rootNodeID string) int {
+	cache, err := drive.NewCache(cacheFile, configPath, driveID, rootNodeID, false)
+	if nil != err {
+		Log.Errorf("%v", err)
+		return 1
+	}
+	defer cache.Close()
+
+	var w io.Writer = os.Stdout
+	if "" != path && "-" != path {
+		f, err := os.Create(path)
+		if nil != err {
+			Log.Errorf("Could not create dump file %v", path)
+			Log.Debugf("%v", err)
+			return 1
+		}
+		defer f.Close()
+		w = f
+	}
+
+	exported, err := cache.Export(w)
+	if nil != err {
+		Log.Errorf("%v", err)
+		return 1
+	}
+	Log.Infof("Exported %v objects", exported)
+	return 0
+}
+
+// runCacheImport replaces the cache namespace of the mount with a dump from a file or stdin
+func runCacheImport(path, cacheFile, configPath, driveID, rootNodeID string) int {
+	var r io.Reader = os.Stdin
+	if "" != path && "-" != path {
+		f, err := os.Open(path)
+		if nil != err {
+			Log.Errorf("Could not open dump file %v", path)
+			Log.Debugf("%v", err)
+			return 1
+		}
+		defer f.Close()
+		r = f
+	}
+
+	if err := os.MkdirAll(filepath.Dir(cacheFile), 0766); nil != err {
+		Log.Errorf("Could not create cache file directory")
+		Log.Debugf("%v", err)
+		return 1
+	}
+	cache, err := drive.NewCache(cacheFile, configPath, driveID, rootNodeID, false)
+	if nil != err {
+		Log.Errorf("%v", err)
+		return 1
+	}
+	defer cache.Close()
+
+	imported, err := cache.Import(r)
+	if nil != err {
+		Log.Errorf("%v", err)
+		return 1
+	}
+	Log.Infof("Imported %v objects", imported)
+	return 0
+}
+
+// runCacheFsck checks the cache namespace of the mount for inconsistencies
+func runCacheFsck(cacheFile, configPath, driveID, rootNodeID string, subtreeOnly, repair bool) int {
+	var cache *drive.Cache
+	var err error
+	if repair {
+		cache, err = drive.NewCache(cacheFile, configPath, driveID, rootNodeID, false)
+	} else {
+		cache, err = drive.NewReadOnlyCache(cacheFile, driveID, rootNodeID)
+	}
+	if nil != err {
+		Log.Errorf("%v", err)
+		return fsckFailed
+	}
+	defer cache.Close()
+
+	report, err := cache.Check(repair, subtreeOnly)
+	if nil != err {
+		Log.Errorf("%v", err)
+		return fsckFailed
+	}
+
+	fmt.Printf("Namespace %v: %v objects, %v index entries\n", report.Namespace, report.Objects, report.IndexEntries)
+	printFsckClass("Undecodable objects", report.UndecodableObjects)
+	printFsckClass("Dangling index entries", report.DanglingIndex)
+	printFsckClass("Mismatched index entries", report.MismatchedIndex)
+	printFsckClass("Missing index entries", report.MissingIndex)
+	printFsckClass("Orphaned objects", report.OrphanedObjects)
+
+	if 0 == report.Inconsistencies() {
+		fmt.Println("No inconsistencies found")
+		return fsckOK
+	}
+	if report.Repaired {
+		fmt.Printf("Repaired %v inconsistencies\n", report.Inconsistencies())
+		return fsckRepaired
+	}
+	fmt.Printf("Found %v inconsistencies, run with --repair to repair them\n", report.Inconsistencies())
+	return fsckInconsistent
+}
+
+func printFsckClass(class string, entries []string) {
+	fmt.Printf("%v: %v\n", class, len(entries))
+	for _, entry := range entries {
+		fmt.Printf("  %v\n", entry)
+	}
+}
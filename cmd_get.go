@@ -0,0 +1,73 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+
+	. "github.com/claudetech/loggo/default"
+	"github.com/plexdrive/plexdrive/chunk"
+	"github.com/plexdrive/plexdrive/config"
+	"github.com/plexdrive/plexdrive/control"
+	"github.com/plexdrive/plexdrive/drive"
+)
+
+// runGetCommand downloads a file by mount path or object id to local disk
+func runGetCommand(source, dest string, threads int, rangeSize int64, ackAbuse bool, cacheFile, configPath, driveID, rootNodeID string) int {
+	if "" == source || "" == dest {
+		Log.Errorf("Source and destination must be specified (plexdrive get <path|id> <dest>)")
+		return 2
+	}
+
+	cfg, err := config.Read(filepath.Join(configPath, "config.json"))
+	if nil != err {
+		Log.Errorf("Could not read configuration, run plexdrive mount first")
+		Log.Debugf("%v", err)
+		return 3
+	}
+
+	// paths are resolved from the cache, everything else is an object id
+	id := source
+	if strings.HasPrefix(source, "/") {
+		browser, err := control.Open(cacheFile, configPath, driveID, rootNodeID, false)
+		if nil != err {
+			Log.Errorf("%v", err)
+			return 1
+		}
+		entry, err := browser.Stat(source)
+		browser.Close()
+		if nil != err {
+			Log.Errorf("%v", err)
+			return 1
+		}
+		id = entry.ID
+	}
+
+	client, err := drive.NewAPIClient(cfg, configPath, driveID)
+	if nil != err {
+		Log.Errorf("%v", err)
+		return 4
+	}
+	object, err := client.FetchObject(id)
+	if nil != err {
+		Log.Errorf("%v", err)
+		return 1
+	}
+
+	if info, err := os.Stat(dest); nil == err && info.IsDir() {
+		dest = filepath.Join(dest, object.Name)
+	}
+
+	fetcher, err := chunk.NewFetcher(client, threads, rangeSize, ackAbuse)
+	if nil != err {
+		Log.Errorf("%v", err)
+		return 1
+	}
+	Log.Infof("Downloading %v (%v) to %v", object.ObjectID, object.Name, dest)
+	if err := fetcher.Fetch(object, dest); nil != err {
+		Log.Errorf("%v", err)
+		return 1
+	}
+	Log.Infof("Downloaded %v bytes to %v", object.Size, dest)
+	return 0
+}
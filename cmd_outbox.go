@@ -0,0 +1,29 @@
+package main
+
+import (
+	"fmt"
+
+	. "github.com/claudetech/loggo/default"
+	"github.com/plexdrive/plexdrive/control"
+)
+
+// runOutboxCommand lists the operations that are not applied to Google Drive yet
+func runOutboxCommand(cacheFile, configPath, driveID, rootNodeID string) int {
+	client, err := control.Open(cacheFile, configPath, driveID, rootNodeID, false)
+	if nil != err {
+		Log.Errorf("%v", err)
+		return 1
+	}
+	defer client.Close()
+
+	ops, err := client.Outbox()
+	if nil != err {
+		Log.Errorf("%v", err)
+		return 1
+	}
+	for _, op := range ops {
+		fmt.Printf("%v %-6v %v %v (%v attempts)\n", op.Created.Local().Format("2006-01-02 15:04:05"), op.Kind, op.ObjectID, op.Name, op.Attempts)
+	}
+	fmt.Printf("%v pending operations\n", len(ops))
+	return 0
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"fmt"
+
+	. "github.com/claudetech/loggo/default"
+	"github.com/plexdrive/plexdrive/drive"
+)
+
+// runPathCommand prints the mount path of an object id
+func runPathCommand(id, cacheFile, configPath, driveID, rootNodeID string) int {
+	if "" == id {
+		Log.Errorf("Object id not specified")
+		return 2
+	}
+	cache, err := drive.NewCache(cacheFile, configPath, driveID, rootNodeID, false)
+	if nil != err {
+		Log.Errorf("%v", err)
+		return 1
+	}
+	defer cache.Close()
+
+	p, err := cache.GetPath(id)
+	if nil != err {
+		Log.Errorf("%v", err)
+		return 1
+	}
+	fmt.Println(p)
+	return 0
+}
+
+// runIDCommand prints the object id of a mount path
+func runIDCommand(p, cacheFile, configPath, driveID, rootNodeID string) int {
+	if "" == p {
+		Log.Errorf("Path not specified")
+		return 2
+	}
+	cache, err := drive.NewCache(cacheFile, configPath, driveID, rootNodeID, false)
+	if nil != err {
+		Log.Errorf("%v", err)
+		return 1
+	}
+	defer cache.Close()
+
+	object, err := cache.GetObjectByPath(p)
+	if nil != err {
+		Log.Errorf("%v", err)
+		return 1
+	}
+	fmt.Println(object.ObjectID)
+	return 0
+}
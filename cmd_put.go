@@ -0,0 +1,262 @@
+package main
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sync"
+
+	. "github.com/claudetech/loggo/default"
+	"github.com/plexdrive/plexdrive/config"
+	"github.com/plexdrive/plexdrive/control"
+	"github.com/plexdrive/plexdrive/drive"
+)
+
+// uploader uploads local files in parallel and stores the created objects in the cache
+type uploader struct {
+	client    *drive.Client
+	browser   control.Client
+	chunkSize int
+	jobs      chan *uploadJob
+	wait      sync.WaitGroup
+	lock      sync.Mutex
+	uploaded  int
+	skipped   int
+	failed    int
+}
+
+// uploadJob is a local file to upload, existing is the remote object with the same name
+type uploadJob struct {
+	localPath string
+	parentID  string
+	name      string
+	existing  *control.Entry
+}
+
+// runPutCommand uploads a local file or folder tree to a remote path
+func runPutCommand(local, remote string, threads int, chunkSize int64, cacheFile, configPath, driveID, rootNodeID string) int {
+	if "" == local || "" == remote {
+		Log.Errorf("Source and destination must be specified (plexdrive put <local> <remote-path>)")
+		return 2
+	}
+	info, err := os.Stat(local)
+	if nil != err {
+		Log.Errorf("Could not read %v", local)
+		Log.Debugf("%v", err)
+		return 1
+	}
+
+	cfg, err := config.Read(filepath.Join(configPath, "config.json"))
+	if nil != err {
+		Log.Errorf("Could not read configuration, run plexdrive mount first")
+		Log.Debugf("%v", err)
+		return 3
+	}
+
+	browser, err := control.Open(cacheFile, configPath, driveID, rootNodeID, true)
+	if nil != err {
+		Log.Errorf("%v", err)
+		return 1
+	}
+	defer browser.Close()
+
+	// like cp the source is put into an existing folder or gets the name of the remote path
+	parentID, name := "", filepath.Base(local)
+	existing, err := browser.Stat(remote)
+	if nil != err {
+		existing = nil
+	}
+	if nil != existing && existing.IsDir {
+		parentID = existing.ID
+		children, err := browser.List(existing.Path)
+		if nil != err {
+			Log.Errorf("%v", err)
+			return 1
+		}
+		existing = findEntry(children, name)
+	} else {
+		parent, err := browser.Stat(path.Dir(path.Clean("/" + remote)))
+		if nil != err || !parent.IsDir {
+			Log.Errorf("Remote folder %v doesn't exist", path.Dir(remote))
+			return 1
+		}
+		parentID, name = parent.ID, path.Base(path.Clean("/"+remote))
+	}
+
+	client, err := drive.NewAPIClient(cfg, configPath, driveID)
+	if nil != err {
+		Log.Errorf("%v", err)
+		return 4
+	}
+
+	u := &uploader{
+		client:    client,
+		browser:   browser,
+		chunkSize: int(chunkSize),
+		jobs:      make(chan *uploadJob, threads),
+	}
+	for i := 0; i < max(threads, 1); i++ {
+		u.wait.Add(1)
+		go u.thread()
+	}
+
+	if info.IsDir() {
+		u.putFolder(local, parentID, name, existing)
+	} else {
+		u.jobs <- &uploadJob{localPath: local, parentID: parentID, name: name, existing: existing}
+	}
+	close(u.jobs)
+	u.wait.Wait()
+
+	Log.Infof("Uploaded %v files / skipped %v identical files / %v failed", u.uploaded, u.skipped, u.failed)
+	if u.failed > 0 {
+		return 1
+	}
+	return 0
+}
+
+// putFolder creates the remote folder if it doesn't exist and queues all files of the local folder
+func (u *uploader) putFolder(localPath, parentID, name string, existing *control.Entry) {
+	folderID := ""
+	children := make([]*control.Entry, 0)
+	if nil != existing {
+		if !existing.IsDir {
+			u.fail(fmt.Errorf("Could not upload folder %v, %v is a file", localPath, existing.Path))
+			return
+		}
+		var err error
+		if children, err = u.browser.List(existing.Path); nil != err {
+			u.fail(err)
+			return
+		}
+		folderID = existing.ID
+	} else {
+		folder, err := u.client.CreateFolder(parentID, name)
+		if nil != err {
+			u.fail(err)
+			return
+		}
+		if err := u.browser.Update([]*drive.APIObject{folder}); nil != err {
+			Log.Warningf("%v", err)
+		}
+		Log.Infof("Created folder %v", localPath)
+		folderID = folder.ObjectID
+	}
+
+	files, err := ioutil.ReadDir(localPath)
+	if nil != err {
+		Log.Debugf("%v", err)
+		u.fail(fmt.Errorf("Could not read folder %v", localPath))
+		return
+	}
+	for _, file := range files {
+		p := filepath.Join(localPath, file.Name())
+		info, err := os.Lstat(p)
+		if nil == err && 0 != info.Mode()&os.ModeSymlink {
+			// follow symlinks to files, symlinks to folders can point to an ancestor
+			if info, err = os.Stat(p); nil == err && info.IsDir() {
+				Log.Warningf("Skipping %v, it is a symlink to a folder", p)
+				continue
+			}
+		}
+		if nil != err {
+			Log.Debugf("%v", err)
+			u.fail(fmt.Errorf("Could not read %v", p))
+			continue
+		}
+		if info.IsDir() {
+			u.putFolder(p, folderID, file.Name(), findEntry(children, file.Name()))
+		} else if info.Mode().IsRegular() {
+			u.jobs <- &uploadJob{localPath: p, parentID: folderID, name: file.Name(), existing: findEntry(children, file.Name())}
+		} else {
+			Log.Warningf("Skipping %v, it is not a regular file", p)
+		}
+	}
+}
+
+func (u *uploader) thread() {
+	defer u.wait.Done()
+	for job := range u.jobs {
+		uploaded, err := u.upload(job)
+		u.lock.Lock()
+		if nil != err {
+			u.failed++
+			Log.Errorf("%v", err)
+		} else if uploaded {
+			u.uploaded++
+		} else {
+			u.skipped++
+		}
+		u.lock.Unlock()
+	}
+}
+
+// upload uploads a file unless the existing remote file has the same checksum
+func (u *uploader) upload(job *uploadJob) (bool, error) {
+	file, err := os.Open(job.localPath)
+	if nil != err {
+		Log.Debugf("%v", err)
+		return false, fmt.Errorf("Could not open %v", job.localPath)
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if nil != err {
+		Log.Debugf("%v", err)
+		return false, fmt.Errorf("Could not read %v", job.localPath)
+	}
+
+	replaceID := ""
+	if nil != job.existing {
+		if job.existing.IsDir {
+			return false, fmt.Errorf("Could not upload file %v, %v is a folder", job.localPath, job.existing.Path)
+		}
+		if uint64(info.Size()) == job.existing.Size {
+			hash := md5.New()
+			if _, err := io.Copy(hash, file); nil != err {
+				Log.Debugf("%v", err)
+				return false, fmt.Errorf("Could not read %v", job.localPath)
+			}
+			if hex.EncodeToString(hash.Sum(nil)) == job.existing.MD5Checksum {
+				Log.Debugf("Skipping %v, %v has the same checksum", job.localPath, job.existing.Path)
+				return false, nil
+			}
+			if _, err := file.Seek(0, io.SeekStart); nil != err {
+				Log.Debugf("%v", err)
+				return false, fmt.Errorf("Could not read %v", job.localPath)
+			}
+		}
+		replaceID = job.existing.ID
+	}
+
+	object, err := u.client.Upload(job.parentID, job.name, replaceID, file, info.ModTime(), u.chunkSize)
+	if nil != err {
+		return false, err
+	}
+	if err := u.browser.Update([]*drive.APIObject{object}); nil != err {
+		Log.Warningf("%v", err)
+	}
+	Log.Infof("Uploaded %v (%v bytes)", job.localPath, info.Size())
+	return true, nil
+}
+
+func (u *uploader) fail(err error) {
+	Log.Errorf("%v", err)
+	u.lock.Lock()
+	u.failed++
+	u.lock.Unlock()
+}
+
+// findEntry finds an entry by name
+func findEntry(entries []*control.Entry, name string) *control.Entry {
+	for _, entry := range entries {
+		if entry.Name == name {
+			return entry
+		}
+	}
+	return nil
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/plexdrive/plexdrive/control"
+	"github.com/plexdrive/plexdrive/drive"
+)
+
+// redirectTransport sends all requests to the test server
+type redirectTransport struct {
+	target *url.URL
+	base   http.RoundTripper
+}
+
+func (t *redirectTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req.URL.Scheme = t.target.Scheme
+	req.URL.Host = t.target.Host
+	return t.base.RoundTrip(req)
+}
+
+// testDriveFile returns the API representation of a file
+func testDriveFile(id, name, parent, mimeType string, content []byte) string {
+	sum := md5.Sum(content)
+	return fmt.Sprintf(`{"id": "%v", "name": "%v", "mimeType": "%v", "size": "%v", "md5Checksum": "%v", "parents": ["%v"], `+
+		`"modifiedTime": "2020-01-01T00:00:00Z", "createdTime": "2020-01-01T00:00:00Z", "capabilities": {"canTrash": true}}`,
+		id, name, mimeType, len(content), hex.EncodeToString(sum[:]), parent)
+}
+
+// readUpload returns the metadata and the content of a multipart upload
+func readUpload(t *testing.T, r *http.Request) (map[string]interface{}, []byte) {
+	_, params, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if nil != err {
+		t.Fatal(err)
+	}
+	reader := multipart.NewReader(r.Body, params["boundary"])
+	part, err := reader.NextPart()
+	if nil != err {
+		t.Fatal(err)
+	}
+	metadata := make(map[string]interface{})
+	if err := json.NewDecoder(part).Decode(&metadata); nil != err {
+		t.Fatal(err)
+	}
+	part, err = reader.NextPart()
+	if nil != err {
+		t.Fatal(err)
+	}
+	content, err := ioutil.ReadAll(part)
+	if nil != err {
+		t.Fatal(err)
+	}
+	return metadata, content
+}
+
+func TestPut(t *testing.T) {
+	dir, err := ioutil.TempDir("", "plexdrive")
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	token := `{"access_token":"test","token_type":"Bearer","expiry":"2100-01-01T00:00:00Z"}`
+	ioutil.WriteFile(filepath.Join(dir, "token.json"), []byte(token), 0600)
+	ioutil.WriteFile(filepath.Join(dir, "config.json"), []byte(`{}`), 0600)
+
+	cacheFile := filepath.Join(dir, "cache.bolt")
+	cache, err := drive.NewCache(cacheFile, dir, "", "", false)
+	if nil != err {
+		t.Fatal(err)
+	}
+	cache.StoreRootID("root")
+	cache.BatchUpdateObjects([]*drive.APIObject{
+		{ObjectID: "root", Name: "My Drive", IsDir: true},
+		{ObjectID: "tv", Name: "TV", IsDir: true, Parents: []string{"root"}},
+	})
+	cache.Close()
+
+	local := filepath.Join(dir, "Show")
+	os.Mkdir(local, 0755)
+	ioutil.WriteFile(filepath.Join(local, "S01E01.mkv"), []byte("episode 1"), 0644)
+	ioutil.WriteFile(filepath.Join(local, "S01E02.mkv"), []byte("episode 2"), 0644)
+	// symlinks to folders are skipped, they could point to an ancestor
+	os.Symlink(local, filepath.Join(local, "Loop"))
+
+	var lock sync.Mutex
+	requests := make([]string, 0)
+	ids := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		defer lock.Unlock()
+		requests = append(requests, r.Method+" "+r.URL.Path)
+		w.Header().Set("Content-Type", "application/json")
+		switch {
+		case "POST" == r.Method && "/drive/v3/files" == r.URL.Path:
+			// the folder is created without content
+			fmt.Fprint(w, `{"id": "show"}`)
+		case "GET" == r.Method && "/drive/v3/files/show" == r.URL.Path:
+			fmt.Fprint(w, testDriveFile("show", "Show", "tv", "application/vnd.google-apps.folder", nil))
+		case "POST" == r.Method && "/upload/drive/v3/files" == r.URL.Path:
+			metadata, content := readUpload(t, r)
+			ids++
+			fmt.Fprint(w, testDriveFile(fmt.Sprintf("file%v", ids), metadata["name"].(string), "show", "video/x-matroska", content))
+		case "PATCH" == r.Method && strings.HasPrefix(r.URL.Path, "/upload/drive/v3/files/"):
+			metadata, content := readUpload(t, r)
+			id := strings.TrimPrefix(r.URL.Path, "/upload/drive/v3/files/")
+			fmt.Fprint(w, testDriveFile(id, metadata["name"].(string), "show", "video/x-matroska", content))
+		default:
+			t.Errorf("Unexpected API request %v %v", r.Method, r.URL)
+			w.WriteHeader(404)
+		}
+	}))
+	defer server.Close()
+
+	target, _ := url.Parse(server.URL)
+	defaultTransport := http.DefaultTransport
+	http.DefaultTransport = &redirectTransport{target: target, base: defaultTransport}
+	defer func() {
+		http.DefaultTransport = defaultTransport
+	}()
+
+	put := func() []string {
+		lock.Lock()
+		requests = requests[:0]
+		lock.Unlock()
+		if code := runPutCommand(local, "/TV", 2, 1<<20, cacheFile, dir, "", ""); 0 != code {
+			t.Fatalf("Expected put to succeed, exited with %v", code)
+		}
+		lock.Lock()
+		defer lock.Unlock()
+		return append([]string{}, requests...)
+	}
+
+	// the missing folder is created and all files are uploaded
+	if r := put(); 4 != len(r) || "POST /drive/v3/files" != r[0] || "GET /drive/v3/files/show" != r[1] ||
+		"POST /upload/drive/v3/files" != r[2] || "POST /upload/drive/v3/files" != r[3] {
+		t.Fatalf("Unexpected requests %v", r)
+	}
+	browser, err := control.Open(cacheFile, dir, "", "", false)
+	if nil != err {
+		t.Fatal(err)
+	}
+	entries, err := browser.List("/TV/Show")
+	browser.Close()
+	if nil != err || 2 != len(entries) {
+		t.Fatalf("Expected the uploaded files to be cached, got %v: %v", entries, err)
+	}
+
+	// identical files are skipped and changed files get a new revision
+	ioutil.WriteFile(filepath.Join(local, "S01E02.mkv"), []byte("episode 2 (proper)"), 0644)
+	replaced := ""
+	for _, entry := range entries {
+		if "S01E02.mkv" == entry.Name {
+			replaced = entry.ID
+		}
+	}
+	if r := put(); 1 != len(r) || "PATCH /upload/drive/v3/files/"+replaced != r[0] {
+		t.Fatalf("Unexpected requests %v", r)
+	}
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"fmt"
+
+	. "github.com/claudetech/loggo/default"
+	"github.com/plexdrive/plexdrive/control"
+)
+
+// runQuarantineCommand lists, confirms or discards quarantined removals
+func runQuarantineCommand(command string, ids []string, cacheFile, configPath, driveID, rootNodeID string) int {
+	if "" == command {
+		command = "list"
+	}
+	client, err := control.Open(cacheFile, configPath, driveID, rootNodeID, "list" != command)
+	if nil != err {
+		Log.Errorf("%v", err)
+		return 1
+	}
+	defer client.Close()
+
+	switch command {
+	case "list":
+		records, err := client.Quarantine()
+		if nil != err {
+			Log.Errorf("%v", err)
+			return 1
+		}
+		for _, record := range records {
+			state := "pending"
+			if record.Held {
+				state = "held"
+			}
+			fmt.Printf("%-8v %v %v (%v)\n", state, record.Removed.Local().Format("2006-01-02 15:04:05"), record.ObjectID, record.Name)
+		}
+		fmt.Printf("%v removals in quarantine\n", len(records))
+	case "confirm":
+		deleted, err := client.ConfirmQuarantine(ids)
+		if nil != err {
+			Log.Errorf("%v", err)
+			return 1
+		}
+		fmt.Printf("Deleted %v objects\n", deleted)
+	case "discard":
+		released, err := client.DiscardQuarantine(ids)
+		if nil != err {
+			Log.Errorf("%v", err)
+			return 1
+		}
+		fmt.Printf("Kept %v objects\n", released)
+	default:
+		Log.Errorf("Quarantine command %v not found (available: list, confirm, discard)", command)
+		return 2
+	}
+	return 0
+}
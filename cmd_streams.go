@@ -0,0 +1,30 @@
+package main
+
+import (
+	"fmt"
+
+	. "github.com/claudetech/loggo/default"
+	"github.com/plexdrive/plexdrive/control"
+)
+
+// runStreamsCommand lists the download statistics of the streams of the running mount
+func runStreamsCommand(cacheFile, configPath, driveID, rootNodeID string) int {
+	client, err := control.Open(cacheFile, configPath, driveID, rootNodeID, false)
+	if nil != err {
+		Log.Errorf("%v", err)
+		return 1
+	}
+	defer client.Close()
+
+	stats, err := client.Streams()
+	if nil != err {
+		Log.Errorf("%v", err)
+		return 1
+	}
+	for _, s := range stats {
+		fmt.Printf("%v %v (%v): %v running, %v queued, %v preloads queued, %v downloaded, %v dropped, %v threads guaranteed\n",
+			s.LastActive.Local().Format("2006-01-02 15:04:05"), s.Stream, s.Name, s.Running, s.Queued, s.Preloads, s.Downloaded, s.Dropped, s.Share)
+	}
+	fmt.Printf("%v active streams\n", len(stats))
+	return 0
+}
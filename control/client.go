@@ -0,0 +1,221 @@
+package control
+
+import (
+	"fmt"
+	"net/rpc"
+
+	. "github.com/claudetech/loggo/default"
+	"github.com/plexdrive/plexdrive/chunk"
+	"github.com/plexdrive/plexdrive/drive"
+)
+
+// Client queries the cache of a mount
+type Client interface {
+	Stat(path string) (*Entry, error)
+	List(path string) ([]*Entry, error)
+	Find(query FindQuery) ([]*Entry, error)
+	Usage(path string) (*Usage, error)
+	Update(objects []*drive.APIObject) error
+	Quarantine() ([]*drive.QuarantinedObject, error)
+	ConfirmQuarantine(ids []string) (int, error)
+	DiscardQuarantine(ids []string) (int, error)
+	Outbox() ([]*drive.OutboxOperation, error)
+	Streams() ([]chunk.StreamStats, error)
+	Close() error
+}
+
+// Open uses the cache file directly and falls back to the control socket of
+// the running mount if the cache file is locked by it, clients that don't
+// update the cache open it read-only
+func Open(cacheFile, configPath, driveID, rootNodeID string, writable bool) (Client, error) {
+	var cache *drive.Cache
+	var err error
+	if writable {
+		cache, err = drive.NewCache(cacheFile, configPath, driveID, rootNodeID, false)
+	} else {
+		cache, err = drive.NewReadOnlyCache(cacheFile, driveID, rootNodeID)
+	}
+	if nil == err {
+		return &localClient{
+			cache:   cache,
+			service: NewService(cache, nil),
+		}, nil
+	}
+	Log.Debugf("%v", err)
+
+	socketPath := SocketPath(configPath, driveID, rootNodeID)
+	client, rerr := rpc.Dial("unix", socketPath)
+	if nil != rerr {
+		Log.Debugf("%v", rerr)
+		return nil, fmt.Errorf("%v and no running mount found on %v", err, socketPath)
+	}
+	Log.Debugf("Using control socket %v", socketPath)
+	return &remoteClient{
+		client: client,
+	}, nil
+}
+
+// localClient queries the cache file
+type localClient struct {
+	cache   *drive.Cache
+	service *Service
+}
+
+func (c *localClient) Stat(path string) (*Entry, error) {
+	var entry Entry
+	if err := c.service.Stat(path, &entry); nil != err {
+		return nil, err
+	}
+	return &entry, nil
+}
+
+func (c *localClient) List(path string) ([]*Entry, error) {
+	var entries []*Entry
+	if err := c.service.List(path, &entries); nil != err {
+		return nil, err
+	}
+	return entries, nil
+}
+
+func (c *localClient) Find(query FindQuery) ([]*Entry, error) {
+	var entries []*Entry
+	if err := c.service.Find(query, &entries); nil != err {
+		return nil, err
+	}
+	return entries, nil
+}
+
+func (c *localClient) Usage(path string) (*Usage, error) {
+	var usage Usage
+	if err := c.service.Usage(path, &usage); nil != err {
+		return nil, err
+	}
+	return &usage, nil
+}
+
+func (c *localClient) Update(objects []*drive.APIObject) error {
+	var updated int
+	return c.service.Update(objects, &updated)
+}
+
+func (c *localClient) Quarantine() ([]*drive.QuarantinedObject, error) {
+	var records []*drive.QuarantinedObject
+	if err := c.service.Quarantine(false, &records); nil != err {
+		return nil, err
+	}
+	return records, nil
+}
+
+func (c *localClient) ConfirmQuarantine(ids []string) (int, error) {
+	var deleted int
+	err := c.service.ConfirmQuarantine(ids, &deleted)
+	return deleted, err
+}
+
+func (c *localClient) DiscardQuarantine(ids []string) (int, error) {
+	var released int
+	err := c.service.DiscardQuarantine(ids, &released)
+	return released, err
+}
+
+func (c *localClient) Outbox() ([]*drive.OutboxOperation, error) {
+	var ops []*drive.OutboxOperation
+	if err := c.service.Outbox(0, &ops); nil != err {
+		return nil, err
+	}
+	return ops, nil
+}
+
+func (c *localClient) Streams() ([]chunk.StreamStats, error) {
+	var stats []chunk.StreamStats
+	if err := c.service.Streams(0, &stats); nil != err {
+		return nil, err
+	}
+	return stats, nil
+}
+
+func (c *localClient) Close() error {
+	return c.cache.Close()
+}
+
+// remoteClient queries a running mount through its control socket
+type remoteClient struct {
+	client *rpc.Client
+}
+
+func (c *remoteClient) Stat(path string) (*Entry, error) {
+	var entry Entry
+	if err := c.client.Call("Control.Stat", path, &entry); nil != err {
+		return nil, err
+	}
+	return &entry, nil
+}
+
+func (c *remoteClient) List(path string) ([]*Entry, error) {
+	var entries []*Entry
+	if err := c.client.Call("Control.List", path, &entries); nil != err {
+		return nil, err
+	}
+	return entries, nil
+}
+
+func (c *remoteClient) Find(query FindQuery) ([]*Entry, error) {
+	var entries []*Entry
+	if err := c.client.Call("Control.Find", query, &entries); nil != err {
+		return nil, err
+	}
+	return entries, nil
+}
+
+func (c *remoteClient) Usage(path string) (*Usage, error) {
+	var usage Usage
+	if err := c.client.Call("Control.Usage", path, &usage); nil != err {
+		return nil, err
+	}
+	return &usage, nil
+}
+
+func (c *remoteClient) Update(objects []*drive.APIObject) error {
+	var updated int
+	return c.client.Call("Control.Update", objects, &updated)
+}
+
+func (c *remoteClient) Quarantine() ([]*drive.QuarantinedObject, error) {
+	var records []*drive.QuarantinedObject
+	if err := c.client.Call("Control.Quarantine", false, &records); nil != err {
+		return nil, err
+	}
+	return records, nil
+}
+
+func (c *remoteClient) ConfirmQuarantine(ids []string) (int, error) {
+	var deleted int
+	err := c.client.Call("Control.ConfirmQuarantine", ids, &deleted)
+	return deleted, err
+}
+
+func (c *remoteClient) DiscardQuarantine(ids []string) (int, error) {
+	var released int
+	err := c.client.Call("Control.DiscardQuarantine", ids, &released)
+	return released, err
+}
+
+func (c *remoteClient) Outbox() ([]*drive.OutboxOperation, error) {
+	var ops []*drive.OutboxOperation
+	if err := c.client.Call("Control.Outbox", 0, &ops); nil != err {
+		return nil, err
+	}
+	return ops, nil
+}
+
+func (c *remoteClient) Streams() ([]chunk.StreamStats, error) {
+	var stats []chunk.StreamStats
+	if err := c.client.Call("Control.Streams", 0, &stats); nil != err {
+		return nil, err
+	}
+	return stats, nil
+}
+
+func (c *remoteClient) Close() error {
+	return c.client.Close()
+}
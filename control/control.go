@@ -0,0 +1,68 @@
+package control
+
+import (
+	"fmt"
+	"hash/fnv"
+	"net"
+	"net/rpc"
+	"os"
+	"path/filepath"
+
+	. "github.com/claudetech/loggo/default"
+	"github.com/plexdrive/plexdrive/drive"
+)
+
+// SocketPath returns the path of the control socket of a mount, every
+// cache namespace gets its own socket in the configuration directory
+func SocketPath(configPath, driveID, rootNodeID string) string {
+	h := fnv.New64a()
+	h.Write([]byte(drive.Namespace(driveID, rootNodeID)))
+	return filepath.Join(configPath, fmt.Sprintf("control-%x.sock", h.Sum64()))
+}
+
+// Server serves the control service of a running mount on a unix socket
+type Server struct {
+	listener net.Listener
+	path     string
+}
+
+// Serve starts serving the cache and the download statistics of a running
+// mount on the socket
+func Serve(socketPath string, cache *drive.Cache, streams StreamSource) (*Server, error) {
+	// a socket left behind by a crashed process can't be reused
+	if conn, err := net.Dial("unix", socketPath); nil == err {
+		conn.Close()
+		return nil, fmt.Errorf("Control socket %v is used by another plexdrive process", socketPath)
+	}
+	os.Remove(socketPath)
+
+	server := rpc.NewServer()
+	if err := server.RegisterName("Control", NewService(cache, streams)); nil != err {
+		Log.Debugf("%v", err)
+		return nil, fmt.Errorf("Could not register control service")
+	}
+
+	listener, err := net.Listen("unix", socketPath)
+	if nil != err {
+		Log.Debugf("%v", err)
+		return nil, fmt.Errorf("Could not listen on control socket %v", socketPath)
+	}
+	if err := os.Chmod(socketPath, 0600); nil != err {
+		Log.Debugf("%v", err)
+	}
+
+	Log.Debugf("Serving control socket %v", socketPath)
+	go server.Accept(listener)
+
+	return &Server{
+		listener: listener,
+		path:     socketPath,
+	}, nil
+}
+
+// Close stops serving and removes the socket
+func (s *Server) Close() error {
+	err := s.listener.Close()
+	os.Remove(s.path)
+	return err
+}
@@ -0,0 +1,84 @@
+package control
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/plexdrive/plexdrive/drive"
+)
+
+func TestQueryRunningMount(t *testing.T) {
+	dir, err := ioutil.TempDir("", "plexdrive")
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cacheFile := filepath.Join(dir, "cache.bolt")
+	cache, err := drive.NewCache(cacheFile, dir, "", "", false)
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer cache.Close()
+
+	modified := time.Date(2020, 1, 2, 0, 0, 0, 0, time.UTC)
+	cache.StoreRootID("root")
+	cache.BatchUpdateObjects([]*drive.APIObject{
+		{ObjectID: "root", Name: "My Drive", IsDir: true},
+		{ObjectID: "tv", Name: "TV", IsDir: true, Parents: []string{"root"}},
+		{ObjectID: "e1", Name: "S01E01.mkv", Size: 100, LastModified: modified, Parents: []string{"tv"}},
+		{ObjectID: "e2", Name: "S01E02.mkv", Size: 300, LastModified: modified.Add(time.Hour), Parents: []string{"tv"}},
+		{ObjectID: "nfo", Name: "tvshow.nfo", Size: 10, LastModified: modified, Parents: []string{"tv"}},
+	})
+
+	server, err := Serve(SocketPath(dir, "", ""), cache, nil)
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	// the cache file is locked by the running mount
+	client, err := Open(cacheFile, dir, "", "", false)
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	if _, ok := client.(*remoteClient); !ok {
+		t.Fatalf("Expected client of the control socket")
+	}
+
+	entries, err := client.List("/TV")
+	if nil != err || 3 != len(entries) || "S01E01.mkv" != entries[0].Name {
+		t.Fatalf("Unexpected entries %v: %v", entries, err)
+	}
+
+	entries, err = client.Find(FindQuery{Path: "/", Name: "*.mkv", MinSize: 200})
+	if nil != err || 1 != len(entries) || "/TV/S01E02.mkv" != entries[0].Path {
+		t.Fatalf("Unexpected matches %v: %v", entries, err)
+	}
+	entries, err = client.Find(FindQuery{Path: "/", Type: "f", ModifiedBefore: modified.Add(time.Minute)})
+	if nil != err || 2 != len(entries) {
+		t.Fatalf("Unexpected matches %v: %v", entries, err)
+	}
+
+	usage, err := client.Usage("/")
+	if nil != err || 410 != usage.Size || 3 != usage.Files || 2 != usage.Folders {
+		t.Fatalf("Unexpected usage %+v: %v", usage, err)
+	}
+
+	if _, err := client.Stat("/missing"); nil == err {
+		t.Fatalf("Expected error for missing path")
+	}
+
+	// uploaded objects are visible to the mount immediately
+	err = client.Update([]*drive.APIObject{{ObjectID: "e3", Name: "S01E03.mkv", Size: 50, Parents: []string{"tv"}}})
+	if nil != err {
+		t.Fatal(err)
+	}
+	if object, err := cache.GetObjectByPath("/TV/S01E03.mkv"); nil != err || "e3" != object.ObjectID {
+		t.Fatalf("Unexpected object %v: %v", object, err)
+	}
+}
@@ -0,0 +1,300 @@
+package control
+
+import (
+	"fmt"
+	"path"
+	"path/filepath"
+	"sort"
+	"time"
+
+	. "github.com/claudetech/loggo/default"
+	"github.com/plexdrive/plexdrive/chunk"
+	"github.com/plexdrive/plexdrive/drive"
+)
+
+// Entry is an object of the cache with its mount path
+type Entry struct {
+	Path         string    `json:"path"`
+	ID           string    `json:"id"`
+	Name         string    `json:"name"`
+	IsDir        bool      `json:"isDir"`
+	Size         uint64    `json:"size"`
+	LastModified time.Time `json:"lastModified"`
+	CreatedTime  time.Time `json:"createdTime"`
+	MD5Checksum  string    `json:"md5Checksum,omitempty"`
+	Parents      []string  `json:"parents"`
+}
+
+// FindQuery are the predicates of a find, zero values match everything
+type FindQuery struct {
+	Path           string
+	Name           string
+	Type           string
+	MinSize        uint64
+	MaxSize        uint64
+	ModifiedAfter  time.Time
+	ModifiedBefore time.Time
+}
+
+// Usage is the disk usage of a folder
+type Usage struct {
+	Path    string `json:"path"`
+	Size    uint64 `json:"size"`
+	Files   int    `json:"files"`
+	Folders int    `json:"folders"`
+}
+
+// StreamSource reports the download statistics of the open files of a mount
+type StreamSource interface {
+	Streams() []chunk.StreamStats
+}
+
+// Service answers queries about the cache of a mount
+type Service struct {
+	cache   *drive.Cache
+	streams StreamSource
+}
+
+// NewService creates a new service for the cache, streams is nil if no
+// mount is running
+func NewService(cache *drive.Cache, streams StreamSource) *Service {
+	return &Service{
+		cache:   cache,
+		streams: streams,
+	}
+}
+
+// Stat returns the entry of a path
+func (s *Service) Stat(p string, reply *Entry) error {
+	object, err := s.cache.GetObjectByPath(p)
+	if nil != err {
+		Log.Debugf("%v", err)
+		return fmt.Errorf("Could not find %v", p)
+	}
+	*reply = *newEntry(path.Clean("/"+p), object)
+	return nil
+}
+
+// List returns the entries of a folder sorted by name
+func (s *Service) List(p string, reply *[]*Entry) error {
+	var folder Entry
+	if err := s.Stat(p, &folder); nil != err {
+		return err
+	}
+	if !folder.IsDir {
+		*reply = []*Entry{&folder}
+		return nil
+	}
+
+	entries, err := s.children(&folder)
+	if nil != err {
+		return err
+	}
+	*reply = entries
+	return nil
+}
+
+// Find returns all entries below a path matching the query
+func (s *Service) Find(query FindQuery, reply *[]*Entry) error {
+	if _, err := filepath.Match(query.Name, ""); nil != err {
+		Log.Debugf("%v", err)
+		return fmt.Errorf("Invalid name pattern %v", query.Name)
+	}
+
+	matches := make([]*Entry, 0)
+	err := s.walk(query.Path, func(entry *Entry) {
+		if query.matches(entry) {
+			matches = append(matches, entry)
+		}
+	})
+	if nil != err {
+		return err
+	}
+	*reply = matches
+	return nil
+}
+
+// Usage returns the summarized size of all files below a path
+func (s *Service) Usage(p string, reply *Usage) error {
+	usage := Usage{Path: path.Clean("/" + p)}
+	err := s.walk(p, func(entry *Entry) {
+		if entry.IsDir {
+			usage.Folders++
+		} else {
+			usage.Files++
+			usage.Size += entry.Size
+		}
+	})
+	if nil != err {
+		return err
+	}
+	*reply = usage
+	return nil
+}
+
+// Update stores objects created by the command line tools in the cache, so
+// that the mount serves them before they are received as changes
+func (s *Service) Update(objects []*drive.APIObject, reply *int) error {
+	if err := s.cache.BatchUpdateObjects(objects); nil != err {
+		return err
+	}
+	*reply = len(objects)
+	return nil
+}
+
+// Quarantine returns the quarantined removals
+func (s *Service) Quarantine(heldOnly bool, reply *[]*drive.QuarantinedObject) error {
+	records, err := s.cache.GetQuarantine()
+	if nil != err {
+		return err
+	}
+	*reply = make([]*drive.QuarantinedObject, 0, len(records))
+	for _, record := range records {
+		if record.Held || !heldOnly {
+			*reply = append(*reply, record)
+		}
+	}
+	return nil
+}
+
+// ConfirmQuarantine applies the quarantined removals of the objects or all
+// held removals if no ids are given
+func (s *Service) ConfirmQuarantine(ids []string, reply *int) error {
+	deleted, err := s.cache.ApplyQuarantine(quarantineFilter(ids))
+	if nil != err {
+		return err
+	}
+	*reply = deleted
+	return nil
+}
+
+// DiscardQuarantine keeps the objects of the quarantined removals or of all
+// held removals if no ids are given
+func (s *Service) DiscardQuarantine(ids []string, reply *int) error {
+	released, err := s.cache.ReleaseQuarantine(quarantineFilter(ids))
+	if nil != err {
+		return err
+	}
+	*reply = released
+	return nil
+}
+
+// Outbox returns the operations that are not applied to Google Drive yet
+func (s *Service) Outbox(limit int, reply *[]*drive.OutboxOperation) error {
+	ops, err := s.cache.GetPendingOperations()
+	if nil != err {
+		return err
+	}
+	if limit > 0 && len(ops) > limit {
+		ops = ops[:limit]
+	}
+	*reply = ops
+	return nil
+}
+
+// Streams returns the download statistics of the recently active streams
+func (s *Service) Streams(_ int, reply *[]chunk.StreamStats) error {
+	if nil == s.streams {
+		return fmt.Errorf("Stream statistics are only available from a running mount")
+	}
+	*reply = s.streams.Streams()
+	return nil
+}
+
+// children returns the entries of a folder sorted by name
+func (s *Service) children(folder *Entry) ([]*Entry, error) {
+	objects, err := s.cache.GetObjectsByParent(folder.ID)
+	if nil != err {
+		Log.Debugf("%v", err)
+		return nil, fmt.Errorf("Could not list %v", folder.Path)
+	}
+	entries := make([]*Entry, 0, len(objects))
+	for _, object := range objects {
+		entries = append(entries, newEntry(path.Join(folder.Path, object.Name), object))
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Name < entries[j].Name
+	})
+	return entries, nil
+}
+
+// walk calls fn for a path and all entries below it, objects with multiple
+// parents are only visited once
+func (s *Service) walk(p string, fn func(entry *Entry)) error {
+	var root Entry
+	if err := s.Stat(p, &root); nil != err {
+		return err
+	}
+
+	seen := make(map[string]struct{})
+	queue := []*Entry{&root}
+	for len(queue) > 0 {
+		entry := queue[0]
+		queue = queue[1:]
+		if _, exists := seen[entry.ID]; exists {
+			continue
+		}
+		seen[entry.ID] = struct{}{}
+		fn(entry)
+
+		if entry.IsDir {
+			children, err := s.children(entry)
+			if nil != err {
+				return err
+			}
+			queue = append(queue, children...)
+		}
+	}
+	return nil
+}
+
+// matches checks if an entry matches all predicates of the query, the name
+// pattern must have been validated before
+func (q *FindQuery) matches(entry *Entry) bool {
+	if "" != q.Name {
+		if match, _ := filepath.Match(q.Name, entry.Name); !match {
+			return false
+		}
+	}
+	if ("f" == q.Type && entry.IsDir) || ("d" == q.Type && !entry.IsDir) {
+		return false
+	}
+	if entry.Size < q.MinSize || (q.MaxSize > 0 && entry.Size > q.MaxSize) {
+		return false
+	}
+	if !q.ModifiedAfter.IsZero() && !entry.LastModified.After(q.ModifiedAfter) {
+		return false
+	}
+	if !q.ModifiedBefore.IsZero() && !entry.LastModified.Before(q.ModifiedBefore) {
+		return false
+	}
+	return true
+}
+
+func quarantineFilter(ids []string) func(record *drive.QuarantinedObject) bool {
+	return func(record *drive.QuarantinedObject) bool {
+		if 0 == len(ids) {
+			return record.Held
+		}
+		for _, id := range ids {
+			if id == record.ObjectID {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+func newEntry(p string, object *drive.APIObject) *Entry {
+	return &Entry{
+		Path:         p,
+		ID:           object.ObjectID,
+		Name:         object.Name,
+		IsDir:        object.IsDir,
+		Size:         object.Size,
+		LastModified: object.LastModified,
+		CreatedTime:  object.CreatedTime,
+		MD5Checksum:  object.MD5Checksum,
+		Parents:      object.Parents,
+	}
+}
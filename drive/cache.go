@@ -2,9 +2,8 @@ package drive
 
 import (
 	"bytes"
-	"encoding/json"
+	"encoding/binary"
 	"fmt"
-	"io/ioutil"
 	"path/filepath"
 
 	"time"
@@ -19,12 +18,16 @@ import (
 type Cache struct {
 	db        *bolt.DB
 	tokenPath string
+	namespace []byte
+	paths     *pathMemo
 }
 
 var (
-	bObjects   = []byte("api_objects")
-	bParents   = []byte("idx_api_objects_py_parent")
-	bPageToken = []byte("page_token")
+	bNamespaces = []byte("namespaces")
+	bObjects    = []byte("api_objects")
+	bParents    = []byte("idx_api_objects_py_parent")
+	bPageToken  = []byte("page_token")
+	kRootID     = []byte("root")
 )
 
 // APIObject is a Google Drive file object
@@ -34,11 +37,22 @@ type APIObject struct {
 	IsDir        bool
 	Size         uint64
 	LastModified time.Time
+	CreatedTime  time.Time
 	DownloadURL  string
 	Parents      []string
 	CanTrash     bool
 	MD5Checksum  string
 	RevisionID   string
+	TargetID     string
+}
+
+// FileID returns the id of the file holding the content, which is the
+// target of a shortcut or the object itself
+func (o *APIObject) FileID() string {
+	if "" != o.TargetID {
+		return o.TargetID
+	}
+	return o.ObjectID
 }
 
 // PageToken is the last change id
@@ -47,12 +61,35 @@ type PageToken struct {
 	Token string
 }
 
-// NewCache creates a new cache instance
-func NewCache(cacheFile, configPath string, sqlDebug bool) (*Cache, error) {
+// Namespace returns the cache namespace of a mount, every combination of
+// shared drive and root node has its own objects, index and page token
+func Namespace(driveID, rootNodeID string) string {
+	rootNodeID = normalizeRootNodeID(driveID, rootNodeID)
+	if "" == driveID {
+		return "my-drive/" + rootNodeID
+	}
+	return driveID + "/" + rootNodeID
+}
+
+// normalizeRootNodeID resolves the default root node of a (shared) drive
+func normalizeRootNodeID(driveID, rootNodeID string) string {
+	if "" == rootNodeID {
+		rootNodeID = "root"
+	}
+	if "" != driveID && rootNodeID == "root" {
+		rootNodeID = driveID
+	}
+	return rootNodeID
+}
+
+// NewCache creates a new cache instance for the namespace of the given drive and root node
+func NewCache(cacheFile, configPath, driveID, rootNodeID string, sqlDebug bool) (*Cache, error) {
 	Log.Debugf("Opening cache connection")
 
-	db, err := bolt.Open(cacheFile, 0600, nil)
-	if nil != err {
+	db, err := bolt.Open(cacheFile, 0600, &bolt.Options{Timeout: time.Second})
+	if bolt.ErrTimeout == err {
+		return nil, fmt.Errorf("Could not open cache file %v, it is locked by another plexdrive process", cacheFile)
+	} else if nil != err {
 		Log.Debugf("%v", err)
 		return nil, fmt.Errorf("Could not open cache file")
 	}
@@ -60,17 +97,46 @@ func NewCache(cacheFile, configPath string, sqlDebug bool) (*Cache, error) {
 	cache := Cache{
 		db:        db,
 		tokenPath: filepath.Join(configPath, "token.json"),
+		namespace: []byte(Namespace(driveID, rootNodeID)),
+		paths:     newPathMemo(),
+	}
+	Log.Debugf("Using cache namespace %s", cache.namespace)
+
+	// Upgrade the cache file to the current schema
+	if err := migrate(db); nil != err {
+		db.Close()
+		return nil, err
 	}
 
 	// Make sure the necessary buckets exist
 	err = db.Update(func(tx *bolt.Tx) error {
-		if _, err := tx.CreateBucketIfNotExists(bObjects); nil != err {
+		namespaces, err := tx.CreateBucketIfNotExists(bNamespaces)
+		if nil != err {
+			return err
+		}
+		ns, err := namespaces.CreateBucketIfNotExists(cache.namespace)
+		if nil != err {
+			return err
+		}
+		if _, err := ns.CreateBucketIfNotExists(bObjects); nil != err {
+			return err
+		}
+		if _, err := ns.CreateBucketIfNotExists(bParents); nil != err {
+			return err
+		}
+		if _, err := ns.CreateBucketIfNotExists(bPageToken); nil != err {
+			return err
+		}
+		if _, err := ns.CreateBucketIfNotExists(bQuarantine); nil != err {
+			return err
+		}
+		if _, err := ns.CreateBucketIfNotExists(bOutbox); nil != err {
 			return err
 		}
-		if _, err := tx.CreateBucketIfNotExists(bParents); nil != err {
+		if _, err := ns.CreateBucketIfNotExists(bDeferred); nil != err {
 			return err
 		}
-		if _, err := tx.CreateBucketIfNotExists(bPageToken); nil != err {
+		if _, err := ns.CreateBucketIfNotExists(bIDPool); nil != err {
 			return err
 		}
 		return nil
@@ -79,6 +145,50 @@ func NewCache(cacheFile, configPath string, sqlDebug bool) (*Cache, error) {
 	return &cache, err
 }
 
+// NewReadOnlyCache opens the namespace of a cache file for reading without
+// migrating it, the namespace must already exist in the current schema
+func NewReadOnlyCache(cacheFile, driveID, rootNodeID string) (*Cache, error) {
+	Log.Debugf("Opening read-only cache connection")
+
+	db, err := bolt.Open(cacheFile, 0600, &bolt.Options{Timeout: time.Second, ReadOnly: true})
+	if bolt.ErrTimeout == err {
+		return nil, fmt.Errorf("Could not open cache file %v, it is locked by another plexdrive process", cacheFile)
+	} else if nil != err {
+		Log.Debugf("%v", err)
+		return nil, fmt.Errorf("Could not open cache file")
+	}
+
+	cache := Cache{
+		db:        db,
+		namespace: []byte(Namespace(driveID, rootNodeID)),
+		paths:     newPathMemo(),
+	}
+	err = db.View(func(tx *bolt.Tx) error {
+		version := uint32(0)
+		if meta := tx.Bucket(bMeta); nil != meta && nil != meta.Get(kSchemaVersion) {
+			version = binary.BigEndian.Uint32(meta.Get(kSchemaVersion))
+		}
+		if version != schemaVersion {
+			return fmt.Errorf("Cache schema version %v doesn't match the supported version %v", version, schemaVersion)
+		}
+		if namespaces := tx.Bucket(bNamespaces); nil == namespaces || nil == namespaces.Bucket(cache.namespace) {
+			return fmt.Errorf("Cache namespace %s doesn't exist", cache.namespace)
+		}
+		return nil
+	})
+	if nil != err {
+		db.Close()
+		return nil, err
+	}
+
+	return &cache, nil
+}
+
+// namespaceBucket returns the bucket holding the objects, index and page token of the mount
+func (c *Cache) namespaceBucket(tx *bolt.Tx) *bolt.Bucket {
+	return tx.Bucket(bNamespaces).Bucket(c.namespace)
+}
+
 // Close closes all handles
 func (c *Cache) Close() error {
 	Log.Debugf("Closing cache file")
@@ -88,38 +198,12 @@ func (c *Cache) Close() error {
 
 // LoadToken loads a token from cache
 func (c *Cache) LoadToken() (*oauth2.Token, error) {
-	Log.Debugf("Loading token from cache")
-
-	tokenFile, err := ioutil.ReadFile(c.tokenPath)
-	if nil != err {
-		Log.Debugf("%v", err)
-		return nil, fmt.Errorf("Could not read token file in %v", c.tokenPath)
-	}
-
-	var token oauth2.Token
-	json.Unmarshal(tokenFile, &token)
-
-	Log.Tracef("Got token from cache %v", token)
-
-	return &token, nil
+	return loadToken(c.tokenPath)
 }
 
 // StoreToken stores a token in the cache or updates the existing token element
 func (c *Cache) StoreToken(token *oauth2.Token) error {
-	Log.Debugf("Storing token to cache")
-
-	tokenJSON, err := json.Marshal(token)
-	if nil != err {
-		Log.Debugf("%v", err)
-		return fmt.Errorf("Could not generate token.json content")
-	}
-
-	if err := ioutil.WriteFile(c.tokenPath, tokenJSON, 0644); nil != err {
-		Log.Debugf("%v", err)
-		return fmt.Errorf("Could not generate token.json file")
-	}
-
-	return nil
+	return storeToken(c.tokenPath, token)
 }
 
 // GetObject gets an object by id
@@ -127,7 +211,8 @@ func (c *Cache) GetObject(id string) (object *APIObject, err error) {
 	Log.Tracef("Getting object %v", id)
 
 	c.db.View(func(tx *bolt.Tx) error {
-		object, err = boltGetObject(tx, id)
+		ns := c.namespaceBucket(tx)
+		object, err = boltGetObject(ns, id)
 		return nil
 	})
 	if nil != err {
@@ -144,18 +229,10 @@ func (c *Cache) GetObjectsByParent(parent string) ([]*APIObject, error) {
 
 	objects := make([]*APIObject, 0)
 	c.db.View(func(tx *bolt.Tx) error {
-		cr := tx.Bucket(bParents).Cursor()
-
-		// Iterate over all object ids stored under the parent in the index
-		objectIds := make([]string, 0)
-		prefix := []byte(parent + "/")
-		for k, v := cr.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = cr.Next() {
-			objectIds = append(objectIds, string(v))
-		}
-
-		// Fetch all objects for the given ids
-		for _, id := range objectIds {
-			if object, err := boltGetObject(tx, id); nil == err {
+		ns := c.namespaceBucket(tx)
+		// Fetch all objects for the ids stored under the parent in the index
+		for _, id := range boltGetChildIDs(ns, parent) {
+			if object, err := boltGetObject(ns, id); nil == err {
 				objects = append(objects, object)
 			}
 		}
@@ -171,15 +248,16 @@ func (c *Cache) GetObjectByParentAndName(parent, name string) (object *APIObject
 	Log.Tracef("Getting object %v in parent %v", name, parent)
 
 	c.db.View(func(tx *bolt.Tx) error {
+		ns := c.namespaceBucket(tx)
 		// Look up object id in parent-name index
-		b := tx.Bucket(bParents)
+		b := ns.Bucket(bParents)
 		v := b.Get([]byte(parent + "/" + name))
 		if nil == v {
 			return nil
 		}
 
 		// Fetch object for given id
-		object, err = boltGetObject(tx, string(v))
+		object, err = boltGetObject(ns, string(v))
 		return nil
 	})
 	if nil != err {
@@ -197,35 +275,84 @@ func (c *Cache) GetObjectByParentAndName(parent, name string) (object *APIObject
 // DeleteObject deletes an object by id
 func (c *Cache) DeleteObject(id string) error {
 	err := c.db.Update(func(tx *bolt.Tx) error {
-		b := tx.Bucket(bObjects)
-		object, _ := boltGetObject(tx, id)
+		ns := c.namespaceBucket(tx)
+		object, _ := boltGetObject(ns, id)
 		if nil == object {
 			return nil
 		}
+		return boltDeleteObject(ns, object)
+	})
+	c.paths.invalidate(id)
+	if nil != err {
+		Log.Debugf("%v", err)
+		return fmt.Errorf("Could not delete object %v", id)
+	}
 
-		b.Delete([]byte(id))
+	return nil
+}
 
-		// Remove object ids from the index
-		b = tx.Bucket(bParents)
-		for _, parent := range object.Parents {
-			b.Delete([]byte(parent + "/" + object.Name))
-		}
+// DeleteSubtree deletes an object and all of its descendants by id, children
+// that are still linked to another cached parent are kept
+func (c *Cache) DeleteSubtree(id string) (int, error) {
+	deleted := 0
+	err := c.db.Update(func(tx *bolt.Tx) (err error) {
+		deleted, err = boltDeleteSubtree(c.namespaceBucket(tx), id)
+		return err
+	})
+	c.paths.invalidate(id)
+	if nil != err {
+		Log.Debugf("%v", err)
+		return deleted, fmt.Errorf("Could not delete subtree %v", id)
+	}
+
+	Log.Debugf("Deleted %v objects in subtree %v", deleted, id)
+	return deleted, nil
+}
 
+// PruneObjects deletes all objects of the namespace that are not in keep
+func (c *Cache) PruneObjects(keep map[string]struct{}) (int, error) {
+	pruned := 0
+	err := c.db.Update(func(tx *bolt.Tx) error {
+		ns := c.namespaceBucket(tx)
+		pruned = 0
+		stale := make([]*APIObject, 0)
+		cr := ns.Bucket(bObjects).Cursor()
+		for k, _ := cr.First(); k != nil; k, _ = cr.Next() {
+			if _, exists := keep[string(k)]; exists {
+				continue
+			}
+			if object, err := boltGetObject(ns, string(k)); nil == err {
+				stale = append(stale, object)
+			}
+		}
+		for _, object := range stale {
+			if err := boltDeleteObject(ns, object); nil != err {
+				return err
+			}
+			pruned++
+		}
 		return nil
 	})
+	c.paths.clear()
 	if nil != err {
 		Log.Debugf("%v", err)
-		return fmt.Errorf("Could not delete object %v", id)
+		return pruned, fmt.Errorf("Could not prune stale objects")
 	}
 
-	return nil
+	return pruned, nil
 }
 
 // UpdateObject updates an object
 func (c *Cache) UpdateObject(object *APIObject) error {
+	moved := make([]string, 0, 1)
 	err := c.db.Update(func(tx *bolt.Tx) error {
-		return boltUpdateObject(tx, object)
+		ns := c.namespaceBucket(tx)
+		if c.paths.isMoved(ns, object) {
+			moved = append(moved, object.ObjectID)
+		}
+		return boltUpdateObject(ns, object)
 	})
+	c.paths.invalidate(moved...)
 
 	if nil != err {
 		Log.Debugf("%v", err)
@@ -235,43 +362,106 @@ func (c *Cache) UpdateObject(object *APIObject) error {
 	return nil
 }
 
-func boltStoreObject(tx *bolt.Tx, object *APIObject) error {
-	b := tx.Bucket(bObjects)
-	v, err := json.Marshal(object)
-	if nil != err {
-		return err
-	}
-	return b.Put([]byte(object.ObjectID), v)
+func boltStoreObject(ns *bolt.Bucket, object *APIObject) error {
+	b := ns.Bucket(bObjects)
+	return b.Put([]byte(object.ObjectID), encodeObject(object))
 }
 
-func boltGetObject(tx *bolt.Tx, id string) (*APIObject, error) {
-	b := tx.Bucket(bObjects)
+func boltGetObject(ns *bolt.Bucket, id string) (*APIObject, error) {
+	b := ns.Bucket(bObjects)
 	v := b.Get([]byte(id))
 	if v == nil {
 		return nil, fmt.Errorf("Could not find object %v in cache", id)
 	}
 
-	var object APIObject
-	err := json.Unmarshal(v, &object)
-	return &object, err
+	return decodeObject(v)
+}
+
+func boltDeleteObject(ns *bolt.Bucket, object *APIObject) error {
+	if err := ns.Bucket(bObjects).Delete([]byte(object.ObjectID)); nil != err {
+		return err
+	}
+
+	// Remove object ids from the index
+	b := ns.Bucket(bParents)
+	for _, parent := range object.Parents {
+		if err := b.Delete([]byte(parent + "/" + object.Name)); nil != err {
+			return err
+		}
+	}
+	return nil
+}
+
+func boltDeleteSubtree(ns *bolt.Bucket, id string) (int, error) {
+	deleted := 0
+	pending := []string{id}
+	for len(pending) > 0 {
+		id := pending[len(pending)-1]
+		pending = pending[:len(pending)-1]
+
+		object, _ := boltGetObject(ns, id)
+		if nil == object {
+			continue
+		}
+		children := boltGetChildIDs(ns, id)
+		if err := boltDeleteObject(ns, object); nil != err {
+			return deleted, err
+		}
+		deleted++
+
+		for _, childID := range children {
+			child, _ := boltGetObject(ns, childID)
+			if nil == child {
+				continue
+			}
+			parents := make([]string, 0, len(child.Parents))
+			for _, parent := range child.Parents {
+				if parent == id {
+					continue
+				}
+				if p, _ := boltGetObject(ns, parent); nil != p {
+					parents = append(parents, parent)
+				}
+			}
+			if 0 == len(parents) {
+				pending = append(pending, childID)
+				continue
+			}
+			child.Parents = parents
+			if err := boltUpdateObject(ns, child); nil != err {
+				return deleted, err
+			}
+		}
+	}
+	return deleted, nil
+}
+
+func boltGetChildIDs(ns *bolt.Bucket, parent string) []string {
+	cr := ns.Bucket(bParents).Cursor()
+	ids := make([]string, 0)
+	prefix := []byte(parent + "/")
+	for k, v := cr.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = cr.Next() {
+		ids = append(ids, string(v))
+	}
+	return ids
 }
 
-func boltUpdateObject(tx *bolt.Tx, object *APIObject) error {
-	prev, _ := boltGetObject(tx, object.ObjectID)
+func boltUpdateObject(ns *bolt.Bucket, object *APIObject) error {
+	prev, _ := boltGetObject(ns, object.ObjectID)
 	if nil != prev {
 		// Remove object ids from the index
-		b := tx.Bucket(bParents)
+		b := ns.Bucket(bParents)
 		for _, parent := range prev.Parents {
 			b.Delete([]byte(parent + "/" + prev.Name))
 		}
 	}
 
-	if err := boltStoreObject(tx, object); nil != err {
+	if err := boltStoreObject(ns, object); nil != err {
 		return err
 	}
 
 	// Store the object id by parent-name in the index
-	b := tx.Bucket(bParents)
+	b := ns.Bucket(bParents)
 	for _, parent := range object.Parents {
 		if err := b.Put([]byte(parent+"/"+object.Name), []byte(object.ObjectID)); nil != err {
 			return err
@@ -281,14 +471,20 @@ func boltUpdateObject(tx *bolt.Tx, object *APIObject) error {
 }
 
 func (c *Cache) BatchUpdateObjects(objects []*APIObject) error {
+	moved := make([]string, 0)
 	err := c.db.Update(func(tx *bolt.Tx) error {
+		ns := c.namespaceBucket(tx)
 		for _, object := range objects {
-			if err := boltUpdateObject(tx, object); nil != err {
+			if c.paths.isMoved(ns, object) {
+				moved = append(moved, object.ObjectID)
+			}
+			if err := boltUpdateObject(ns, object); nil != err {
 				return err
 			}
 		}
 		return nil
 	})
+	c.paths.invalidate(moved...)
 
 	if nil != err {
 		Log.Debugf("%v", err)
@@ -298,11 +494,37 @@ func (c *Cache) BatchUpdateObjects(objects []*APIObject) error {
 	return nil
 }
 
+// StoreRootID stores the id of the mounted root node
+func (c *Cache) StoreRootID(id string) error {
+	err := c.db.Update(func(tx *bolt.Tx) error {
+		return c.namespaceBucket(tx).Put(kRootID, []byte(id))
+	})
+	if nil != err {
+		Log.Debugf("%v", err)
+		return fmt.Errorf("Could not store root node id %v", id)
+	}
+	return nil
+}
+
+// GetRootID gets the id of the mounted root node
+func (c *Cache) GetRootID() (string, error) {
+	var id string
+	c.db.View(func(tx *bolt.Tx) error {
+		id = string(c.namespaceBucket(tx).Get(kRootID))
+		return nil
+	})
+	if "" == id {
+		return "", fmt.Errorf("Could not get root node id from cache")
+	}
+	return id, nil
+}
+
 // StoreStartPageToken stores the page token for changes
 func (c *Cache) StoreStartPageToken(token string) error {
 	Log.Debugf("Storing page token %v in cache", token)
 	err := c.db.Update(func(tx *bolt.Tx) error {
-		b := tx.Bucket(bPageToken)
+		ns := c.namespaceBucket(tx)
+		b := ns.Bucket(bPageToken)
 		return b.Put([]byte("t"), []byte(token))
 	})
 
@@ -320,7 +542,8 @@ func (c *Cache) GetStartPageToken() (string, error) {
 
 	Log.Debugf("Getting start page token from cache")
 	c.db.View(func(tx *bolt.Tx) error {
-		b := tx.Bucket(bPageToken)
+		ns := c.namespaceBucket(tx)
+		b := ns.Bucket(bPageToken)
 		v := b.Get([]byte("t"))
 		pageToken = string(v)
 		return nil
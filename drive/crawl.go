@@ -0,0 +1,340 @@
+package drive
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	. "github.com/claudetech/loggo/default"
+	gdrive "google.golang.org/api/drive/v3"
+	"google.golang.org/api/googleapi"
+)
+
+// maxRetries is the number of attempts for a throttled API request
+const maxRetries = 5
+
+// maxFolderAttempts is the number of attempts to list a folder before it is
+// skipped, so that a single failing folder doesn't abort the whole crawl
+const maxFolderAttempts = 3
+
+// folderRetryDelay is the delay before a failed folder is listed again, it is
+// multiplied by the number of failed attempts
+var folderRetryDelay = 5 * time.Second
+
+// crawlFolder is a folder waiting to be listed, pageToken is the next page of
+// a folder whose listing failed after some pages had been stored
+type crawlFolder struct {
+	id        string
+	pageToken string
+	attempts  int
+}
+
+// crawler builds the cache by listing the folders of a subtree with a fixed
+// number of workers
+type crawler struct {
+	client    *Client
+	service   *gdrive.Service
+	lock      sync.Mutex
+	cond      *sync.Cond
+	pending   []*crawlFolder
+	active    int
+	err       error
+	skipped   []string
+	folders   int64
+	objects   int64
+	startTime time.Time
+	// seen collects all crawled object ids if stale objects should be pruned
+	seen map[string]struct{}
+}
+
+// buildCache fetches the start page token and crawls the whole root subtree
+// into the cache, the page token is only stored after the crawl. Folders that
+// couldn't be listed keep the namespace marked for a resync.
+// On resync all cached objects that weren't found while crawling are removed.
+func (d *Client) buildCache(service *gdrive.Service, resync bool) error {
+	if resync {
+		Log.Infof("Cache needs a resync, crawling root %v with %v threads", d.rootNodeID, d.crawlThreads)
+	} else {
+		Log.Infof("No last change id found, crawling root %v with %v threads", d.rootNodeID, d.crawlThreads)
+	}
+
+	// the start page token must be fetched before crawling so that changes
+	// happening while crawling are replayed afterwards
+	query := service.Changes.GetStartPageToken().SupportsAllDrives(true)
+	if "" != d.driveID {
+		query = query.DriveId(d.driveID)
+	}
+	var startPageToken *gdrive.StartPageToken
+	err := retry(func() (err error) {
+		startPageToken, err = query.Do()
+		return err
+	})
+	d.updateOnline(err)
+	if nil != err {
+		Log.Debugf("%v", err)
+		return fmt.Errorf("Could not get start page token")
+	}
+
+	rootFile, err := d.GetFileById(d.rootNodeID)
+	if nil != err {
+		return err
+	}
+	root, err := d.mapFileToObject(rootFile)
+	if nil != err {
+		return err
+	}
+	if err := d.cache.UpdateObject(root); nil != err {
+		return err
+	}
+	if err := d.cache.StoreRootID(root.ObjectID); nil != err {
+		return err
+	}
+	d.lock.Lock()
+	d.rootID = root.ObjectID
+	d.lock.Unlock()
+
+	var seen map[string]struct{}
+	if resync {
+		seen = map[string]struct{}{root.ObjectID: {}}
+	}
+	skipped, err := d.crawlSubtree(service, root.ObjectID, seen)
+	if nil != err {
+		return err
+	}
+
+	if len(skipped) > 0 {
+		// the cache is incomplete, it's used as it is and rebuilt on the next start
+		Log.Warningf("Could not crawl %v folders, the cache will be resynced on the next start", len(skipped))
+		if err := d.cache.MarkResync(); nil != err {
+			return err
+		}
+	} else if resync {
+		pruned, err := d.cache.PruneObjects(seen)
+		if nil != err {
+			return err
+		}
+		Log.Infof("Removed %v stale objects from cache", pruned)
+	}
+	if err := d.cache.StoreStartPageToken(startPageToken.StartPageToken); nil != err {
+		return err
+	}
+	if resync && 0 == len(skipped) {
+		return d.cache.ClearResync()
+	}
+	return nil
+}
+
+// crawlSubtree stores all descendants of the folder in the cache, the ids of all
+// crawled objects are added to seen if it's not nil. It returns the ids of the
+// folders that have been skipped because they couldn't be listed.
+func (d *Client) crawlSubtree(service *gdrive.Service, folderID string, seen map[string]struct{}) ([]string, error) {
+	c := crawler{
+		client:    d,
+		service:   service,
+		pending:   []*crawlFolder{{id: folderID}},
+		startTime: time.Now(),
+		seen:      seen,
+	}
+	c.cond = sync.NewCond(&c.lock)
+
+	var wg sync.WaitGroup
+	for i := 0; i < d.crawlThreads; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			c.work()
+		}()
+	}
+	wg.Wait()
+	if nil != c.err {
+		return c.skipped, c.err
+	}
+
+	Log.Infof("Crawled %v folders / %v objects in %v", c.folders, c.objects, time.Since(c.startTime))
+	return c.skipped, nil
+}
+
+// work lists the pending folders until all folders have been crawled, a
+// folder that is retried stays active so that the crawl isn't finished early
+func (c *crawler) work() {
+	for {
+		folder := c.next()
+		if nil == folder {
+			return
+		}
+		err := c.listFolder(folder)
+		if nil != err {
+			Log.Debugf("%v", err)
+			folder.attempts++
+			if folder.attempts < maxFolderAttempts {
+				Log.Warningf("Could not list folder %v, retrying", folder.id)
+				time.Sleep(time.Duration(folder.attempts) * folderRetryDelay)
+			} else {
+				Log.Warningf("Could not list folder %v, skipping it", folder.id)
+			}
+		}
+
+		c.lock.Lock()
+		if nil != err && folder.attempts < maxFolderAttempts {
+			c.pending = append(c.pending, folder)
+		} else if nil != err {
+			c.skipped = append(c.skipped, folder.id)
+		}
+		c.active--
+		c.cond.Broadcast()
+		c.lock.Unlock()
+	}
+}
+
+// next waits for a pending folder, it returns nil when the crawl is done
+func (c *crawler) next() *crawlFolder {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for 0 == len(c.pending) && c.active > 0 && nil == c.err {
+		c.cond.Wait()
+	}
+	if 0 == len(c.pending) || nil != c.err {
+		return nil
+	}
+	folder := c.pending[0]
+	c.pending = c.pending[1:]
+	c.active++
+	return folder
+}
+
+// push queues the subfolders of a crawled folder
+func (c *crawler) push(folders []string) {
+	if 0 == len(folders) {
+		return
+	}
+	c.lock.Lock()
+	for _, id := range folders {
+		c.pending = append(c.pending, &crawlFolder{id: id})
+	}
+	c.cond.Broadcast()
+	c.lock.Unlock()
+}
+
+// listFolder stores all children of a folder and queues the child folders, the
+// page token of the folder is updated after every stored page
+func (c *crawler) listFolder(folder *crawlFolder) error {
+	query := c.service.Files.
+		List().
+		Q(fmt.Sprintf("'%v' in parents and trashed = false", folder.id)).
+		Fields(googleapi.Field(fmt.Sprintf("nextPageToken, files(%v)", fields))).
+		PageSize(1000).
+		SupportsAllDrives(true).
+		IncludeItemsFromAllDrives(true)
+	if "" != c.client.driveID {
+		query = query.Corpora("drive").DriveId(c.client.driveID)
+	}
+
+	for {
+		if c.failed() {
+			return nil
+		}
+
+		var results *gdrive.FileList
+		err := retry(func() (err error) {
+			results, err = query.PageToken(folder.pageToken).Do()
+			return err
+		})
+		if nil != err {
+			Log.Debugf("%v", err)
+			return fmt.Errorf("Could not list folder %v", folder.id)
+		}
+
+		objects := make([]*APIObject, 0, len(results.Files))
+		folders := make([]string, 0)
+		for _, file := range results.Files {
+			object, err := c.client.mapFileToObject(file)
+			if nil != err {
+				Log.Debugf("%v", err)
+				Log.Warningf("Could not map Google Drive file %v (%v) to object", file.Id, file.Name)
+				continue
+			}
+			objects = append(objects, object)
+			if object.IsDir {
+				folders = append(folders, object.ObjectID)
+			}
+		}
+		if nil != c.seen {
+			c.lock.Lock()
+			for _, object := range objects {
+				c.seen[object.ObjectID] = struct{}{}
+			}
+			c.lock.Unlock()
+		}
+		if err := c.client.cache.BatchUpdateObjects(objects); nil != err {
+			// the cache can't be written, so the crawl can't continue
+			c.fail(err)
+			return nil
+		}
+		c.push(folders)
+
+		count := atomic.AddInt64(&c.objects, int64(len(objects)))
+		Log.Debugf("Crawled %v objects in folder %v (total: %v)", len(objects), folder.id, count)
+
+		if "" == results.NextPageToken {
+			break
+		}
+		folder.pageToken = results.NextPageToken
+	}
+
+	if folders := atomic.AddInt64(&c.folders, 1); 0 == folders%1000 {
+		Log.Infof("Crawled %v folders / %v objects", folders, atomic.LoadInt64(&c.objects))
+	}
+	return nil
+}
+
+// fail stores the first error that aborts the crawl
+func (c *crawler) fail(err error) {
+	c.lock.Lock()
+	if nil == c.err {
+		c.err = err
+	}
+	c.cond.Broadcast()
+	c.lock.Unlock()
+}
+
+// failed checks if the crawl has been aborted
+func (c *crawler) failed() bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return nil != c.err
+}
+
+// retry runs the API call and retries it with an exponential backoff
+// if Google Drive throttles the request
+func retry(call func() error) (err error) {
+	delay := time.Second
+	for i := 0; i < maxRetries; i++ {
+		if err = call(); nil == err || !isRetryableError(err) {
+			return err
+		}
+		Log.Debugf("Request throttled, retrying in %v: %v", delay, err)
+		time.Sleep(delay)
+		delay *= 2
+	}
+	return err
+}
+
+// isRetryableError checks if the API error is a temporary throttling or backend error
+func isRetryableError(err error) bool {
+	apiErr, ok := err.(*googleapi.Error)
+	if !ok {
+		return false
+	}
+	if apiErr.Code == 429 || apiErr.Code >= 500 {
+		return true
+	}
+	if apiErr.Code == 403 {
+		for _, e := range apiErr.Errors {
+			if e.Reason == "rateLimitExceeded" || e.Reason == "userRateLimitExceeded" {
+				return true
+			}
+		}
+	}
+	return false
+}
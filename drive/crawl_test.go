@@ -0,0 +1,248 @@
+package drive
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"google.golang.org/api/googleapi"
+)
+
+// testFolders are the children of the folders of the crawled test drive
+var testFolders = map[string][]string{
+	"root":   {"movies", "tv", "readme"},
+	"movies": {"movie"},
+	"tv":     {"show"},
+	"show":   {"episode1", "episode2"},
+}
+
+// testFile returns the API representation of a file of the test drive
+func testFile(id, parent string) string {
+	mimeType := "video/x-matroska"
+	if _, isFolder := testFolders[id]; isFolder {
+		mimeType = folderMimeType
+	}
+	return fmt.Sprintf(`{"id": "%v", "name": "%v", "mimeType": "%v", "size": "42", "parents": ["%v"], `+
+		`"modifiedTime": "2020-01-01T00:00:00Z", "createdTime": "2020-01-01T00:00:00Z", "capabilities": {"canTrash": true}}`,
+		id, strings.Title(id), mimeType, parent)
+}
+
+// newCrawlTestClient creates a client for the test drive, the failing folders
+// can't be listed for the given number of attempts
+func newCrawlTestClient(t *testing.T, cache *Cache, failing map[string]int) *Client {
+	var lock sync.Mutex
+	client := newTestClient(cache, func(req *http.Request) (*http.Response, error) {
+		switch {
+		case strings.HasSuffix(req.URL.Path, "/changes/startPageToken"):
+			return jsonResponse(req, 200, `{"startPageToken": "42"}`), nil
+		case strings.HasSuffix(req.URL.Path, "/changes"):
+			return jsonResponse(req, 200, `{"newStartPageToken": "42", "changes": []}`), nil
+		case strings.HasSuffix(req.URL.Path, "/files/generateIds"):
+			return jsonResponse(req, 200, `{"ids": ["generated"]}`), nil
+		case strings.HasSuffix(req.URL.Path, "/files/root"):
+			return jsonResponse(req, 200, `{"id": "root", "name": "My Drive", "mimeType": "`+folderMimeType+`", `+
+				`"modifiedTime": "2020-01-01T00:00:00Z", "createdTime": "2020-01-01T00:00:00Z", "capabilities": {}}`), nil
+		case strings.HasSuffix(req.URL.Path, "/files"):
+			q := req.URL.Query().Get("q")
+			parent := q[1 : strings.Index(q[1:], "'")+1]
+			lock.Lock()
+			fail := failing[parent] > 0
+			failing[parent]--
+			lock.Unlock()
+			if fail {
+				return nil, errors.New("connection reset")
+			}
+
+			// every folder is listed in pages of one file
+			children := testFolders[parent]
+			page := 0
+			fmt.Sscanf(req.URL.Query().Get("pageToken"), "%d", &page)
+			if page >= len(children) {
+				return jsonResponse(req, 200, `{"files": []}`), nil
+			}
+			next := ""
+			if page+1 < len(children) {
+				next = fmt.Sprintf("%d", page+1)
+			}
+			return jsonResponse(req, 200, fmt.Sprintf(`{"nextPageToken": "%v", "files": [%v]}`, next, testFile(children[page], parent))), nil
+		}
+		t.Errorf("Unexpected API request %v", req.URL)
+		return jsonResponse(req, 404, `{"error": {"code": 404}}`), nil
+	})
+	client.crawlThreads = 2
+	return client
+}
+
+func TestBuildCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "plexdrive")
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	folderRetryDelay = 0
+
+	cache, err := NewCache(filepath.Join(dir, "cache.bolt"), dir, "", "", false)
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer cache.Close()
+	cache.UpdateObject(&APIObject{ObjectID: "stale", Name: "Stale", Parents: []string{"root"}})
+
+	// a folder that fails temporarily is retried from the failed page
+	client := newCrawlTestClient(t, cache, map[string]int{"show": 1})
+	service, err := client.getClient()
+	if nil != err {
+		t.Fatal(err)
+	}
+	if err := client.buildCache(service, true); nil != err {
+		t.Fatal(err)
+	}
+	for _, id := range []string{"movies", "movie", "tv", "show", "episode1", "episode2", "readme"} {
+		if _, err := cache.GetObject(id); nil != err {
+			t.Fatalf("Expected crawled object %v: %v", id, err)
+		}
+	}
+	if _, err := cache.GetObject("stale"); nil == err {
+		t.Fatal("Expected stale object to be pruned")
+	}
+	if token, _ := cache.GetStartPageToken(); "42" != token || cache.NeedsResync() {
+		t.Fatalf("Expected page token 42 without resync got %v", token)
+	}
+
+	// a folder that keeps failing is skipped and the cache is resynced later
+	client = newCrawlTestClient(t, cache, map[string]int{"tv": maxFolderAttempts})
+	cache.UpdateObject(&APIObject{ObjectID: "stale", Name: "Stale", Parents: []string{"root"}})
+	if service, err = client.getClient(); nil != err {
+		t.Fatal(err)
+	}
+	if err := client.buildCache(service, true); nil != err {
+		t.Fatal(err)
+	}
+	if _, err := cache.GetObject("movie"); nil != err {
+		t.Fatalf("Expected the other folders to be crawled: %v", err)
+	}
+	if _, err := cache.GetObject("stale"); nil != err {
+		t.Fatal("Expected an incomplete crawl not to prune objects")
+	}
+	if !cache.NeedsResync() {
+		t.Fatal("Expected an incomplete crawl to be resynced")
+	}
+}
+
+func TestCrawlSubtree(t *testing.T) {
+	dir, err := ioutil.TempDir("", "plexdrive")
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	folderRetryDelay = 0
+
+	cache, err := NewCache(filepath.Join(dir, "cache.bolt"), dir, "", "", false)
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer cache.Close()
+
+	client := newCrawlTestClient(t, cache, map[string]int{"movies": maxFolderAttempts})
+	service, err := client.getClient()
+	if nil != err {
+		t.Fatal(err)
+	}
+	seen := make(map[string]struct{})
+	skipped, err := client.crawlSubtree(service, "root", seen)
+	if nil != err {
+		t.Fatal(err)
+	}
+	if 1 != len(skipped) || "movies" != skipped[0] {
+		t.Fatalf("Expected folder movies to be skipped got %v", skipped)
+	}
+	if 6 != len(seen) {
+		t.Fatalf("Expected 6 crawled objects got %v", len(seen))
+	}
+	if object, err := cache.GetObjectByParentAndName("show", "Episode2"); nil != err || 42 != object.Size {
+		t.Fatalf("Expected crawled episode got %v: %v", object, err)
+	}
+}
+
+func TestApplyChangesMovedIn(t *testing.T) {
+	dir, err := ioutil.TempDir("", "plexdrive")
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	folderRetryDelay = 0
+
+	cache, err := NewCache(filepath.Join(dir, "cache.bolt"), dir, "", "", false)
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer cache.Close()
+	cache.BatchUpdateObjects([]*APIObject{
+		{ObjectID: "root", Name: "My Drive", IsDir: true},
+		// the change feed stores folders outside of the root without contents
+		{ObjectID: "tv", Name: "Tv", IsDir: true, Parents: []string{"elsewhere"}},
+		{ObjectID: "readme", Name: "Readme", Parents: []string{"root"}},
+	})
+
+	// the contents of folders moved into the root are crawled without subtree-only mode
+	client := newCrawlTestClient(t, cache, map[string]int{})
+	client.rootID = "root"
+	service, err := client.getClient()
+	if nil != err {
+		t.Fatal(err)
+	}
+	if _, _, err := client.applyChanges(service, []*APIObject{
+		{ObjectID: "tv", Name: "Tv", IsDir: true, Parents: []string{"root"}},
+		{ObjectID: "movies", Name: "Movies", IsDir: true, Parents: []string{"root"}},
+		{ObjectID: "readme", Name: "Readme", Parents: []string{"root"}},
+	}, nil); nil != err {
+		t.Fatal(err)
+	}
+	for _, id := range []string{"show", "episode1", "episode2", "movie"} {
+		if _, err := cache.GetObject(id); nil != err {
+			t.Fatalf("Expected crawled object %v: %v", id, err)
+		}
+	}
+	if moved := client.movedIntoSubtree([]*APIObject{
+		{ObjectID: "tv", Name: "Tv", IsDir: true, Parents: []string{"root"}},
+		{ObjectID: "other", Name: "Other", IsDir: true, Parents: []string{"elsewhere"}},
+	}); 0 != len(moved) {
+		t.Fatalf("Expected no folders moved in got %v", moved)
+	}
+}
+
+func TestIsRetryableError(t *testing.T) {
+	tests := []struct {
+		err       error
+		retryable bool
+	}{
+		{&googleapi.Error{Code: 429}, true},
+		{&googleapi.Error{Code: 500}, true},
+		{&googleapi.Error{Code: 503}, true},
+		{&googleapi.Error{Code: 403, Errors: []googleapi.ErrorItem{{Reason: "userRateLimitExceeded"}}}, true},
+		{&googleapi.Error{Code: 403, Errors: []googleapi.ErrorItem{{Reason: "insufficientFilePermissions"}}}, false},
+		{&googleapi.Error{Code: 404}, false},
+		{errors.New("connection reset"), false},
+	}
+	for _, test := range tests {
+		if retryable := isRetryableError(test.err); test.retryable != retryable {
+			t.Errorf("Expected %v to be retryable: %v", test.err, test.retryable)
+		}
+	}
+
+	// throttled requests are retried, other errors are returned immediately
+	calls := 0
+	err := retry(func() error {
+		calls++
+		return &googleapi.Error{Code: 404}
+	})
+	if nil == err || 1 != calls {
+		t.Fatalf("Expected a single attempt got %v", calls)
+	}
+}
@@ -6,6 +6,7 @@ import (
 	"net/http"
 	"os"
 	"os/signal"
+	"path/filepath"
 	"sync"
 	"syscall"
 	"time"
@@ -19,7 +20,7 @@ import (
 )
 
 // fields are the fields that should be returned by the Google Drive API
-const fields = "id, name, mimeType, modifiedTime, md5Checksum, size, headRevisionId, explicitlyTrashed, parents, capabilities/canTrash, shortcutDetails"
+const fields = "id, name, mimeType, modifiedTime, createdTime, md5Checksum, size, headRevisionId, explicitlyTrashed, parents, capabilities/canTrash, shortcutDetails"
 
 // folderMimeType is the mime type of a Google Drive folder
 const folderMimeType = "application/vnd.google-apps.folder"
@@ -30,11 +31,18 @@ const shortcutMimeType = "application/vnd.google-apps.shortcut"
 // Client holds the Google Drive API connection(s)
 type Client struct {
 	cache           *Cache
+	tokenPath       string
 	context         context.Context
 	token           *oauth2.Token
 	config          *oauth2.Config
 	rootNodeID      string
+	rootID          string
 	driveID         string
+	crawlThreads    int
+	offline         int32
+	subtreeOnly     bool
+	guard           DeletionGuard
+	outboxNotify    chan struct{}
 	changesChecking bool
 	lock            sync.Mutex
 	ChangedObjects  chan []*APIObject
@@ -42,30 +50,24 @@ type Client struct {
 }
 
 // NewClient creates a new Google Drive client
-func NewClient(config *config.Config, cache *Cache, refreshInterval time.Duration, rootNodeID string, driveID string) (*Client, error) {
+func NewClient(config *config.Config, cache *Cache, refreshInterval time.Duration, rootNodeID string, driveID string, crawlThreads int, subtreeOnly bool, guard DeletionGuard) (*Client, error) {
 	client := Client{
-		cache:   cache,
-		context: context.Background(),
-		config: &oauth2.Config{
-			ClientID:     config.ClientID,
-			ClientSecret: config.ClientSecret,
-			Endpoint: oauth2.Endpoint{
-				AuthURL:  "https://accounts.google.com/o/oauth2/auth",
-				TokenURL: "https://accounts.google.com/o/oauth2/token",
-			},
-			RedirectURL: "urn:ietf:wg:oauth:2.0:oob",
-			Scopes:      []string{gdrive.DriveScope},
-		},
+		cache:          cache,
+		tokenPath:      cache.tokenPath,
+		context:        context.Background(),
+		config:         newOAuthConfig(config),
 		rootNodeID:     rootNodeID,
 		driveID:        driveID,
+		crawlThreads:   crawlThreads,
+		subtreeOnly:    subtreeOnly,
+		guard:          guard,
+		outboxNotify:   make(chan struct{}, 1),
 		ChangedObjects: make(chan []*APIObject, 1),
 	}
 
-	if "" == client.rootNodeID {
-		client.rootNodeID = "root"
-	}
-	if "" != client.driveID && client.rootNodeID == "root" {
-		client.rootNodeID = client.driveID
+	client.rootNodeID = normalizeRootNodeID(client.driveID, client.rootNodeID)
+	if client.crawlThreads < 1 {
+		client.crawlThreads = 1
 	}
 
 	if err := client.authorize(); nil != err {
@@ -73,10 +75,43 @@ func NewClient(config *config.Config, cache *Cache, refreshInterval time.Duratio
 	}
 
 	go client.startWatchChanges(refreshInterval)
+	go client.processOutbox()
 
 	return &client, nil
 }
 
+// NewAPIClient creates a Google Drive client for API requests of the command
+// line tools, it has no cache and doesn't watch for changes
+func NewAPIClient(config *config.Config, configPath string, driveID string) (*Client, error) {
+	client := Client{
+		tokenPath:      filepath.Join(configPath, "token.json"),
+		context:        context.Background(),
+		config:         newOAuthConfig(config),
+		driveID:        driveID,
+		ChangedObjects: make(chan []*APIObject, 1),
+	}
+
+	if err := client.authorize(); nil != err {
+		return nil, err
+	}
+
+	return &client, nil
+}
+
+// newOAuthConfig creates the OAuth configuration of the Google Drive API
+func newOAuthConfig(config *config.Config) *oauth2.Config {
+	return &oauth2.Config{
+		ClientID:     config.ClientID,
+		ClientSecret: config.ClientSecret,
+		Endpoint: oauth2.Endpoint{
+			AuthURL:  "https://accounts.google.com/o/oauth2/auth",
+			TokenURL: "https://accounts.google.com/o/oauth2/token",
+		},
+		RedirectURL: "urn:ietf:wg:oauth:2.0:oob",
+		Scopes:      []string{gdrive.DriveScope},
+	}
+}
+
 func (d *Client) startWatchChanges(refreshInterval time.Duration) {
 	d.checkChanges(true)
 	sigChan := make(chan os.Signal, 1)
@@ -89,15 +124,25 @@ func (d *Client) startWatchChanges(refreshInterval time.Duration) {
 				return
 			}
 			d.checkChanges(false)
-		case <-time.After(refreshInterval):
+		case <-time.After(d.nextCheckInterval(refreshInterval)):
 			d.checkChanges(false)
 		}
 	}
 }
 
+// nextCheckInterval checks for changes more often while the API is not
+// reachable to reconnect as soon as possible
+func (d *Client) nextCheckInterval(refreshInterval time.Duration) time.Duration {
+	if !d.Online() && reconnectInterval < refreshInterval {
+		return reconnectInterval
+	}
+	return refreshInterval
+}
+
 func (d *Client) checkChanges(firstCheck bool) {
 	d.lock.Lock()
 	if d.changesChecking {
+		d.lock.Unlock()
 		return
 	}
 	d.changesChecking = true
@@ -117,19 +162,27 @@ func (d *Client) checkChanges(firstCheck bool) {
 		return
 	}
 
-	// get the last token
-	pageToken, err := d.cache.GetStartPageToken()
-	if nil != err {
-		pageToken = "1"
-		Log.Info("No last change id found, starting from beginning...")
-	} else {
-		Log.Debugf("Last change id found, continuing getting changes (%v)", pageToken)
-	}
-
 	if firstCheck {
 		Log.Infof("First cache build process started...")
 	}
 
+	// get the last token or build the cache from scratch
+	pageToken, err := d.cache.GetStartPageToken()
+	resync := d.cache.NeedsResync()
+	if nil != err || resync {
+		if err := d.buildCache(client, resync); nil != err {
+			Log.Debugf("%v", err)
+			Log.Warningf("Could not build cache, retrying on next change check")
+			return
+		}
+		if pageToken, err = d.cache.GetStartPageToken(); nil != err {
+			Log.Warningf("%v", err)
+			return
+		}
+	}
+	Log.Debugf("Last change id found, continuing getting changes (%v)", pageToken)
+
+	removedItems := make([]string, 0)
 	deletedItems := 0
 	updatedItems := 0
 	processedItems := 0
@@ -147,6 +200,7 @@ func (d *Client) checkChanges(firstCheck bool) {
 		}
 
 		results, err := query.Do()
+		d.updateOnline(err)
 		if nil != err {
 			Log.Debugf("%v", err)
 			Log.Warningf("Could not get changes")
@@ -154,6 +208,8 @@ func (d *Client) checkChanges(firstCheck bool) {
 		}
 
 		objects := make([]*APIObject, 0)
+		removed := make([]string, 0)
+		pending := d.cache.pendingObjectIDs()
 		for _, change := range results.Changes {
 			Log.Tracef("Change %v", change)
 			// ignore changes for changeType drive
@@ -161,11 +217,18 @@ func (d *Client) checkChanges(firstCheck bool) {
 				Log.Warningf("Ignoring change type %v", change.ChangeType)
 				continue
 			}
+			// the cache has the state after the pending operations, the object
+			// is fetched again once the operations are applied
+			if _, exists := pending[change.FileId]; exists {
+				Log.Debugf("Deferring change of object %v with pending operations", change.FileId)
+				if err := d.cache.deferChange(change.FileId); nil != err {
+					Log.Warningf("%v", err)
+				}
+				continue
+			}
 
 			if change.Removed || (nil != change.File && change.File.ExplicitlyTrashed) {
-				if err := d.cache.DeleteObject(change.FileId); nil != err {
-					Log.Tracef("%v", err)
-				}
+				removed = append(removed, change.FileId)
 				deletedItems++
 			} else {
 				object, err := d.mapFileToObject(change.File)
@@ -180,7 +243,10 @@ func (d *Client) checkChanges(firstCheck bool) {
 
 			processedItems++
 		}
-		if err := d.cache.BatchUpdateObjects(objects); nil != err {
+
+		objects, quarantined, err := d.applyChanges(client, objects, removed)
+		removedItems = append(removedItems, quarantined...)
+		if nil != err {
 			Log.Warningf("%v", err)
 			return
 		}
@@ -209,15 +275,70 @@ func (d *Client) checkChanges(firstCheck bool) {
 		}
 	}
 
+	if d.guard.Enabled() {
+		d.guardRemovals(removedItems)
+	}
+
+	// ids for folders created while offline
+	if d.Online() {
+		if err := d.refillIDPool(client); nil != err {
+			Log.Warningf("%v", err)
+		}
+	}
+
 	if firstCheck {
 		Log.Infof("First cache build process finished!")
 	}
 }
 
+// applyChanges stores the changed objects and deletes the removed objects,
+// it returns the stored objects and the removals that have been quarantined
+// by the deletion guard
+func (d *Client) applyChanges(service *gdrive.Service, objects []*APIObject, removed []string) ([]*APIObject, []string, error) {
+	var movedIn, movedOut []string
+	if d.subtreeOnly {
+		objects, movedIn, movedOut = d.filterSubtree(objects)
+		// objects moved out of the subtree are removed like deleted ones
+		removed = append(removed, movedOut...)
+	} else {
+		movedIn = d.movedIntoSubtree(objects)
+	}
+	var quarantined []string
+	if d.guard.Enabled() {
+		quarantined = d.quarantineRemovals(removed, objects)
+	} else {
+		for _, id := range removed {
+			if d.subtreeOnly {
+				if _, err := d.cache.DeleteSubtree(id); nil != err {
+					Log.Tracef("%v", err)
+				}
+			} else if err := d.cache.DeleteObject(id); nil != err {
+				Log.Tracef("%v", err)
+			}
+		}
+	}
+	if err := d.cache.BatchUpdateObjects(objects); nil != err {
+		return nil, quarantined, err
+	}
+	for _, folderID := range movedIn {
+		skipped, err := d.crawlSubtree(service, folderID, nil)
+		if nil != err {
+			Log.Debugf("%v", err)
+		}
+		if nil != err || len(skipped) > 0 {
+			Log.Warningf("Could not fetch folder %v that was moved into the mounted root, the cache will be resynced on the next start", folderID)
+			if err := d.cache.MarkResync(); nil != err {
+				Log.Warningf("%v", err)
+			}
+		}
+	}
+	return objects, quarantined, nil
+}
+
 func (d *Client) authorize() error {
 	Log.Debugf("Authorizing against Google Drive API")
 
-	token, err := d.cache.LoadToken()
+	token, err := loadToken(d.tokenPath)
 	if nil != err {
 		Log.Debugf("Token could not be found, fetching new one")
 
@@ -226,7 +347,7 @@ func (d *Client) authorize() error {
 			return err
 		}
 		token = t
-		if err := d.cache.StoreToken(token); nil != err {
+		if err := storeToken(d.tokenPath, token); nil != err {
 			return err
 		}
 	}
@@ -266,10 +387,20 @@ func (d *Client) GetNativeClient() *http.Client {
 
 // GetFileById gets a Google Drive file by its id
 func (d *Client) GetFileById(id string) (*gdrive.File, error) {
-	client, err := d.getClient()
+	file, err := d.getFile(id)
 	if nil != err {
 		Log.Debugf("%v", err)
-		return nil, fmt.Errorf("Could not get Google Drive client")
+		return nil, fmt.Errorf("Could not get object %v from API", id)
+	}
+	return file, nil
+}
+
+// getFile gets a Google Drive file by its id and returns the unwrapped error
+// of the API request
+func (d *Client) getFile(id string) (*gdrive.File, error) {
+	client, err := d.getClient()
+	if nil != err {
+		return nil, err
 	}
 
 	file, err := client.Files.
@@ -278,31 +409,53 @@ func (d *Client) GetFileById(id string) (*gdrive.File, error) {
 		SupportsAllDrives(true).
 		Do()
 	if nil != err {
-		Log.Debugf("%v", err)
-		return nil, fmt.Errorf("Could not get object %v from API", id)
+		return nil, err
 	}
 
 	// getting file size
 	if 0 == file.Size && folderMimeType != file.MimeType && shortcutMimeType != file.MimeType {
 		res, err := client.Files.Get(id).SupportsAllDrives(true).Download()
 		if nil != err {
-			Log.Debugf("%v", err)
-			return nil, fmt.Errorf("Could not get file size for object %v", id)
+			return nil, err
 		}
+		res.Body.Close()
 		file.Size = res.ContentLength
 	}
 
 	return file, nil
 }
 
-// GetRoot gets the root node directly from the API
+// FetchObject gets an object by id directly from the API without caching it
+func (d *Client) FetchObject(id string) (*APIObject, error) {
+	file, err := d.GetFileById(id)
+	if nil != err {
+		return nil, err
+	}
+	return d.mapFileToObject(file)
+}
+
+// GetRoot gets the root node directly from the API, if the API is not
+// reachable the root node is taken from the cache
 func (d *Client) GetRoot() (*APIObject, error) {
 	Log.Debugf("Getting root from API")
 
-	file, err := d.GetFileById(d.rootNodeID)
-	if err != nil {
-		return nil, err
+	file, err := d.getFile(d.rootNodeID)
+	if nil != err {
+		// a missing root node or missing permissions must not be hidden
+		if isAuthOrNotFoundError(err) {
+			return nil, err
+		}
+		root, cacheErr := d.getCachedRoot()
+		if nil != cacheErr {
+			Log.Debugf("%v", cacheErr)
+			return nil, err
+		}
+		Log.Warningf("%v", err)
+		Log.Warningf("Could not get root node from API, mounting root node %v from cache", root.ObjectID)
+		d.updateOnline(err)
+		return root, nil
 	}
+	d.updateOnline(nil)
 
 	if file.MimeType != folderMimeType {
 		return nil, fmt.Errorf("Root node %v is not a folder (%v)", file.Id, file.MimeType)
@@ -315,6 +468,9 @@ func (d *Client) GetRoot() (*APIObject, error) {
 	if err := d.cache.UpdateObject(root); nil != err {
 		return root, fmt.Errorf("Failed to cache root node: %v", err)
 	}
+	if err := d.cache.StoreRootID(root.ObjectID); nil != err {
+		return root, err
+	}
 	return root, nil
 }
 
@@ -333,98 +489,88 @@ func (d *Client) GetObjectByParentAndName(parent, name string) (*APIObject, erro
 	return d.cache.GetObjectByParentAndName(parent, name)
 }
 
-// Remove removes file from Google Drive
+// Remove removes file from Google Drive, the object is removed from the cache
+// immediately and from the API by the outbox worker
 func (d *Client) Remove(object *APIObject, parent string) error {
-	client, err := d.getClient()
-	if nil != err {
-		Log.Debugf("%v", err)
-		return fmt.Errorf("Could not get Google Drive client")
-	}
-
-	if err := d.cache.DeleteObject(object.ObjectID); nil != err {
+	op := OutboxOperation{
+		Kind:     OpRemove,
+		ObjectID: object.ObjectID,
+		Parent:   parent,
+		Previous: object,
+		Created:  time.Now(),
+	}
+	if err := d.cache.enqueueOperation(&op, nil); nil != err {
 		Log.Debugf("%v", err)
 		return fmt.Errorf("Could not delete object %v (%v) from cache", object.ObjectID, object.Name)
 	}
-
-	go func() {
-		if object.CanTrash {
-			if _, err := client.Files.Update(object.ObjectID, &gdrive.File{Trashed: true}).SupportsAllDrives(true).Do(); nil != err {
-				Log.Debugf("%v", err)
-				Log.Warningf("Could not delete object %v (%v) from API", object.ObjectID, object.Name)
-				d.cache.UpdateObject(object)
-			}
-		} else {
-			if _, err := client.Files.Update(object.ObjectID, nil).RemoveParents(parent).SupportsAllDrives(true).Do(); nil != err {
-				Log.Debugf("%v", err)
-				Log.Warningf("Could not unsubscribe object %v (%v) from API", object.ObjectID, object.Name)
-				d.cache.UpdateObject(object)
-			}
-		}
-	}()
+	d.notifyOutbox()
 
 	return nil
 }
 
-// Mkdir creates a new directory in Google Drive
+// Mkdir creates a new directory in Google Drive, the id of the directory is
+// taken from the ids generated in advance and the directory is created by the
+// outbox worker, so directories can be created while offline
 func (d *Client) Mkdir(parent string, Name string) (*APIObject, error) {
-	client, err := d.getClient()
+	id, err := d.nextID()
 	if nil != err {
 		Log.Debugf("%v", err)
-		return nil, fmt.Errorf("Could not get Google Drive client")
-	}
-
-	created, err := client.Files.Create(&gdrive.File{Name: Name, Parents: []string{parent}, MimeType: folderMimeType}).SupportsAllDrives(true).Do()
-	if nil != err {
-		Log.Debugf("%v", err)
-		return nil, fmt.Errorf("Could not create object(%v) from API", Name)
-	}
-
-	file, err := client.Files.Get(created.Id).Fields(googleapi.Field(fields)).SupportsAllDrives(true).Do()
-	if nil != err {
-		Log.Debugf("%v", err)
-		return nil, fmt.Errorf("Could not get object fields %v from API", created.Id)
-	}
-
-	Obj, err := d.mapFileToObject(file)
-	if nil != err {
-		Log.Debugf("%v", err)
-		return nil, fmt.Errorf("Could not map file to object %v (%v)", file.Id, file.Name)
-	}
-
-	if err := d.cache.UpdateObject(Obj); nil != err {
+		return nil, fmt.Errorf("Could not generate id for object(%v)", Name)
+	}
+
+	now := time.Now()
+	Obj := &APIObject{
+		ObjectID:     id,
+		Name:         Name,
+		IsDir:        true,
+		LastModified: now,
+		CreatedTime:  now,
+		Parents:      []string{parent},
+		CanTrash:     true,
+	}
+	op := OutboxOperation{
+		Kind:     OpMkdir,
+		ObjectID: Obj.ObjectID,
+		Parent:   parent,
+		Name:     Name,
+		Created:  now,
+	}
+	if err := d.cache.enqueueOperation(&op, Obj); nil != err {
 		Log.Debugf("%v", err)
 		return nil, fmt.Errorf("Could not create object %v (%v) from cache", Obj.ObjectID, Obj.Name)
 	}
+	d.notifyOutbox()
 
 	return Obj, nil
 }
 
-// Rename renames file in Google Drive
+// Rename renames file in Google Drive, the object is renamed in the cache
+// immediately and in the API by the outbox worker
 func (d *Client) Rename(object *APIObject, OldParent string, NewParent string, NewName string) error {
-	client, err := d.getClient()
-	if nil != err {
-		Log.Debugf("%v", err)
-		return fmt.Errorf("Could not get Google Drive client")
-	}
-
-	if _, err := client.Files.Update(object.ObjectID, &gdrive.File{Name: NewName}).RemoveParents(OldParent).AddParents(NewParent).SupportsAllDrives(true).Do(); nil != err {
-		Log.Debugf("%v", err)
-		return fmt.Errorf("Could not rename object %v (%v) from API", object.ObjectID, object.Name)
-	}
-
-	object.Name = NewName
-	for i, p := range object.Parents {
-		if p == OldParent {
-			object.Parents = append(object.Parents[:i], object.Parents[i+1:]...)
-			break
+	renamed := *object
+	renamed.Name = NewName
+	renamed.Parents = make([]string, 0, len(object.Parents))
+	for _, p := range object.Parents {
+		if p != OldParent {
+			renamed.Parents = append(renamed.Parents, p)
 		}
 	}
-	object.Parents = append(object.Parents, NewParent)
+	renamed.Parents = append(renamed.Parents, NewParent)
 
-	if err := d.cache.UpdateObject(object); nil != err {
+	op := OutboxOperation{
+		Kind:      OpRename,
+		ObjectID:  object.ObjectID,
+		Parent:    OldParent,
+		NewParent: NewParent,
+		Name:      NewName,
+		Previous:  object,
+		Created:   time.Now(),
+	}
+	if err := d.cache.enqueueOperation(&op, &renamed); nil != err {
 		Log.Debugf("%v", err)
 		return fmt.Errorf("Could not rename object %v (%v) from cache", object.ObjectID, object.Name)
 	}
+	d.notifyOutbox()
 
 	return nil
 }
@@ -449,11 +595,16 @@ func (d *Client) mapFileToObject(file *gdrive.File) (*APIObject, error) {
 		lastModified = time.Now()
 	}
 
-	var downloadURL string
-	if "" != targetFile.HeadRevisionId {
-		downloadURL = fmt.Sprintf("https://www.googleapis.com/drive/v3/files/%v/revisions/%v?alt=media", targetFile.Id, targetFile.HeadRevisionId)
-	} else {
-		downloadURL = fmt.Sprintf("https://www.googleapis.com/drive/v3/files/%v?alt=media", targetFile.Id)
+	createdTime, cerr := time.Parse(time.RFC3339, targetFile.CreatedTime)
+	if nil != cerr {
+		Log.Debugf("%v", cerr)
+		Log.Warningf("Could not parse creation date for object %v (%v)", file.Id, file.Name)
+		createdTime = lastModified
+	}
+
+	var targetID string
+	if targetFile.Id != file.Id {
+		targetID = targetFile.Id
 	}
 
 	return &APIObject{
@@ -461,11 +612,13 @@ func (d *Client) mapFileToObject(file *gdrive.File) (*APIObject, error) {
 		Name:         file.Name,
 		IsDir:        targetFile.MimeType == folderMimeType,
 		LastModified: lastModified,
+		CreatedTime:  createdTime,
 		Size:         uint64(targetFile.Size),
-		DownloadURL:  downloadURL,
+		DownloadURL:  downloadURL(targetFile.Id, targetFile.HeadRevisionId),
 		Parents:      file.Parents,
 		CanTrash:     file.Capabilities.CanTrash,
 		MD5Checksum:  targetFile.Md5Checksum,
 		RevisionID:   targetFile.HeadRevisionId,
+		TargetID:     targetID,
 	}, err
 }
@@ -0,0 +1,207 @@
+package drive
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// objectEncodingVersion is the first byte of a binary encoded object, JSON
+// encoded objects of older caches always start with '{'
+const objectEncodingVersion = byte(1)
+
+const (
+	flagIsDir = 1 << iota
+	flagCanTrash
+	flagHasTarget
+)
+
+// downloadURL builds the download url of a file revision
+func downloadURL(fileID, revisionID string) string {
+	if "" != revisionID {
+		return fmt.Sprintf("https://www.googleapis.com/drive/v3/files/%v/revisions/%v?alt=media", fileID, revisionID)
+	}
+	return fmt.Sprintf("https://www.googleapis.com/drive/v3/files/%v?alt=media", fileID)
+}
+
+// encodeObject encodes an object in the compact binary format, derived fields
+// like the download url are not stored
+func encodeObject(object *APIObject) []byte {
+	size := 2 + 6*binary.MaxVarintLen64
+	strs := []string{object.ObjectID, object.Name, object.MD5Checksum, object.RevisionID, object.TargetID}
+	strs = append(strs, object.Parents...)
+	for _, s := range strs {
+		size += binary.MaxVarintLen64 + len(s)
+	}
+
+	flags := byte(0)
+	if object.IsDir {
+		flags |= flagIsDir
+	}
+	if object.CanTrash {
+		flags |= flagCanTrash
+	}
+	if "" != object.TargetID {
+		flags |= flagHasTarget
+	}
+
+	buf := make([]byte, 0, size)
+	buf = append(buf, objectEncodingVersion, flags)
+	buf = appendString(buf, object.ObjectID)
+	buf = appendString(buf, object.Name)
+	buf = appendUvarint(buf, object.Size)
+	buf = appendTime(buf, object.LastModified)
+	buf = appendTime(buf, object.CreatedTime)
+	buf = appendString(buf, object.MD5Checksum)
+	buf = appendString(buf, object.RevisionID)
+	if "" != object.TargetID {
+		buf = appendString(buf, object.TargetID)
+	}
+	buf = appendUvarint(buf, uint64(len(object.Parents)))
+	for _, parent := range object.Parents {
+		buf = appendString(buf, parent)
+	}
+	return buf
+}
+
+// decodeObject decodes an object in the binary or the legacy JSON format
+func decodeObject(data []byte) (*APIObject, error) {
+	if len(data) > 0 && '{' == data[0] {
+		return decodeJSONObject(data)
+	}
+	if len(data) < 2 {
+		return nil, fmt.Errorf("Encoded object is truncated")
+	}
+	if objectEncodingVersion != data[0] {
+		return nil, fmt.Errorf("Unknown object encoding version %v", data[0])
+	}
+
+	d := decoder{data: data[2:]}
+	flags := data[1]
+	object := APIObject{
+		IsDir:    0 != flags&flagIsDir,
+		CanTrash: 0 != flags&flagCanTrash,
+	}
+	object.ObjectID = d.string()
+	object.Name = d.string()
+	object.Size = d.uvarint()
+	object.LastModified = d.time()
+	object.CreatedTime = d.time()
+	object.MD5Checksum = d.string()
+	object.RevisionID = d.string()
+	if 0 != flags&flagHasTarget {
+		object.TargetID = d.string()
+	}
+	if parents := d.uvarint(); parents > uint64(len(d.data)) {
+		d.err = fmt.Errorf("Encoded object is truncated")
+	} else if parents > 0 {
+		object.Parents = make([]string, parents)
+		for i := range object.Parents {
+			object.Parents[i] = d.string()
+		}
+	}
+	if nil != d.err {
+		return nil, d.err
+	}
+
+	object.DownloadURL = downloadURL(object.FileID(), object.RevisionID)
+	return &object, nil
+}
+
+// decodeJSONObject decodes an object stored by older cache versions
+func decodeJSONObject(data []byte) (*APIObject, error) {
+	var object APIObject
+	if err := json.Unmarshal(data, &object); nil != err {
+		return nil, err
+	}
+	// the target of a shortcut was only stored in the download url
+	if "" == object.TargetID {
+		url := strings.TrimPrefix(object.DownloadURL, "https://www.googleapis.com/drive/v3/files/")
+		if i := strings.IndexAny(url, "/?"); i > 0 && url[:i] != object.ObjectID {
+			object.TargetID = url[:i]
+		}
+	}
+	return &object, nil
+}
+
+func appendUvarint(buf []byte, v uint64) []byte {
+	var tmp [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(tmp[:], v)
+	return append(buf, tmp[:n]...)
+}
+
+func appendVarint(buf []byte, v int64) []byte {
+	var tmp [binary.MaxVarintLen64]byte
+	n := binary.PutVarint(tmp[:], v)
+	return append(buf, tmp[:n]...)
+}
+
+func appendString(buf []byte, s string) []byte {
+	buf = appendUvarint(buf, uint64(len(s)))
+	return append(buf, s...)
+}
+
+func appendTime(buf []byte, t time.Time) []byte {
+	buf = appendVarint(buf, t.Unix())
+	return appendUvarint(buf, uint64(t.Nanosecond()))
+}
+
+// decoder reads values of the binary object format and keeps the first error
+type decoder struct {
+	data []byte
+	err  error
+}
+
+func (d *decoder) uvarint() uint64 {
+	if nil != d.err {
+		return 0
+	}
+	v, n := binary.Uvarint(d.data)
+	if n <= 0 {
+		d.err = fmt.Errorf("Encoded object is truncated")
+		return 0
+	}
+	d.data = d.data[n:]
+	return v
+}
+
+func (d *decoder) varint() int64 {
+	if nil != d.err {
+		return 0
+	}
+	v, n := binary.Varint(d.data)
+	if n <= 0 {
+		d.err = fmt.Errorf("Encoded object is truncated")
+		return 0
+	}
+	d.data = d.data[n:]
+	return v
+}
+
+func (d *decoder) string() string {
+	l := d.uvarint()
+	if nil != d.err {
+		return ""
+	}
+	if l > uint64(len(d.data)) {
+		d.err = fmt.Errorf("Encoded object is truncated")
+		return ""
+	}
+	s := string(d.data[:l])
+	d.data = d.data[l:]
+	return s
+}
+
+func (d *decoder) time() time.Time {
+	sec := d.varint()
+	nsec := d.uvarint()
+	if nil != d.err {
+		return time.Time{}
+	}
+	if sec == (time.Time{}).Unix() && 0 == nsec {
+		return time.Time{}
+	}
+	return time.Unix(sec, int64(nsec))
+}
@@ -0,0 +1,139 @@
+package drive
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/claudetech/loggo"
+	. "github.com/claudetech/loggo/default"
+)
+
+func testObject() *APIObject {
+	return &APIObject{
+		ObjectID:     "1a2b3c",
+		Name:         "S01E01.mkv",
+		Size:         1234567890,
+		LastModified: time.Unix(1600000000, 123000000),
+		CreatedTime:  time.Unix(1500000000, 0),
+		DownloadURL:  downloadURL("1a2b3c", "rev1"),
+		Parents:      []string{"parent1", "parent2"},
+		CanTrash:     true,
+		MD5Checksum:  "d41d8cd98f00b204e9800998ecf8427e",
+		RevisionID:   "rev1",
+	}
+}
+
+func TestEncodeObject(t *testing.T) {
+	shortcut := testObject()
+	shortcut.TargetID = "target"
+	shortcut.DownloadURL = downloadURL("target", "rev1")
+	folder := &APIObject{ObjectID: "folder", Name: "TV", IsDir: true, DownloadURL: downloadURL("folder", "")}
+
+	for _, expected := range []*APIObject{testObject(), shortcut, folder} {
+		actual, err := decodeObject(encodeObject(expected))
+		if nil != err {
+			t.Fatalf("Could not decode %v: %v", expected.ObjectID, err)
+		}
+		if !actual.LastModified.Equal(expected.LastModified) || !actual.CreatedTime.Equal(expected.CreatedTime) {
+			t.Fatalf("Time mismatch: %v != %v", actual, expected)
+		}
+		actual.LastModified, expected.LastModified = time.Time{}, time.Time{}
+		actual.CreatedTime, expected.CreatedTime = time.Time{}, time.Time{}
+		if !reflect.DeepEqual(actual, expected) {
+			t.Fatalf("Object mismatch: %v != %v", actual, expected)
+		}
+	}
+}
+
+func TestDecodeTruncatedObject(t *testing.T) {
+	data := encodeObject(testObject())
+	for i := 0; i < len(data); i++ {
+		if _, err := decodeObject(data[:i]); nil == err {
+			t.Fatalf("Expected error for object truncated to %v bytes", i)
+		}
+	}
+}
+
+func TestDecodeJSONObject(t *testing.T) {
+	shortcut := testObject()
+	shortcut.DownloadURL = downloadURL("target", "rev1")
+	data, _ := json.Marshal(shortcut)
+
+	object, err := decodeObject(data)
+	if nil != err {
+		t.Fatal(err)
+	}
+	if "target" != object.TargetID {
+		t.Fatalf("Expected target id from download url, got %v", object.TargetID)
+	}
+
+	object, err = decodeObject(encodeObject(object))
+	if nil != err {
+		t.Fatal(err)
+	}
+	if shortcut.DownloadURL != object.DownloadURL {
+		t.Fatalf("Download url mismatch: %v != %v", object.DownloadURL, shortcut.DownloadURL)
+	}
+}
+
+func benchmarkGetObjectsByParent(b *testing.B, encode func(*APIObject) []byte) {
+	Log.SetLevel(loggo.Warning)
+	dir, err := ioutil.TempDir("", "plexdrive")
+	if nil != err {
+		b.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cache, err := NewCache(filepath.Join(dir, "cache.bolt"), dir, "", "", false)
+	if nil != err {
+		b.Fatal(err)
+	}
+	defer cache.Close()
+
+	const children = 10000
+	err = cache.db.Update(func(tx *bolt.Tx) error {
+		ns := cache.namespaceBucket(tx)
+		for i := 0; i < children; i++ {
+			object := testObject()
+			object.ObjectID = fmt.Sprintf("object%v", i)
+			object.Name = fmt.Sprintf("S01E%05d.mkv", i)
+			object.Parents = []string{"parent"}
+			if err := ns.Bucket(bObjects).Put([]byte(object.ObjectID), encode(object)); nil != err {
+				return err
+			}
+			if err := ns.Bucket(bParents).Put([]byte("parent/"+object.Name), []byte(object.ObjectID)); nil != err {
+				return err
+			}
+		}
+		return nil
+	})
+	if nil != err {
+		b.Fatal(err)
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		objects, _ := cache.GetObjectsByParent("parent")
+		if children != len(objects) {
+			b.Fatalf("Expected %v children got %v", children, len(objects))
+		}
+	}
+}
+
+func BenchmarkGetObjectsByParentJSON(b *testing.B) {
+	benchmarkGetObjectsByParent(b, func(object *APIObject) []byte {
+		data, _ := json.Marshal(object)
+		return data
+	})
+}
+
+func BenchmarkGetObjectsByParentBinary(b *testing.B) {
+	benchmarkGetObjectsByParent(b, encodeObject)
+}
@@ -0,0 +1,189 @@
+package drive
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+
+	. "github.com/claudetech/loggo/default"
+
+	"github.com/boltdb/bolt"
+)
+
+// importBatchSize is the number of objects imported in one transaction
+const importBatchSize = 10000
+
+// bImports holds the objects of running imports by namespace
+var bImports = []byte("imports")
+
+// exportHeader is the first line of a cache dump
+type exportHeader struct {
+	Namespace string
+	PageToken string
+	RootID    string
+}
+
+// Export writes the page token and all objects of the namespace as JSON lines
+func (c *Cache) Export(w io.Writer) (int, error) {
+	exported := 0
+	err := c.db.View(func(tx *bolt.Tx) error {
+		ns := c.namespaceBucket(tx)
+		encoder := json.NewEncoder(w)
+		header := exportHeader{
+			Namespace: string(c.namespace),
+			PageToken: string(ns.Bucket(bPageToken).Get([]byte("t"))),
+			RootID:    string(ns.Get(kRootID)),
+		}
+		if err := encoder.Encode(&header); nil != err {
+			return err
+		}
+
+		return ns.Bucket(bObjects).ForEach(func(k, v []byte) error {
+			object, err := decodeObject(v)
+			if nil != err {
+				Log.Warningf("Skipping undecodable object %s: %v", k, err)
+				return nil
+			}
+			exported++
+			return encoder.Encode(object)
+		})
+	})
+	if nil != err {
+		Log.Debugf("%v", err)
+		return exported, fmt.Errorf("Could not export cache namespace %s", c.namespace)
+	}
+
+	return exported, nil
+}
+
+// Import replaces the namespace with the objects and page token of a dump,
+// the objects are read into a temporary bucket that replaces the namespace
+// once the whole dump has been read, so an aborted import keeps the cache
+func (c *Cache) Import(r io.Reader) (int, error) {
+	decoder := json.NewDecoder(bufio.NewReader(r))
+	var header exportHeader
+	if err := decoder.Decode(&header); nil != err {
+		Log.Debugf("%v", err)
+		return 0, fmt.Errorf("Could not read dump header")
+	}
+	if header.Namespace != string(c.namespace) {
+		return 0, fmt.Errorf("Dump of namespace %v can't be imported into namespace %s", header.Namespace, c.namespace)
+	}
+
+	// Prepare the temporary bucket, leftovers of an aborted import are discarded
+	err := c.db.Update(func(tx *bolt.Tx) error {
+		imports, err := tx.CreateBucketIfNotExists(bImports)
+		if nil != err {
+			return err
+		}
+		if nil != imports.Bucket(c.namespace) {
+			if err := imports.DeleteBucket(c.namespace); nil != err {
+				return err
+			}
+		}
+		b, err := imports.CreateBucket(c.namespace)
+		if nil != err {
+			return err
+		}
+		if _, err := b.CreateBucket(bObjects); nil != err {
+			return err
+		}
+		_, err = b.CreateBucket(bParents)
+		return err
+	})
+	if nil != err {
+		Log.Debugf("%v", err)
+		return 0, fmt.Errorf("Could not prepare import of cache namespace %s", c.namespace)
+	}
+	defer c.discardImport()
+
+	imported := 0
+	for done := false; !done; {
+		objects := make([]*APIObject, 0, importBatchSize)
+		for len(objects) < importBatchSize {
+			var object APIObject
+			if err := decoder.Decode(&object); io.EOF == err {
+				done = true
+				break
+			} else if nil != err {
+				Log.Debugf("%v", err)
+				return imported, fmt.Errorf("Could not read object %v of dump", imported+len(objects)+1)
+			}
+			objects = append(objects, &object)
+		}
+		err := c.db.Update(func(tx *bolt.Tx) error {
+			b := tx.Bucket(bImports).Bucket(c.namespace)
+			for _, object := range objects {
+				if err := boltUpdateObject(b, object); nil != err {
+					return err
+				}
+			}
+			return nil
+		})
+		if nil != err {
+			Log.Debugf("%v", err)
+			return imported, fmt.Errorf("Could not import objects")
+		}
+		imported += len(objects)
+		Log.Debugf("Read %v objects", imported)
+	}
+
+	// Replace the namespace with the imported objects
+	err = c.db.Update(func(tx *bolt.Tx) error {
+		ns := c.namespaceBucket(tx)
+		for _, name := range [][]byte{bObjects, bParents, bPageToken, bQuarantine} {
+			if err := ns.DeleteBucket(name); nil != err {
+				return err
+			}
+			if _, err := ns.CreateBucket(name); nil != err {
+				return err
+			}
+		}
+		b := tx.Bucket(bImports).Bucket(c.namespace)
+		for _, name := range [][]byte{bObjects, bParents} {
+			target := ns.Bucket(name)
+			err := b.Bucket(name).ForEach(func(k, v []byte) error {
+				return target.Put(k, v)
+			})
+			if nil != err {
+				return err
+			}
+		}
+		if err := ns.Delete(kResync); nil != err {
+			return err
+		}
+		if err := ns.Delete(kRootID); nil != err {
+			return err
+		}
+		if "" != header.RootID {
+			if err := ns.Put(kRootID, []byte(header.RootID)); nil != err {
+				return err
+			}
+		}
+		if "" != header.PageToken {
+			return ns.Bucket(bPageToken).Put([]byte("t"), []byte(header.PageToken))
+		}
+		return nil
+	})
+	c.paths.clear()
+	if nil != err {
+		Log.Debugf("%v", err)
+		return 0, fmt.Errorf("Could not replace cache namespace %s", c.namespace)
+	}
+	return imported, nil
+}
+
+// discardImport removes the temporary bucket of an import
+func (c *Cache) discardImport() {
+	err := c.db.Update(func(tx *bolt.Tx) error {
+		imports := tx.Bucket(bImports)
+		if nil == imports || nil == imports.Bucket(c.namespace) {
+			return nil
+		}
+		return imports.DeleteBucket(c.namespace)
+	})
+	if nil != err {
+		Log.Warningf("Could not discard import of cache namespace %s: %v", c.namespace, err)
+	}
+}
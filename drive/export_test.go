@@ -0,0 +1,78 @@
+package drive
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestExportImport(t *testing.T) {
+	dir, err := ioutil.TempDir("", "plexdrive")
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	source, err := NewCache(filepath.Join(dir, "source.bolt"), dir, "", "", false)
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer source.Close()
+	source.StoreRootID("root")
+	source.StoreStartPageToken("1234")
+	source.BatchUpdateObjects([]*APIObject{
+		{ObjectID: "root", Name: "My Drive", IsDir: true},
+		{ObjectID: "episode", Name: "S01E01.mkv", Parents: []string{"root"}, Size: 42},
+	})
+
+	var dump bytes.Buffer
+	if exported, err := source.Export(&dump); nil != err || 2 != exported {
+		t.Fatalf("Export failed (%v objects): %v", exported, err)
+	}
+
+	target, err := NewCache(filepath.Join(dir, "target.bolt"), dir, "", "", false)
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer target.Close()
+	target.UpdateObject(&APIObject{ObjectID: "stale", Name: "Stale"})
+
+	// an aborted import keeps the cache
+	broken := append(append([]byte{}, dump.Bytes()...), []byte("{broken")...)
+	if _, err := target.Import(bytes.NewReader(broken)); nil == err {
+		t.Fatalf("Expected import of a broken dump to fail")
+	}
+	if _, err := target.GetObject("stale"); nil != err {
+		t.Fatalf("Expected cache to be kept after an aborted import: %v", err)
+	}
+	if _, err := target.GetObject("episode"); nil == err {
+		t.Fatalf("Expected no objects of an aborted import")
+	}
+
+	if imported, err := target.Import(bytes.NewReader(dump.Bytes())); nil != err || 2 != imported {
+		t.Fatalf("Import failed (%v objects): %v", imported, err)
+	}
+	if token, _ := target.GetStartPageToken(); "1234" != token {
+		t.Fatalf("Expected page token 1234 got %v", token)
+	}
+	if rootID, _ := target.GetRootID(); "root" != rootID {
+		t.Fatalf("Expected root id root got %v", rootID)
+	}
+	if object, err := target.GetObjectByParentAndName("root", "S01E01.mkv"); nil != err || 42 != object.Size {
+		t.Fatalf("Expected imported object, got %v: %v", object, err)
+	}
+	if _, err := target.GetObject("stale"); nil == err {
+		t.Fatalf("Expected stale object to be removed by import")
+	}
+
+	other, err := NewCache(filepath.Join(dir, "other.bolt"), dir, "drive", "", false)
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer other.Close()
+	if _, err := other.Import(bytes.NewReader(dump.Bytes())); nil == err {
+		t.Fatalf("Expected import into another namespace to fail")
+	}
+}
@@ -0,0 +1,193 @@
+package drive
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+
+	. "github.com/claudetech/loggo/default"
+
+	"github.com/boltdb/bolt"
+)
+
+// CheckReport lists all inconsistencies of a cache namespace
+type CheckReport struct {
+	Namespace    string
+	Objects      int
+	IndexEntries int
+	// UndecodableObjects are object ids whose values can't be decoded
+	UndecodableObjects []string
+	// DanglingIndex are index keys pointing to objects that don't exist
+	DanglingIndex []string
+	// MismatchedIndex are index keys whose parent or name doesn't match the object
+	MismatchedIndex []string
+	// MissingIndex are index keys that are missing for an object and its parents
+	MissingIndex []string
+	// OrphanedObjects are object ids without a parent inside the subtree of the
+	// root node, they are only checked for caches of subtree-only mounts
+	OrphanedObjects []string
+	// Repaired is set if all inconsistencies have been repaired
+	Repaired bool
+}
+
+// Inconsistencies returns the total number of inconsistencies found
+func (r *CheckReport) Inconsistencies() int {
+	return len(r.UndecodableObjects) + len(r.DanglingIndex) + len(r.MismatchedIndex) +
+		len(r.MissingIndex) + len(r.OrphanedObjects)
+}
+
+// Check scans the objects and the parent index of the namespace for
+// inconsistencies and optionally repairs them. Objects outside of the root
+// node are only orphaned if the namespace is used by a subtree-only mount,
+// otherwise the changes of the whole drive are cached.
+func (c *Cache) Check(repair, subtreeOnly bool) (*CheckReport, error) {
+	report := CheckReport{
+		Namespace: string(c.namespace),
+	}
+
+	check := func(tx *bolt.Tx) error {
+		ns := c.namespaceBucket(tx)
+		rootID := string(ns.Get(kRootID))
+		if subtreeOnly && "" == rootID {
+			Log.Warningf("Root node of namespace %s is unknown, skipping orphaned object check", c.namespace)
+		}
+
+		// Check all objects and their index entries
+		objects := make(map[string]*APIObject)
+		err := ns.Bucket(bObjects).ForEach(func(k, v []byte) error {
+			report.Objects++
+			object, err := decodeObject(v)
+			if nil != err {
+				Log.Debugf("%v", err)
+				report.UndecodableObjects = append(report.UndecodableObjects, string(k))
+				return nil
+			}
+			objects[string(k)] = object
+			for _, parent := range object.Parents {
+				key := parent + "/" + object.Name
+				if nil == ns.Bucket(bParents).Get([]byte(key)) {
+					report.MissingIndex = append(report.MissingIndex, key)
+				}
+			}
+			return nil
+		})
+		if nil != err {
+			return err
+		}
+
+		if subtreeOnly && "" != rootID {
+			report.OrphanedObjects = findOrphans(objects, rootID)
+		}
+
+		// Check all index entries
+		err = ns.Bucket(bParents).ForEach(func(k, v []byte) error {
+			report.IndexEntries++
+			object, exists := objects[string(v)]
+			if !exists {
+				report.DanglingIndex = append(report.DanglingIndex, string(k))
+				return nil
+			}
+			i := bytes.IndexByte(k, '/')
+			if i < 0 || string(k[i+1:]) != object.Name || !contains(object.Parents, string(k[:i])) {
+				report.MismatchedIndex = append(report.MismatchedIndex, string(k))
+			}
+			return nil
+		})
+		if nil != err || !repair {
+			return err
+		}
+
+		// Repair all inconsistencies
+		b := ns.Bucket(bObjects)
+		for _, id := range report.UndecodableObjects {
+			if err := b.Delete([]byte(id)); nil != err {
+				return err
+			}
+		}
+		b = ns.Bucket(bParents)
+		for _, key := range append(report.DanglingIndex, report.MismatchedIndex...) {
+			if err := b.Delete([]byte(key)); nil != err {
+				return err
+			}
+		}
+		for _, id := range report.OrphanedObjects {
+			if _, err := boltDeleteSubtree(ns, id); nil != err {
+				return err
+			}
+		}
+		// Recreate index entries of all remaining objects, this includes the
+		// entries of objects whose key was used by a mismatched entry
+		for id, object := range objects {
+			if remaining, _ := boltGetObject(ns, id); nil == remaining {
+				continue
+			}
+			for _, parent := range object.Parents {
+				key := []byte(parent + "/" + object.Name)
+				if nil != b.Get(key) {
+					continue
+				}
+				if err := b.Put(key, []byte(id)); nil != err {
+					return err
+				}
+			}
+		}
+		report.Repaired = true
+		return nil
+	}
+
+	var err error
+	if repair {
+		err = c.db.Update(check)
+		c.paths.clear()
+	} else {
+		err = c.db.View(check)
+	}
+	if nil != err {
+		Log.Debugf("%v", err)
+		return nil, fmt.Errorf("Could not check cache namespace %s", c.namespace)
+	}
+
+	return &report, nil
+}
+
+// findOrphans returns the ids of all objects that can't be reached from the
+// root node, because none of their parents is inside the subtree of the root
+func findOrphans(objects map[string]*APIObject, rootID string) []string {
+	children := make(map[string][]string)
+	for id, object := range objects {
+		for _, parent := range object.Parents {
+			children[parent] = append(children[parent], id)
+		}
+	}
+
+	reachable := map[string]struct{}{rootID: {}}
+	pending := []string{rootID}
+	for len(pending) > 0 {
+		id := pending[len(pending)-1]
+		pending = pending[:len(pending)-1]
+		for _, child := range children[id] {
+			if _, exists := reachable[child]; !exists {
+				reachable[child] = struct{}{}
+				pending = append(pending, child)
+			}
+		}
+	}
+
+	orphans := make([]string, 0)
+	for id := range objects {
+		if _, exists := reachable[id]; !exists {
+			orphans = append(orphans, id)
+		}
+	}
+	sort.Strings(orphans)
+	return orphans
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,91 @@
+package drive
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/boltdb/bolt"
+)
+
+func TestCheckAndRepair(t *testing.T) {
+	dir, err := ioutil.TempDir("", "plexdrive")
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cache, err := NewCache(filepath.Join(dir, "cache.bolt"), dir, "", "", false)
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer func() {
+		cache.Close()
+	}()
+
+	cache.StoreRootID("root")
+	cache.BatchUpdateObjects([]*APIObject{
+		{ObjectID: "root", Name: "My Drive"},
+		{ObjectID: "tv", Name: "TV", IsDir: true, Parents: []string{"root"}},
+		{ObjectID: "episode", Name: "S01E01.mkv", Parents: []string{"tv"}},
+		{ObjectID: "orphan", Name: "Lost", IsDir: true, Parents: []string{"missing"}},
+		{ObjectID: "orphan-child", Name: "Child", Parents: []string{"orphan"}},
+		{ObjectID: "outside", Name: "Outside", IsDir: true, Parents: []string{"outside-parent"}},
+		{ObjectID: "outside-parent", Name: "Parent", IsDir: true, Parents: []string{"outside"}},
+	})
+	cache.db.Update(func(tx *bolt.Tx) error {
+		b := cache.namespaceBucket(tx).Bucket(bParents)
+		b.Put([]byte("tv/deleted.mkv"), []byte("deleted"))
+		b.Put([]byte("tv/renamed.mkv"), []byte("episode"))
+		b.Delete([]byte("root/TV"))
+		return nil
+	})
+
+	// objects outside of the root node are expected without subtree-only mode
+	report, err := cache.Check(false, false)
+	if nil != err || 0 != len(report.OrphanedObjects) || 3 != report.Inconsistencies() {
+		t.Fatalf("Unexpected report without subtree-only mode %+v: %v", report, err)
+	}
+
+	report, err = cache.Check(false, true)
+	if nil != err {
+		t.Fatal(err)
+	}
+	if 1 != len(report.DanglingIndex) || 1 != len(report.MismatchedIndex) ||
+		1 != len(report.MissingIndex) || 4 != len(report.OrphanedObjects) {
+		t.Fatalf("Unexpected report %+v", report)
+	}
+	if report.Repaired {
+		t.Fatalf("Expected report without repair")
+	}
+
+	// a check without repair opens the cache read-only
+	cache.Close()
+	readOnly, err := NewReadOnlyCache(filepath.Join(dir, "cache.bolt"), "", "")
+	if nil != err {
+		t.Fatal(err)
+	}
+	if report, err := readOnly.Check(false, true); nil != err || 4 != len(report.OrphanedObjects) {
+		t.Fatalf("Unexpected read-only report %+v: %v", report, err)
+	}
+	readOnly.Close()
+	if cache, err = NewCache(filepath.Join(dir, "cache.bolt"), dir, "", "", false); nil != err {
+		t.Fatal(err)
+	}
+
+	if report, err = cache.Check(true, true); nil != err || !report.Repaired {
+		t.Fatalf("Repair failed: %v", err)
+	}
+	if report, err = cache.Check(false, true); nil != err || 0 != report.Inconsistencies() {
+		t.Fatalf("Expected no inconsistencies after repair %+v", report)
+	}
+	for _, id := range []string{"orphan-child", "outside", "outside-parent"} {
+		if _, err := cache.GetObject(id); nil == err {
+			t.Fatalf("Expected object %v outside of the root node to be removed", id)
+		}
+	}
+	if object, err := cache.GetObjectByParentAndName("root", "TV"); nil != err || "tv" != object.ObjectID {
+		t.Fatalf("Expected missing index entry to be restored")
+	}
+}
@@ -0,0 +1,72 @@
+package drive
+
+import (
+	"time"
+
+	. "github.com/claudetech/loggo/default"
+)
+
+// quarantineRemovals holds the removals of a change page in quarantine and
+// releases the removals of objects that have been restored since
+func (d *Client) quarantineRemovals(removed []string, updated []*APIObject) []string {
+	if len(updated) > 0 {
+		restored := make(map[string]struct{}, len(updated))
+		for _, object := range updated {
+			restored[object.ObjectID] = struct{}{}
+		}
+		released, err := d.cache.ReleaseQuarantine(func(record *QuarantinedObject) bool {
+			_, exists := restored[record.ObjectID]
+			return exists
+		})
+		if nil != err {
+			Log.Warningf("%v", err)
+		} else if released > 0 {
+			Log.Infof("Released %v restored objects from quarantine", released)
+		}
+	}
+
+	if 0 == len(removed) {
+		return nil
+	}
+	quarantined, err := d.cache.QuarantineObjects(removed, time.Now(), d.subtreeOnly)
+	if nil != err {
+		Log.Warningf("%v", err)
+		return nil
+	}
+	return quarantined
+}
+
+// guardRemovals holds the removals of a change check if they exceed the limits
+// of the deletion guard and applies all removals whose grace period passed
+func (d *Client) guardRemovals(removed []string) {
+	hold := false
+	if d.guard.MaxObjects > 0 && len(removed) > d.guard.MaxObjects {
+		Log.Warningf("Change check removed %v objects, more than the limit of %v", len(removed), d.guard.MaxObjects)
+		hold = true
+	}
+	if d.guard.MaxFolderPercent > 0 && len(removed) > 0 {
+		for folder, share := range d.cache.getRemovalShares(removed) {
+			if share > d.guard.MaxFolderPercent {
+				Log.Warningf("Change check removed %.0f%% of folder %v, more than the limit of %.0f%%", share, folder, d.guard.MaxFolderPercent)
+				hold = true
+			}
+		}
+	}
+	if hold {
+		if err := d.cache.HoldQuarantine(removed); nil != err {
+			Log.Warningf("%v", err)
+		} else {
+			Log.Warningf("Holding %v removals in quarantine, run plexdrive quarantine confirm to apply them", len(removed))
+		}
+	}
+
+	deadline := time.Now().Add(-d.guard.GracePeriod)
+	deleted, err := d.cache.ApplyQuarantine(func(record *QuarantinedObject) bool {
+		return !record.Held && !record.Removed.After(deadline)
+	})
+	if nil != err {
+		Log.Warningf("%v", err)
+	} else if deleted > 0 {
+		Log.Infof("Deleted %v objects after the grace period", deleted)
+	}
+}
@@ -0,0 +1,100 @@
+package drive
+
+import (
+	"fmt"
+
+	. "github.com/claudetech/loggo/default"
+	gdrive "google.golang.org/api/drive/v3"
+
+	"github.com/boltdb/bolt"
+)
+
+var bIDPool = []byte("id_pool")
+
+// idPoolSize is the number of object ids generated in advance, so that
+// folders can be created while the API is not reachable
+const idPoolSize = 50
+
+// takeID removes a generated object id from the pool, the id is empty if the
+// pool is empty
+func (c *Cache) takeID() (string, error) {
+	id := ""
+	err := c.db.Update(func(tx *bolt.Tx) error {
+		cursor := c.namespaceBucket(tx).Bucket(bIDPool).Cursor()
+		k, _ := cursor.First()
+		if nil == k {
+			return nil
+		}
+		id = string(k)
+		return cursor.Delete()
+	})
+	if nil != err {
+		Log.Debugf("%v", err)
+		return "", fmt.Errorf("Could not take object id from cache")
+	}
+	return id, nil
+}
+
+// storeIDs adds generated object ids to the pool
+func (c *Cache) storeIDs(ids []string) error {
+	err := c.db.Update(func(tx *bolt.Tx) error {
+		b := c.namespaceBucket(tx).Bucket(bIDPool)
+		for _, id := range ids {
+			if err := b.Put([]byte(id), []byte{}); nil != err {
+				return err
+			}
+		}
+		return nil
+	})
+	if nil != err {
+		Log.Debugf("%v", err)
+		return fmt.Errorf("Could not store object ids in cache")
+	}
+	return nil
+}
+
+// countIDs gets the number of object ids in the pool
+func (c *Cache) countIDs() int {
+	count := 0
+	c.db.View(func(tx *bolt.Tx) error {
+		count = c.namespaceBucket(tx).Bucket(bIDPool).Stats().KeyN
+		return nil
+	})
+	return count
+}
+
+// refillIDPool generates object ids once less than half of the pool is left
+func (d *Client) refillIDPool(client *gdrive.Service) error {
+	missing := idPoolSize - d.cache.countIDs()
+	if missing < idPoolSize/2 {
+		return nil
+	}
+	ids, err := client.Files.GenerateIds().Count(int64(missing)).Space("drive").Do()
+	d.updateOnline(err)
+	if nil != err {
+		Log.Debugf("%v", err)
+		return fmt.Errorf("Could not generate object ids from API")
+	}
+	return d.cache.storeIDs(ids.Ids)
+}
+
+// nextID takes an object id from the pool, the pool is only refilled right
+// away if it is empty
+func (d *Client) nextID() (string, error) {
+	id, err := d.cache.takeID()
+	if nil != err || "" != id {
+		return id, err
+	}
+	client, err := d.getClient()
+	if nil != err {
+		Log.Debugf("%v", err)
+		return "", fmt.Errorf("Could not get Google Drive client")
+	}
+	if err := d.refillIDPool(client); nil != err {
+		return "", err
+	}
+	if id, err = d.cache.takeID(); nil == err && "" == id {
+		return "", fmt.Errorf("Could not generate object id from API")
+	}
+	return id, err
+}
@@ -0,0 +1,284 @@
+package drive
+
+import (
+	"encoding/binary"
+	"fmt"
+
+	. "github.com/claudetech/loggo/default"
+
+	"github.com/boltdb/bolt"
+)
+
+var (
+	bMeta          = []byte("meta")
+	kSchemaVersion = []byte("schema_version")
+	kResync        = []byte("resync")
+)
+
+// migration upgrades the cache file to the next schema version
+type migration struct {
+	// description is logged when the migration is applied
+	description string
+	// resync marks all existing namespaces for a full resync with the API,
+	// for changes to objects that can't be derived from the cached data
+	resync bool
+	// apply runs the migration inside of the upgrade transaction
+	apply func(tx *bolt.Tx) error
+}
+
+// migrations are all schema upgrades, the schema version is the number of
+// applied migrations, so new migrations must only be appended
+var migrations = []migration{
+	{
+		description: "move cache buckets without namespace into the default namespace",
+		apply: func(tx *bolt.Tx) error {
+			// Caches without namespaces could have been used with any drive
+			// and root node, so the objects are moved into the namespace of
+			// My Drive and checked by a resync, the page token is dropped
+			if nil != tx.Bucket(bPageToken) {
+				if err := tx.DeleteBucket(bPageToken); nil != err {
+					return err
+				}
+			}
+			var ns *bolt.Bucket
+			for _, name := range [][]byte{bObjects, bParents} {
+				legacy := tx.Bucket(name)
+				if nil == legacy {
+					continue
+				}
+				if nil == ns {
+					namespaces, err := tx.CreateBucketIfNotExists(bNamespaces)
+					if nil != err {
+						return err
+					}
+					if ns, err = namespaces.CreateBucketIfNotExists([]byte(Namespace("", ""))); nil != err {
+						return err
+					}
+				}
+				if nil != ns.Bucket(name) {
+					if err := ns.DeleteBucket(name); nil != err {
+						return err
+					}
+				}
+				b, err := ns.CreateBucket(name)
+				if nil != err {
+					return err
+				}
+				if err := legacy.ForEach(func(k, v []byte) error {
+					return b.Put(k, v)
+				}); nil != err {
+					return err
+				}
+				if err := tx.DeleteBucket(name); nil != err {
+					return err
+				}
+			}
+			if nil == ns {
+				return nil
+			}
+			return ns.Put(kResync, []byte{1})
+		},
+	},
+	{
+		// the creation time of objects cached before can only be fetched
+		// from the API
+		description: "store creation time of objects",
+		resync:      true,
+	},
+	{
+		description: "encode objects in the compact binary format",
+		apply: func(tx *bolt.Tx) error {
+			return forEachNamespace(tx, func(name []byte, ns *bolt.Bucket) error {
+				return reencodeObjects(ns)
+			})
+		},
+	},
+}
+
+// schemaVersion is the current version of the cache file schema
+var schemaVersion = uint32(len(migrations))
+
+// migrate upgrades the cache file to the current schema version
+func migrate(db *bolt.DB) error {
+	return db.Update(func(tx *bolt.Tx) error {
+		meta, err := tx.CreateBucketIfNotExists(bMeta)
+		if nil != err {
+			return err
+		}
+
+		version := uint32(0)
+		if v := meta.Get(kSchemaVersion); nil != v {
+			version = binary.BigEndian.Uint32(v)
+		} else if isEmptyCache(tx) {
+			// a fresh cache file is created with the current schema
+			version = schemaVersion
+		}
+
+		if version > schemaVersion {
+			return fmt.Errorf("Cache schema version %v is newer than the supported version %v", version, schemaVersion)
+		}
+
+		resync := false
+		for ; version < schemaVersion; version++ {
+			m := migrations[version]
+			Log.Infof("Migrating cache schema to version %v: %v", version+1, m.description)
+			if nil != m.apply {
+				if err := m.apply(tx); nil != err {
+					return fmt.Errorf("Could not migrate cache schema to version %v: %v", version+1, err)
+				}
+			}
+			resync = resync || m.resync
+		}
+
+		if resync {
+			if err := markResync(tx); nil != err {
+				return err
+			}
+		}
+
+		v := make([]byte, 4)
+		binary.BigEndian.PutUint32(v, version)
+		return meta.Put(kSchemaVersion, v)
+	})
+}
+
+// isEmptyCache checks if the cache file has no data besides the meta bucket
+func isEmptyCache(tx *bolt.Tx) bool {
+	empty := true
+	tx.ForEach(func(name []byte, _ *bolt.Bucket) error {
+		if string(name) != string(bMeta) {
+			empty = false
+		}
+		return nil
+	})
+	return empty
+}
+
+// forEachNamespace calls fn for the bucket of every existing namespace
+func forEachNamespace(tx *bolt.Tx, fn func(name []byte, ns *bolt.Bucket) error) error {
+	namespaces := tx.Bucket(bNamespaces)
+	if nil == namespaces {
+		return nil
+	}
+	return namespaces.ForEach(func(name, v []byte) error {
+		// only sub buckets are namespaces
+		if nil != v {
+			return nil
+		}
+		return fn(name, namespaces.Bucket(name))
+	})
+}
+
+// markResync flags all existing namespaces for a full resync
+func markResync(tx *bolt.Tx) error {
+	return forEachNamespace(tx, func(name []byte, ns *bolt.Bucket) error {
+		Log.Infof("Cache namespace %s needs a resync", name)
+		return ns.Put(kResync, []byte{1})
+	})
+}
+
+// reencodeObjects stores all objects of the namespace in the current encoding,
+// values are written in batches because the cursor must not be used while
+// the bucket is modified. Undecodable objects are dropped together with
+// their index entries.
+func reencodeObjects(ns *bolt.Bucket) error {
+	b := ns.Bucket(bObjects)
+	if nil == b {
+		return nil
+	}
+	const batchSize = 10000
+	dropped := make(map[string]struct{})
+	var last []byte
+	for {
+		keys := make([][]byte, 0, batchSize)
+		values := make([][]byte, 0, batchSize)
+		cr := b.Cursor()
+		k, v := cr.First()
+		if nil != last {
+			k, v = cr.Seek(last)
+			if nil != k && string(k) == string(last) {
+				k, v = cr.Next()
+			}
+		}
+		for ; nil != k && len(keys) < batchSize; k, v = cr.Next() {
+			object, err := decodeObject(v)
+			if nil != err {
+				Log.Warningf("Dropping undecodable object %s: %v", k, err)
+				values = append(values, nil)
+				dropped[string(k)] = struct{}{}
+			} else {
+				values = append(values, encodeObject(object))
+			}
+			keys = append(keys, append([]byte{}, k...))
+		}
+		if 0 == len(keys) {
+			break
+		}
+		for i, key := range keys {
+			var err error
+			if nil == values[i] {
+				err = b.Delete(key)
+			} else {
+				err = b.Put(key, values[i])
+			}
+			if nil != err {
+				return err
+			}
+		}
+		last = keys[len(keys)-1]
+	}
+
+	// The name and parents of dropped objects are unknown, so their index
+	// entries are found by the object id
+	index := ns.Bucket(bParents)
+	if 0 == len(dropped) || nil == index {
+		return nil
+	}
+	stale := make([][]byte, 0)
+	index.ForEach(func(k, v []byte) error {
+		if _, exists := dropped[string(v)]; exists {
+			stale = append(stale, append([]byte{}, k...))
+		}
+		return nil
+	})
+	for _, key := range stale {
+		if err := index.Delete(key); nil != err {
+			return err
+		}
+	}
+	return nil
+}
+
+// NeedsResync checks if the namespace must be rebuilt from the API
+func (c *Cache) NeedsResync() bool {
+	resync := false
+	c.db.View(func(tx *bolt.Tx) error {
+		resync = nil != c.namespaceBucket(tx).Get(kResync)
+		return nil
+	})
+	return resync
+}
+
+// MarkResync flags the namespace for a full resync on the next start
+func (c *Cache) MarkResync() error {
+	err := c.db.Update(func(tx *bolt.Tx) error {
+		return c.namespaceBucket(tx).Put(kResync, []byte{1})
+	})
+	if nil != err {
+		Log.Debugf("%v", err)
+		return fmt.Errorf("Could not mark cache namespace %s for resync", c.namespace)
+	}
+	return nil
+}
+
+// ClearResync removes the resync flag after the namespace has been rebuilt
+func (c *Cache) ClearResync() error {
+	err := c.db.Update(func(tx *bolt.Tx) error {
+		return c.namespaceBucket(tx).Delete(kResync)
+	})
+	if nil != err {
+		Log.Debugf("%v", err)
+		return fmt.Errorf("Could not clear resync flag of cache namespace %s", c.namespace)
+	}
+	return nil
+}
@@ -0,0 +1,169 @@
+package drive
+
+import (
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+// writeBaselineCache creates a cache file in the format before namespaces
+// and migrations, objects were stored as JSON
+func writeBaselineCache(t *testing.T, path string) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: time.Second})
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		objects, err := tx.CreateBucket(bObjects)
+		if nil != err {
+			return err
+		}
+		objects.Put([]byte("root"), []byte(`{"ObjectID":"root","Name":"My Drive","IsDir":true,"Parents":[]}`))
+		objects.Put([]byte("movie"), []byte(`{"ObjectID":"movie","Name":"Movie.mkv","Size":42,"Parents":["root"]}`))
+		objects.Put([]byte("broken"), []byte(`{"ObjectID":"broken","Name":`))
+
+		parents, err := tx.CreateBucket(bParents)
+		if nil != err {
+			return err
+		}
+		parents.Put([]byte("root/Movie.mkv"), []byte("movie"))
+		parents.Put([]byte("root/Broken.mkv"), []byte("broken"))
+
+		token, err := tx.CreateBucket(bPageToken)
+		if nil != err {
+			return err
+		}
+		return token.Put([]byte("t"), []byte("1234"))
+	})
+	if nil != err {
+		t.Fatal(err)
+	}
+}
+
+func TestMigrateBaselineCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "plexdrive")
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "cache.bolt")
+	writeBaselineCache(t, path)
+
+	cache, err := NewCache(path, dir, "", "", false)
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer cache.Close()
+
+	// the objects are kept in the namespace of My Drive until they are
+	// checked by a resync, the page token of an unknown drive is dropped
+	if object, err := cache.GetObjectByParentAndName("root", "Movie.mkv"); nil != err || 42 != object.Size {
+		t.Fatalf("Expected migrated object, got %v: %v", object, err)
+	}
+	if token, err := cache.GetStartPageToken(); nil == err {
+		t.Fatalf("Expected the page token to be dropped got %v", token)
+	}
+	if !cache.NeedsResync() {
+		t.Fatal("Expected the migrated cache to be resynced")
+	}
+	err = cache.db.View(func(tx *bolt.Tx) error {
+		// objects are stored in the binary encoding
+		ns := cache.namespaceBucket(tx)
+		if v := ns.Bucket(bObjects).Get([]byte("movie")); '{' == v[0] {
+			t.Errorf("Expected object to be reencoded, got %s", v)
+		}
+		// undecodable objects are dropped with their index entries
+		if nil != ns.Bucket(bObjects).Get([]byte("broken")) || nil != ns.Bucket(bParents).Get([]byte("root/Broken.mkv")) {
+			t.Error("Expected undecodable object and its index entry to be dropped")
+		}
+		for _, name := range [][]byte{bObjects, bParents, bPageToken} {
+			if nil != tx.Bucket(name) {
+				t.Errorf("Expected bucket %s without namespace to be removed", name)
+			}
+		}
+		return nil
+	})
+	if nil != err {
+		t.Fatal(err)
+	}
+}
+
+func TestMigrations(t *testing.T) {
+	dir, err := ioutil.TempDir("", "plexdrive")
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for i, m := range migrations {
+		if "" == m.description {
+			t.Errorf("Expected a description of migration %v", i+1)
+		}
+	}
+
+	// a new cache file is created with the current schema
+	path := filepath.Join(dir, "cache.bolt")
+	cache, err := NewCache(path, dir, "", "", false)
+	if nil != err {
+		t.Fatal(err)
+	}
+	version := func() uint32 {
+		v := uint32(0)
+		cache.db.View(func(tx *bolt.Tx) error {
+			v = binary.BigEndian.Uint32(tx.Bucket(bMeta).Get(kSchemaVersion))
+			return nil
+		})
+		return v
+	}
+	if schemaVersion != version() || cache.NeedsResync() {
+		t.Fatalf("Expected schema version %v without resync got %v", schemaVersion, version())
+	}
+
+	setVersion := func(version uint32) {
+		v := make([]byte, 4)
+		binary.BigEndian.PutUint32(v, version)
+		cache.db.Update(func(tx *bolt.Tx) error {
+			return tx.Bucket(bMeta).Put(kSchemaVersion, v)
+		})
+		cache.Close()
+	}
+
+	// the creation time of objects needs a resync of all namespaces
+	cache.StoreStartPageToken("1234")
+	cache.BatchUpdateObjects([]*APIObject{{ObjectID: "movie", Name: "Movie.mkv", Parents: []string{"movies"}}})
+	setVersion(1)
+	if cache, err = NewCache(path, dir, "", "", false); nil != err {
+		t.Fatal(err)
+	}
+	if schemaVersion != version() || !cache.NeedsResync() {
+		t.Fatalf("Expected schema version %v with resync got %v", schemaVersion, version())
+	}
+	if _, err := cache.GetObject("movie"); nil != err {
+		t.Fatalf("Expected object to be kept until the resync: %v", err)
+	}
+
+	// the next start crawls the namespace again
+	folderRetryDelay = 0
+	newCrawlTestClient(t, cache, map[string]int{}).checkChanges(true)
+	if object, err := cache.GetObject("movie"); nil != err || object.CreatedTime.IsZero() {
+		t.Fatalf("Expected object with creation time after the resync got %v: %v", object, err)
+	}
+	if token, _ := cache.GetStartPageToken(); "42" != token || cache.NeedsResync() {
+		t.Fatalf("Expected page token 42 without resync got %v", token)
+	}
+
+	// cache files of a newer plexdrive are refused
+	setVersion(schemaVersion + 1)
+	if cache, err = NewCache(path, dir, "", "", false); nil == err {
+		cache.Close()
+		t.Fatal("Expected a newer schema version to be refused")
+	}
+}
@@ -0,0 +1,83 @@
+package drive
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"sync/atomic"
+	"time"
+
+	. "github.com/claudetech/loggo/default"
+	"golang.org/x/oauth2"
+	"google.golang.org/api/googleapi"
+)
+
+// reconnectInterval is the time to wait till checking if the API is reachable again
+const reconnectInterval = 10 * time.Second
+
+// Online checks if the Google Drive API was reachable on the last request,
+// objects and chunks are served from cache only while the client is offline
+func (d *Client) Online() bool {
+	return 0 == atomic.LoadInt32(&d.offline)
+}
+
+// updateOnline tracks the API connection state based on the result of an API
+// request, only errors that didn't come from the API switch to offline mode
+func (d *Client) updateOnline(err error) {
+	if nil != err {
+		if !isTransportError(err) {
+			return
+		}
+		if atomic.CompareAndSwapInt32(&d.offline, 0, 1) {
+			Log.Warningf("Google Drive API is not reachable, serving from cache until it is reachable again")
+		}
+		return
+	}
+	if atomic.CompareAndSwapInt32(&d.offline, 1, 0) {
+		Log.Infof("Google Drive API is reachable again")
+	}
+}
+
+// isTransportError checks if an API request failed because the network is
+// down and not because of an answer of the API or of the token endpoint
+func isTransportError(err error) bool {
+	switch e := err.(type) {
+	case *googleapi.Error:
+		return false
+	case *url.Error:
+		if _, isTokenError := e.Err.(*oauth2.RetrieveError); isTokenError {
+			return false
+		}
+	}
+	return true
+}
+
+// isAuthOrNotFoundError checks if the API rejected a request because of the
+// credentials or the permissions or because the object doesn't exist
+func isAuthOrNotFoundError(err error) bool {
+	switch e := err.(type) {
+	case *googleapi.Error:
+		return http.StatusUnauthorized == e.Code || http.StatusForbidden == e.Code || http.StatusNotFound == e.Code
+	case *url.Error:
+		_, isTokenError := e.Err.(*oauth2.RetrieveError)
+		return isTokenError
+	}
+	return false
+}
+
+// getCachedRoot gets the root node from the cache if the API is not reachable
+func (d *Client) getCachedRoot() (*APIObject, error) {
+	id, err := d.cache.GetRootID()
+	if nil != err {
+		return nil, err
+	}
+	root, err := d.cache.GetObject(id)
+	if nil != err {
+		return nil, fmt.Errorf("Could not find root node %v in cache", id)
+	}
+
+	d.lock.Lock()
+	d.rootID = root.ObjectID
+	d.lock.Unlock()
+	return root, nil
+}
@@ -0,0 +1,159 @@
+package drive
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/plexdrive/plexdrive/config"
+	"golang.org/x/oauth2"
+)
+
+// apiTransport answers the API requests of a test client
+type apiTransport func(req *http.Request) (*http.Response, error)
+
+func (t apiTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	return t(req)
+}
+
+// newTestClient creates a client that sends its API requests to the transport
+func newTestClient(cache *Cache, transport apiTransport) *Client {
+	ctx := context.WithValue(context.Background(), oauth2.HTTPClient, &http.Client{Transport: transport})
+	return &Client{
+		cache:        cache,
+		context:      ctx,
+		config:       newOAuthConfig(&config.Config{}),
+		token:        &oauth2.Token{AccessToken: "test", Expiry: time.Now().Add(time.Hour)},
+		rootNodeID:   "root",
+		outboxNotify: make(chan struct{}, 1),
+	}
+}
+
+// jsonResponse builds an API response with a JSON body
+func jsonResponse(req *http.Request, code int, body string) *http.Response {
+	return &http.Response{
+		StatusCode: code,
+		Header:     http.Header{"Content-Type": []string{"application/json"}},
+		Body:       ioutil.NopCloser(strings.NewReader(body)),
+		Request:    req,
+	}
+}
+
+func TestOfflineRoot(t *testing.T) {
+	dir, err := ioutil.TempDir("", "plexdrive")
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cache, err := NewCache(filepath.Join(dir, "cache.bolt"), dir, "", "", false)
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer cache.Close()
+	cache.StoreRootID("cached-root")
+	cache.UpdateObject(&APIObject{ObjectID: "cached-root", Name: "My Drive", IsDir: true})
+
+	var response func(req *http.Request) (*http.Response, error)
+	client := newTestClient(cache, func(req *http.Request) (*http.Response, error) {
+		return response(req)
+	})
+
+	// a missing root node is no connection problem
+	response = func(req *http.Request) (*http.Response, error) {
+		return jsonResponse(req, 404, `{"error": {"code": 404, "message": "File not found"}}`), nil
+	}
+	if _, err := client.GetRoot(); nil == err {
+		t.Fatal("Expected an error for a missing root node")
+	}
+	if !client.Online() {
+		t.Fatal("Expected the client to stay online")
+	}
+
+	// the root node is served from cache while the network is down
+	response = func(req *http.Request) (*http.Response, error) {
+		return nil, errors.New("network is unreachable")
+	}
+	root, err := client.GetRoot()
+	if nil != err || "cached-root" != root.ObjectID {
+		t.Fatalf("Expected the cached root node got %v: %v", root, err)
+	}
+	if client.Online() {
+		t.Fatal("Expected the client to be offline")
+	}
+	if reconnectInterval != client.nextCheckInterval(time.Hour) {
+		t.Fatal("Expected the reconnect interval while offline")
+	}
+
+	// the client reconnects on the next successful request
+	response = func(req *http.Request) (*http.Response, error) {
+		return jsonResponse(req, 200, `{"id": "root", "name": "My Drive", "mimeType": "`+folderMimeType+`", "modifiedTime": "2020-01-01T00:00:00Z", "capabilities": {"canTrash": true}}`), nil
+	}
+	if root, err = client.GetRoot(); nil != err || "root" != root.ObjectID {
+		t.Fatalf("Expected the root node of the API got %v: %v", root, err)
+	}
+	if !client.Online() {
+		t.Fatal("Expected the client to be online again")
+	}
+	if time.Hour != client.nextCheckInterval(time.Hour) {
+		t.Fatal("Expected the refresh interval while online")
+	}
+}
+
+func TestOfflineMkdir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "plexdrive")
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cache, err := NewCache(filepath.Join(dir, "cache.bolt"), dir, "", "", false)
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer cache.Close()
+
+	var response func(req *http.Request) (*http.Response, error)
+	client := newTestClient(cache, func(req *http.Request) (*http.Response, error) {
+		return response(req)
+	})
+
+	// ids are generated while online
+	response = func(req *http.Request) (*http.Response, error) {
+		if !strings.HasSuffix(req.URL.Path, "/files/generateIds") || fmt.Sprintf("%v", idPoolSize) != req.URL.Query().Get("count") {
+			t.Fatalf("Unexpected API request %v", req.URL)
+		}
+		return jsonResponse(req, 200, `{"ids": ["id1", "id2"]}`), nil
+	}
+	service, err := client.getClient()
+	if nil != err {
+		t.Fatal(err)
+	}
+	if err := client.refillIDPool(service); nil != err || 2 != cache.countIDs() {
+		t.Fatalf("Expected 2 generated ids got %v: %v", cache.countIDs(), err)
+	}
+
+	// folders are created with the generated ids while the network is down
+	response = func(req *http.Request) (*http.Response, error) {
+		return nil, errors.New("network is unreachable")
+	}
+	for _, id := range []string{"id1", "id2"} {
+		folder, err := client.Mkdir("root", "New "+id)
+		if nil != err || id != folder.ObjectID {
+			t.Fatalf("Expected folder with id %v got %v: %v", id, folder, err)
+		}
+	}
+	if ops, _ := cache.GetPendingOperations(); 2 != len(ops) || OpMkdir != ops[0].Kind {
+		t.Fatalf("Expected 2 pending mkdir operations got %+v", ops)
+	}
+	if _, err := client.Mkdir("root", "New"); nil == err {
+		t.Fatal("Expected an error without generated ids while offline")
+	}
+}
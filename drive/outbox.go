@@ -0,0 +1,449 @@
+package drive
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	. "github.com/claudetech/loggo/default"
+	gdrive "google.golang.org/api/drive/v3"
+	"google.golang.org/api/googleapi"
+
+	"github.com/boltdb/bolt"
+)
+
+var (
+	bOutbox   = []byte("outbox")
+	bDeferred = []byte("outbox_deferred")
+)
+
+// maxOutboxDelay is the maximum time to wait before retrying a failed operation
+const maxOutboxDelay = 5 * time.Minute
+
+// Kinds of outbox operations
+const (
+	OpRemove = "remove"
+	OpRename = "rename"
+	OpMkdir  = "mkdir"
+)
+
+// OutboxOperation is a mutation of Google Drive, it is applied to the cache
+// immediately and to the API by the outbox worker in order
+type OutboxOperation struct {
+	Seq      uint64
+	Kind     string
+	ObjectID string
+	// Parent is the folder the object is removed from, moved from or created in
+	Parent string
+	// NewParent is the folder the object is moved to
+	NewParent string
+	// Name is the new name of the object
+	Name string
+	// Previous is the cached object before the operation, it is restored if
+	// the operation is rejected by the API
+	Previous *APIObject
+	Attempts int
+	Created  time.Time
+}
+
+// enqueueOperation stores an operation in the outbox and applies it to the
+// cache in the same transaction
+func (c *Cache) enqueueOperation(op *OutboxOperation, updated *APIObject) error {
+	err := c.db.Update(func(tx *bolt.Tx) error {
+		ns := c.namespaceBucket(tx)
+		if OpRemove == op.Kind {
+			if cached, _ := boltGetObject(ns, op.ObjectID); nil != cached {
+				if err := boltDeleteObject(ns, cached); nil != err {
+					return err
+				}
+			}
+		} else if err := boltUpdateObject(ns, updated); nil != err {
+			return err
+		}
+
+		b := ns.Bucket(bOutbox)
+		seq, err := b.NextSequence()
+		if nil != err {
+			return err
+		}
+		op.Seq = seq
+		return boltStoreOperation(b, op)
+	})
+	c.paths.invalidate(op.ObjectID)
+	if nil != err {
+		Log.Debugf("%v", err)
+		return fmt.Errorf("Could not store %v of object %v in outbox", op.Kind, op.ObjectID)
+	}
+	return nil
+}
+
+// GetPendingOperations returns all operations of the outbox in order
+func (c *Cache) GetPendingOperations() ([]*OutboxOperation, error) {
+	ops := make([]*OutboxOperation, 0)
+	err := c.db.View(func(tx *bolt.Tx) error {
+		b := c.namespaceBucket(tx).Bucket(bOutbox)
+		if nil == b {
+			return nil
+		}
+		return b.ForEach(func(k, v []byte) error {
+			var op OutboxOperation
+			if err := json.Unmarshal(v, &op); nil != err {
+				return err
+			}
+			ops = append(ops, &op)
+			return nil
+		})
+	})
+	if nil != err {
+		Log.Debugf("%v", err)
+		return nil, fmt.Errorf("Could not read outbox")
+	}
+	return ops, nil
+}
+
+// nextOperation returns the oldest operation of the outbox
+func (c *Cache) nextOperation() (op *OutboxOperation, err error) {
+	err = c.db.View(func(tx *bolt.Tx) error {
+		_, v := c.namespaceBucket(tx).Bucket(bOutbox).Cursor().First()
+		if nil == v {
+			return nil
+		}
+		op = &OutboxOperation{}
+		return json.Unmarshal(v, op)
+	})
+	return op, err
+}
+
+// updateOperation stores the retry state of an operation
+func (c *Cache) updateOperation(op *OutboxOperation) error {
+	return c.db.Update(func(tx *bolt.Tx) error {
+		return boltStoreOperation(c.namespaceBucket(tx).Bucket(bOutbox), op)
+	})
+}
+
+// completeOperation removes an applied operation from the outbox and stores
+// the object returned by the API, unless later operations on the object are
+// pending
+func (c *Cache) completeOperation(op *OutboxOperation, result *APIObject) error {
+	err := c.db.Update(func(tx *bolt.Tx) error {
+		ns := c.namespaceBucket(tx)
+		b := ns.Bucket(bOutbox)
+		if err := b.Delete(seqKey(op.Seq)); nil != err {
+			return err
+		}
+		if nil == result {
+			return nil
+		}
+		later, err := boltLaterOperations(b, op)
+		if nil != err || len(later) > 0 {
+			return err
+		}
+		return boltUpdateObject(ns, result)
+	})
+	c.paths.invalidate(op.ObjectID)
+	return err
+}
+
+// rejectOperation removes an operation that was rejected by the API from the
+// outbox and reverts its changes of the cache. Later operations on the object
+// are rebased onto the state before the rejected operation, operations on a
+// folder that couldn't be created are rejected as well.
+func (c *Cache) rejectOperation(op *OutboxOperation) error {
+	err := c.db.Update(func(tx *bolt.Tx) error {
+		ns := c.namespaceBucket(tx)
+		b := ns.Bucket(bOutbox)
+		if err := b.Delete(seqKey(op.Seq)); nil != err {
+			return err
+		}
+		later, err := boltLaterOperations(b, op)
+		if nil != err {
+			return err
+		}
+
+		if OpMkdir == op.Kind {
+			for _, next := range later {
+				if err := b.Delete(seqKey(next.Seq)); nil != err {
+					return err
+				}
+			}
+			_, err := boltDeleteSubtree(ns, op.ObjectID)
+			return err
+		}
+
+		if 0 == len(later) {
+			return boltUpdateObject(ns, op.Previous)
+		}
+		// the cache has the state after the later operations
+		next := later[0]
+		next.Previous = op.Previous
+		if OpRename == op.Kind && next.Parent == op.NewParent {
+			next.Parent = op.Parent
+		}
+		return boltStoreOperation(b, next)
+	})
+	c.paths.invalidate(op.ObjectID)
+	return err
+}
+
+// boltLaterOperations returns the queued operations on the object of an
+// operation that follow it
+func boltLaterOperations(b *bolt.Bucket, op *OutboxOperation) ([]*OutboxOperation, error) {
+	later := make([]*OutboxOperation, 0)
+	cr := b.Cursor()
+	for k, v := cr.Seek(seqKey(op.Seq + 1)); nil != k; k, v = cr.Next() {
+		var next OutboxOperation
+		if err := json.Unmarshal(v, &next); nil != err {
+			return nil, err
+		}
+		if next.ObjectID == op.ObjectID {
+			later = append(later, &next)
+		}
+	}
+	return later, nil
+}
+
+// deferChange remembers an object whose change has been ignored because of
+// pending operations, it is fetched again once the outbox is drained
+func (c *Cache) deferChange(id string) error {
+	err := c.db.Update(func(tx *bolt.Tx) error {
+		return c.namespaceBucket(tx).Bucket(bDeferred).Put([]byte(id), []byte{1})
+	})
+	if nil != err {
+		Log.Debugf("%v", err)
+		return fmt.Errorf("Could not defer change of object %v", id)
+	}
+	return nil
+}
+
+// getDeferredChanges returns the ids of all objects with deferred changes
+func (c *Cache) getDeferredChanges() ([]string, error) {
+	ids := make([]string, 0)
+	err := c.db.View(func(tx *bolt.Tx) error {
+		return c.namespaceBucket(tx).Bucket(bDeferred).ForEach(func(k, v []byte) error {
+			ids = append(ids, string(k))
+			return nil
+		})
+	})
+	if nil != err {
+		Log.Debugf("%v", err)
+		return nil, fmt.Errorf("Could not read deferred changes")
+	}
+	return ids, nil
+}
+
+// clearDeferredChanges removes the deferred changes that have been fetched
+func (c *Cache) clearDeferredChanges(ids []string) error {
+	err := c.db.Update(func(tx *bolt.Tx) error {
+		b := c.namespaceBucket(tx).Bucket(bDeferred)
+		for _, id := range ids {
+			if err := b.Delete([]byte(id)); nil != err {
+				return err
+			}
+		}
+		return nil
+	})
+	if nil != err {
+		Log.Debugf("%v", err)
+		return fmt.Errorf("Could not clear deferred changes")
+	}
+	return nil
+}
+
+// pendingObjectIDs returns the ids of all objects with pending operations
+func (c *Cache) pendingObjectIDs() map[string]struct{} {
+	ids := make(map[string]struct{})
+	ops, err := c.GetPendingOperations()
+	if nil != err {
+		Log.Warningf("%v", err)
+		return ids
+	}
+	for _, op := range ops {
+		ids[op.ObjectID] = struct{}{}
+	}
+	return ids
+}
+
+func boltStoreOperation(b *bolt.Bucket, op *OutboxOperation) error {
+	v, err := json.Marshal(op)
+	if nil != err {
+		return err
+	}
+	return b.Put(seqKey(op.Seq), v)
+}
+
+func seqKey(seq uint64) []byte {
+	k := make([]byte, 8)
+	binary.BigEndian.PutUint64(k, seq)
+	return k
+}
+
+// notifyOutbox wakes up the outbox worker
+func (d *Client) notifyOutbox() {
+	select {
+	case d.outboxNotify <- struct{}{}:
+	default:
+	}
+}
+
+// processOutbox applies the operations of the outbox in order, operations
+// are retried until they are applied or rejected by the API
+func (d *Client) processOutbox() {
+	for {
+		op, err := d.cache.nextOperation()
+		if nil != err {
+			Log.Debugf("%v", err)
+			Log.Warningf("Could not read outbox")
+		}
+		if nil == op {
+			d.replayDeferredChanges()
+			select {
+			case <-d.outboxNotify:
+			case <-time.After(reconnectInterval):
+			}
+			continue
+		}
+
+		result, err := d.applyOperation(op)
+		if nil == err {
+			if err := d.cache.completeOperation(op, result); nil != err {
+				Log.Debugf("%v", err)
+				Log.Warningf("Could not complete %v of object %v", op.Kind, op.ObjectID)
+			}
+			Log.Debugf("Applied %v of object %v", op.Kind, op.ObjectID)
+			continue
+		}
+
+		if _, isAPIError := err.(*googleapi.Error); isAPIError && !isRetryableError(err) {
+			Log.Debugf("%v", err)
+			Log.Warningf("Google Drive rejected %v of object %v, reverting it", op.Kind, op.ObjectID)
+			if err := d.cache.rejectOperation(op); nil != err {
+				Log.Debugf("%v", err)
+				Log.Warningf("Could not revert %v of object %v", op.Kind, op.ObjectID)
+			}
+			continue
+		}
+
+		op.Attempts++
+		if err := d.cache.updateOperation(op); nil != err {
+			Log.Debugf("%v", err)
+		}
+		delay := maxOutboxDelay
+		if op.Attempts < 16 {
+			delay = time.Duration(1<<uint(op.Attempts)) * time.Second
+		}
+		if delay > maxOutboxDelay {
+			delay = maxOutboxDelay
+		}
+		Log.Debugf("%v", err)
+		Log.Warningf("Could not apply %v of object %v, retrying in %v", op.Kind, op.ObjectID, delay)
+		time.Sleep(delay)
+	}
+}
+
+// applyOperation applies an operation to the API
+func (d *Client) applyOperation(op *OutboxOperation) (*APIObject, error) {
+	client, err := d.getClient()
+	if nil != err {
+		return nil, err
+	}
+
+	switch op.Kind {
+	case OpRemove:
+		if op.Previous.CanTrash {
+			_, err = client.Files.Update(op.ObjectID, &gdrive.File{Trashed: true}).SupportsAllDrives(true).Do()
+		} else {
+			_, err = client.Files.Update(op.ObjectID, nil).RemoveParents(op.Parent).SupportsAllDrives(true).Do()
+		}
+		d.updateOnline(err)
+		if apiErr, ok := err.(*googleapi.Error); ok && http.StatusNotFound == apiErr.Code {
+			// the object has already been removed
+			return nil, nil
+		}
+		return nil, err
+	case OpRename:
+		file, err := client.Files.Update(op.ObjectID, &gdrive.File{Name: op.Name}).
+			RemoveParents(op.Parent).
+			AddParents(op.NewParent).
+			Fields(googleapi.Field(fields)).
+			SupportsAllDrives(true).
+			Do()
+		d.updateOnline(err)
+		if nil != err {
+			return nil, err
+		}
+		return d.mapFileToObject(file)
+	case OpMkdir:
+		file, err := client.Files.Create(&gdrive.File{Id: op.ObjectID, Name: op.Name, Parents: []string{op.Parent}, MimeType: folderMimeType}).
+			Fields(googleapi.Field(fields)).
+			SupportsAllDrives(true).
+			Do()
+		d.updateOnline(err)
+		if apiErr, ok := err.(*googleapi.Error); ok && http.StatusConflict == apiErr.Code {
+			// the folder has been created by an earlier attempt
+			return nil, nil
+		}
+		if nil != err {
+			return nil, err
+		}
+		return d.mapFileToObject(file)
+	}
+
+	Log.Warningf("Dropping unknown outbox operation %v of object %v", op.Kind, op.ObjectID)
+	return nil, nil
+}
+
+// replayDeferredChanges fetches the objects whose changes have been ignored
+// while they had pending operations
+func (d *Client) replayDeferredChanges() {
+	ids, err := d.cache.getDeferredChanges()
+	if nil != err {
+		Log.Warningf("%v", err)
+		return
+	}
+	if 0 == len(ids) {
+		return
+	}
+	client, err := d.getClient()
+	if nil != err {
+		Log.Debugf("%v", err)
+		return
+	}
+
+	objects := make([]*APIObject, 0, len(ids))
+	removed := make([]string, 0)
+	fetched := make([]string, 0, len(ids))
+	for _, id := range ids {
+		file, err := d.getFile(id)
+		if apiErr, ok := err.(*googleapi.Error); ok && http.StatusNotFound == apiErr.Code {
+			removed = append(removed, id)
+		} else if nil != err {
+			d.updateOnline(err)
+			Log.Debugf("%v", err)
+			Log.Warningf("Could not fetch deferred change of object %v, retrying later", id)
+			continue
+		} else if file.ExplicitlyTrashed {
+			removed = append(removed, id)
+		} else if object, err := d.mapFileToObject(file); nil != err {
+			Log.Debugf("%v", err)
+			Log.Warningf("Could not map Google Drive file %v (%v) to object", file.Id, file.Name)
+		} else {
+			objects = append(objects, object)
+		}
+		fetched = append(fetched, id)
+	}
+
+	_, quarantined, err := d.applyChanges(client, objects, removed)
+	if nil != err {
+		Log.Warningf("%v", err)
+		return
+	}
+	if d.guard.Enabled() {
+		d.guardRemovals(quarantined)
+	}
+	if err := d.cache.clearDeferredChanges(fetched); nil != err {
+		Log.Warningf("%v", err)
+	}
+	Log.Debugf("Replayed %v deferred changes", len(fetched))
+}
@@ -0,0 +1,204 @@
+package drive
+
+import (
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"testing"
+)
+
+func TestOutbox(t *testing.T) {
+	dir, err := ioutil.TempDir("", "plexdrive")
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cacheFile := filepath.Join(dir, "cache.bolt")
+	cache, err := NewCache(cacheFile, dir, "", "", false)
+	if nil != err {
+		t.Fatal(err)
+	}
+
+	episode := &APIObject{ObjectID: "episode", Name: "S01E01.mkv", Parents: []string{"tv"}, CanTrash: true}
+	cache.BatchUpdateObjects([]*APIObject{
+		{ObjectID: "tv", Name: "TV", IsDir: true, Parents: []string{"root"}},
+		{ObjectID: "movies", Name: "Movies", IsDir: true, Parents: []string{"root"}},
+		episode,
+	})
+	client := &Client{cache: cache, outboxNotify: make(chan struct{}, 1)}
+
+	if err := client.Rename(episode, "tv", "movies", "Movie.mkv"); nil != err {
+		t.Fatal(err)
+	}
+	if _, err := cache.GetObjectByParentAndName("movies", "Movie.mkv"); nil != err {
+		t.Fatalf("Expected renamed object in cache: %v", err)
+	}
+	if "S01E01.mkv" != episode.Name {
+		t.Fatalf("Expected the object of the caller to be unchanged")
+	}
+
+	// pending operations are replayed after a restart
+	cache.Close()
+	if cache, err = NewCache(cacheFile, dir, "", "", false); nil != err {
+		t.Fatal(err)
+	}
+	defer cache.Close()
+	client.cache = cache
+
+	op, err := cache.nextOperation()
+	if nil != err || nil == op || OpRename != op.Kind || "movies" != op.NewParent {
+		t.Fatalf("Unexpected operation %+v: %v", op, err)
+	}
+	if _, exists := cache.pendingObjectIDs()["episode"]; !exists {
+		t.Fatalf("Expected object to have pending operations")
+	}
+
+	// a rejected operation is reverted
+	if err := cache.rejectOperation(op); nil != err {
+		t.Fatal(err)
+	}
+	if _, err := cache.GetObjectByParentAndName("tv", "S01E01.mkv"); nil != err {
+		t.Fatalf("Expected rename to be reverted: %v", err)
+	}
+	if _, err := cache.GetObjectByParentAndName("movies", "Movie.mkv"); nil == err {
+		t.Fatalf("Expected renamed index entry to be removed")
+	}
+
+	if err := client.Remove(episode, "tv"); nil != err {
+		t.Fatal(err)
+	}
+	if _, err := cache.GetObject("episode"); nil == err {
+		t.Fatalf("Expected removed object to be deleted from cache")
+	}
+	op, _ = cache.nextOperation()
+	if err := cache.completeOperation(op, nil); nil != err {
+		t.Fatal(err)
+	}
+	if ops, _ := cache.GetPendingOperations(); 0 != len(ops) {
+		t.Fatalf("Expected empty outbox %+v", ops)
+	}
+}
+
+func TestOutboxRejectDependent(t *testing.T) {
+	dir, err := ioutil.TempDir("", "plexdrive")
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cache, err := NewCache(filepath.Join(dir, "cache.bolt"), dir, "", "", false)
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer cache.Close()
+
+	episode := &APIObject{ObjectID: "episode", Name: "S01E01.mkv", Parents: []string{"tv"}}
+	cache.BatchUpdateObjects([]*APIObject{
+		{ObjectID: "tv", Name: "TV", IsDir: true, Parents: []string{"root"}},
+		{ObjectID: "movies", Name: "Movies", IsDir: true, Parents: []string{"root"}},
+		episode,
+	})
+	client := &Client{cache: cache, outboxNotify: make(chan struct{}, 1)}
+
+	// a rejected rename followed by a remove keeps the object removed
+	client.Rename(episode, "tv", "movies", "Movie.mkv")
+	renamed, _ := cache.GetObject("episode")
+	client.Remove(renamed, "movies")
+	op, _ := cache.nextOperation()
+	if err := cache.rejectOperation(op); nil != err {
+		t.Fatal(err)
+	}
+	if _, err := cache.GetObject("episode"); nil == err {
+		t.Fatal("Expected the removed object to stay removed")
+	}
+	op, _ = cache.nextOperation()
+	if nil == op || OpRemove != op.Kind || "tv" != op.Parent || "S01E01.mkv" != op.Previous.Name {
+		t.Fatalf("Expected the remove to be rebased got %+v", op)
+	}
+	cache.completeOperation(op, nil)
+
+	// operations on a folder that couldn't be created are rejected as well
+	folder := &APIObject{ObjectID: "new", Name: "New", IsDir: true, Parents: []string{"root"}}
+	cache.enqueueOperation(&OutboxOperation{Kind: OpMkdir, ObjectID: "new", Parent: "root", Name: "New"}, folder)
+	client.Rename(folder, "root", "tv", "New")
+	op, _ = cache.nextOperation()
+	if err := cache.rejectOperation(op); nil != err {
+		t.Fatal(err)
+	}
+	if ops, _ := cache.GetPendingOperations(); 0 != len(ops) {
+		t.Fatalf("Expected the dependent operations to be rejected got %+v", ops)
+	}
+	if _, err := cache.GetObject("new"); nil == err {
+		t.Fatal("Expected the rejected folder to be removed")
+	}
+}
+
+func TestOutboxApply(t *testing.T) {
+	dir, err := ioutil.TempDir("", "plexdrive")
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cache, err := NewCache(filepath.Join(dir, "cache.bolt"), dir, "", "", false)
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer cache.Close()
+
+	episode := &APIObject{ObjectID: "episode", Name: "S01E01.mkv", Parents: []string{"tv"}, CanTrash: true}
+	cache.BatchUpdateObjects([]*APIObject{
+		{ObjectID: "tv", Name: "TV", IsDir: true, Parents: []string{"root"}},
+		{ObjectID: "movies", Name: "Movies", IsDir: true, Parents: []string{"root"}},
+		episode,
+	})
+
+	files := map[string]string{
+		"episode": `{"id": "episode", "name": "Movie.mkv", "mimeType": "video/x-matroska", "size": "100", "headRevisionId": "2", "modifiedTime": "2020-01-01T00:00:00Z", "parents": ["movies"], "capabilities": {"canTrash": true}}`,
+	}
+	client := newTestClient(cache, func(req *http.Request) (*http.Response, error) {
+		id := path.Base(req.URL.Path)
+		if file, exists := files[id]; exists {
+			return jsonResponse(req, 200, file), nil
+		}
+		return jsonResponse(req, 404, `{"error": {"code": 404, "message": "File not found"}}`), nil
+	})
+
+	// a rename stores the state of the API
+	client.Rename(episode, "tv", "movies", "Movie.mkv")
+	op, _ := cache.nextOperation()
+	result, err := client.applyOperation(op)
+	if nil != err || nil == result || "2" != result.RevisionID {
+		t.Fatalf("Expected the renamed object of the API got %+v: %v", result, err)
+	}
+	cache.completeOperation(op, result)
+	if object, _ := cache.GetObject("episode"); nil == object || "2" != object.RevisionID {
+		t.Fatalf("Expected the object of the API in cache got %+v", object)
+	}
+
+	// the remove of an object that doesn't exist anymore succeeds
+	removed := &APIObject{ObjectID: "gone", Name: "gone.mkv", Parents: []string{"tv"}, CanTrash: true}
+	op = &OutboxOperation{Kind: OpRemove, ObjectID: "gone", Parent: "tv", Previous: removed}
+	if _, err := client.applyOperation(op); nil != err {
+		t.Fatalf("Expected the remove of a missing object to succeed: %v", err)
+	}
+
+	// deferred changes are fetched again once the outbox is drained
+	cache.BatchUpdateObjects([]*APIObject{removed})
+	cache.deferChange("episode")
+	cache.deferChange("gone")
+	files["episode"] = `{"id": "episode", "name": "Movie.mkv", "mimeType": "video/x-matroska", "size": "100", "headRevisionId": "3", "modifiedTime": "2020-01-01T00:00:00Z", "parents": ["movies"], "capabilities": {"canTrash": true}}`
+	client.replayDeferredChanges()
+	if object, _ := cache.GetObject("episode"); nil == object || "3" != object.RevisionID {
+		t.Fatalf("Expected the deferred change to be applied got %+v", object)
+	}
+	if _, err := cache.GetObject("gone"); nil == err {
+		t.Fatal("Expected the deferred removal to be applied")
+	}
+	if ids, _ := cache.getDeferredChanges(); 0 != len(ids) {
+		t.Fatalf("Expected no deferred changes got %v", ids)
+	}
+}
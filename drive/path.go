@@ -0,0 +1,249 @@
+package drive
+
+import (
+	"fmt"
+	"path"
+	"strings"
+	"sync"
+
+	. "github.com/claudetech/loggo/default"
+
+	"github.com/boltdb/bolt"
+)
+
+// maxPathDepth limits the number of ancestors resolved for a path to
+// protect against cycles in the parent relationships
+const maxPathDepth = 1000
+
+// maxMemoizedPaths is the number of paths kept before the memo is reset
+const maxMemoizedPaths = 100000
+
+// pathEntry is a memoized mount path of an object
+type pathEntry struct {
+	path      string
+	ancestors []string
+}
+
+// pathMemo memoizes the mount paths of objects, entries are invalidated
+// after the object or one of its ancestors has been renamed, moved or deleted
+type pathMemo struct {
+	lock       sync.Mutex
+	paths      map[string]*pathEntry
+	ids        map[string]string
+	dependents map[string]map[string]struct{}
+	// generation is increased on every invalidation, paths resolved from
+	// an older generation may be outdated and are not memoized
+	generation uint64
+}
+
+func newPathMemo() *pathMemo {
+	m := pathMemo{}
+	m.reset()
+	return &m
+}
+
+// clear removes all memoized paths
+func (m *pathMemo) clear() {
+	m.lock.Lock()
+	m.reset()
+	m.generation++
+	m.lock.Unlock()
+}
+
+// reset removes all memoized paths without locking
+func (m *pathMemo) reset() {
+	m.paths = make(map[string]*pathEntry)
+	m.ids = make(map[string]string)
+	m.dependents = make(map[string]map[string]struct{})
+}
+
+// get returns the memoized path of an object
+func (m *pathMemo) get(id string) *pathEntry {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.paths[id]
+}
+
+// getID returns the memoized object id of a path
+func (m *pathMemo) getID(p string) (string, bool) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	id, exists := m.ids[p]
+	return id, exists
+}
+
+// currentGeneration returns the generation before resolving a path
+func (m *pathMemo) currentGeneration() uint64 {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.generation
+}
+
+// put memoizes the path of an object resolved in the given generation
+func (m *pathMemo) put(id string, entry *pathEntry, generation uint64) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if generation != m.generation {
+		return
+	}
+	if len(m.paths) >= maxMemoizedPaths {
+		m.reset()
+	}
+	if prev, exists := m.paths[id]; exists {
+		delete(m.ids, prev.path)
+	}
+	m.paths[id] = entry
+	m.ids[entry.path] = id
+	for _, ancestor := range append(entry.ancestors, id) {
+		dependents, exists := m.dependents[ancestor]
+		if !exists {
+			dependents = make(map[string]struct{})
+			m.dependents[ancestor] = dependents
+		}
+		dependents[id] = struct{}{}
+	}
+}
+
+// tracks checks if a change of the object affects any memoized path
+func (m *pathMemo) tracks(id string) bool {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	_, exists := m.dependents[id]
+	return exists
+}
+
+// invalidate removes the memoized paths of the objects and all their
+// descendants, it must be called after every committed update or deletion so
+// that paths resolved concurrently from the previous state aren't memoized
+func (m *pathMemo) invalidate(ids ...string) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	for _, id := range ids {
+		for dependent := range m.dependents[id] {
+			if entry, exists := m.paths[dependent]; exists {
+				delete(m.ids, entry.path)
+				delete(m.paths, dependent)
+			}
+		}
+		delete(m.dependents, id)
+	}
+	m.generation++
+}
+
+// isMoved checks if an object that is about to be updated changes its name
+// or parents and affects memoized paths, those paths must be invalidated
+// after the update has been committed
+func (m *pathMemo) isMoved(ns *bolt.Bucket, object *APIObject) bool {
+	if !m.tracks(object.ObjectID) {
+		return false
+	}
+	prev, _ := boltGetObject(ns, object.ObjectID)
+	return nil == prev || prev.Name != object.Name || strings.Join(prev.Parents, "/") != strings.Join(object.Parents, "/")
+}
+
+// GetPath resolves the mount path of an object by id
+func (c *Cache) GetPath(id string) (string, error) {
+	rootID, err := c.GetRootID()
+	if nil != err {
+		return "", err
+	}
+
+	var entry *pathEntry
+	generation := c.paths.currentGeneration()
+	err = c.db.View(func(tx *bolt.Tx) (err error) {
+		entry, err = c.resolvePath(c.namespaceBucket(tx), generation, rootID, id, 0)
+		return err
+	})
+	if nil != err {
+		return "", err
+	}
+
+	Log.Tracef("Resolved object %v to path %v", id, entry.path)
+	return entry.path, nil
+}
+
+// resolvePath builds the path of an object from the memoized paths of its ancestors
+func (c *Cache) resolvePath(ns *bolt.Bucket, generation uint64, rootID, id string, depth int) (*pathEntry, error) {
+	if entry := c.paths.get(id); nil != entry {
+		return entry, nil
+	}
+	if id == rootID {
+		entry := &pathEntry{path: "/"}
+		c.paths.put(id, entry, generation)
+		return entry, nil
+	}
+	if depth > maxPathDepth {
+		return nil, fmt.Errorf("Could not resolve path of object %v, too many ancestors", id)
+	}
+
+	object, err := boltGetObject(ns, id)
+	if nil != err {
+		return nil, err
+	}
+
+	// prefer the first parent that is cached
+	var parent *pathEntry
+	var parentID string
+	for _, p := range object.Parents {
+		if parent, err = c.resolvePath(ns, generation, rootID, p, depth+1); nil == err {
+			parentID = p
+			break
+		}
+	}
+	if nil == parent {
+		return nil, fmt.Errorf("Object %v (%v) is not below the root node", id, object.Name)
+	}
+
+	entry := &pathEntry{
+		path:      path.Join(parent.path, object.Name),
+		ancestors: append(append(make([]string, 0, len(parent.ancestors)+1), parent.ancestors...), parentID),
+	}
+	c.paths.put(id, entry, generation)
+	return entry, nil
+}
+
+// GetObjectByPath resolves an object by its mount path
+func (c *Cache) GetObjectByPath(p string) (*APIObject, error) {
+	p = path.Clean("/" + p)
+	if id, exists := c.paths.getID(p); exists {
+		if object, err := c.GetObject(id); nil == err {
+			return object, nil
+		}
+	}
+
+	rootID, err := c.GetRootID()
+	if nil != err {
+		return nil, err
+	}
+
+	var object *APIObject
+	generation := c.paths.currentGeneration()
+	err = c.db.View(func(tx *bolt.Tx) error {
+		ns := c.namespaceBucket(tx)
+		id := rootID
+		ancestors := make([]string, 0)
+		for _, name := range strings.Split(strings.Trim(p, "/"), "/") {
+			if "" == name {
+				continue
+			}
+			v := ns.Bucket(bParents).Get([]byte(id + "/" + name))
+			if nil == v {
+				return fmt.Errorf("Could not find %v in %v", name, p)
+			}
+			ancestors = append(ancestors, id)
+			id = string(v)
+		}
+
+		var err error
+		if object, err = boltGetObject(ns, id); nil == err {
+			c.paths.put(id, &pathEntry{path: p, ancestors: ancestors}, generation)
+		}
+		return err
+	})
+	if nil != err {
+		return nil, err
+	}
+
+	Log.Tracef("Resolved path %v to object %v", p, object.ObjectID)
+	return object, nil
+}
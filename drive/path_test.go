@@ -0,0 +1,87 @@
+package drive
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestResolvePaths(t *testing.T) {
+	dir, err := ioutil.TempDir("", "plexdrive")
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cache, err := NewCache(filepath.Join(dir, "cache.bolt"), dir, "", "", false)
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer cache.Close()
+
+	cache.StoreRootID("root")
+	cache.BatchUpdateObjects([]*APIObject{
+		{ObjectID: "root", Name: "My Drive", IsDir: true},
+		{ObjectID: "tv", Name: "TV", IsDir: true, Parents: []string{"root"}},
+		{ObjectID: "show", Name: "Show", IsDir: true, Parents: []string{"tv"}},
+		{ObjectID: "episode", Name: "S01E01.mkv", Parents: []string{"show"}},
+	})
+
+	if p, err := cache.GetPath("episode"); nil != err || "/TV/Show/S01E01.mkv" != p {
+		t.Fatalf("Unexpected path %v: %v", p, err)
+	}
+	if object, err := cache.GetObjectByPath("/TV/Show/S01E01.mkv"); nil != err || "episode" != object.ObjectID {
+		t.Fatalf("Unexpected object %v: %v", object, err)
+	}
+	if p, err := cache.GetPath("root"); nil != err || "/" != p {
+		t.Fatalf("Unexpected root path %v: %v", p, err)
+	}
+
+	// renaming an ancestor invalidates the memoized paths of all descendants
+	cache.BatchUpdateObjects([]*APIObject{
+		{ObjectID: "tv", Name: "Series", IsDir: true, Parents: []string{"root"}},
+	})
+	if p, err := cache.GetPath("episode"); nil != err || "/Series/Show/S01E01.mkv" != p {
+		t.Fatalf("Unexpected path after rename %v: %v", p, err)
+	}
+	if _, err := cache.GetObjectByPath("/TV/Show/S01E01.mkv"); nil == err {
+		t.Fatalf("Expected old path to be unresolvable")
+	}
+
+	cache.DeleteSubtree("show")
+	if _, err := cache.GetPath("episode"); nil == err {
+		t.Fatalf("Expected deleted object to be unresolvable")
+	}
+}
+
+func TestResolvePathsConcurrentUpdate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "plexdrive")
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cache, err := NewCache(filepath.Join(dir, "cache.bolt"), dir, "", "", false)
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer cache.Close()
+
+	cache.StoreRootID("root")
+	cache.BatchUpdateObjects([]*APIObject{
+		{ObjectID: "root", Name: "My Drive", IsDir: true},
+		{ObjectID: "movie", Name: "Movie.mkv", Parents: []string{"root"}},
+	})
+
+	// a path resolved before an update of an untracked object is committed
+	// must not be memoized afterwards
+	generation := cache.paths.currentGeneration()
+	cache.BatchUpdateObjects([]*APIObject{
+		{ObjectID: "movie", Name: "Film.mkv", Parents: []string{"root"}},
+	})
+	cache.paths.put("movie", &pathEntry{path: "/Movie.mkv", ancestors: []string{"root"}}, generation)
+	if p, err := cache.GetPath("movie"); nil != err || "/Film.mkv" != p {
+		t.Fatalf("Unexpected path after concurrent rename %v: %v", p, err)
+	}
+}
@@ -0,0 +1,237 @@
+package drive
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+
+	. "github.com/claudetech/loggo/default"
+
+	"github.com/boltdb/bolt"
+)
+
+var bQuarantine = []byte("quarantine")
+
+// minGuardedFolderSize is the number of children a folder must have before
+// the share of removed children is checked, removing a single file of a small
+// folder would exceed any share
+const minGuardedFolderSize = 10
+
+// DeletionGuard holds removals of the change feed in quarantine, the objects
+// are still served until the removals are applied
+type DeletionGuard struct {
+	// MaxObjects holds the removals of a change check that removes more
+	// objects until they are confirmed (0 = no limit)
+	MaxObjects int
+	// MaxFolderPercent holds the removals of a change check that removes a
+	// bigger share of the children of a folder until they are confirmed (0 = no limit)
+	MaxFolderPercent float64
+	// GracePeriod delays the removals of change checks below the limits
+	GracePeriod time.Duration
+}
+
+// Enabled checks if removals are quarantined at all
+func (g DeletionGuard) Enabled() bool {
+	return g.MaxObjects > 0 || g.MaxFolderPercent > 0 || g.GracePeriod > 0
+}
+
+// QuarantinedObject is a removal held in quarantine
+type QuarantinedObject struct {
+	ObjectID string
+	Name     string
+	Removed  time.Time
+	// Held removals are only applied after they have been confirmed
+	Held bool
+	// Subtree removes all descendants of the object as well
+	Subtree bool
+}
+
+// QuarantineObjects holds the removal of cached objects, the ids of objects
+// that were not quarantined yet are returned
+func (c *Cache) QuarantineObjects(ids []string, removed time.Time, subtree bool) ([]string, error) {
+	quarantined := make([]string, 0, len(ids))
+	err := c.db.Update(func(tx *bolt.Tx) error {
+		ns := c.namespaceBucket(tx)
+		b := ns.Bucket(bQuarantine)
+		for _, id := range ids {
+			if nil != b.Get([]byte(id)) {
+				continue
+			}
+			object, _ := boltGetObject(ns, id)
+			if nil == object {
+				continue
+			}
+			record := QuarantinedObject{
+				ObjectID: id,
+				Name:     object.Name,
+				Removed:  removed,
+				Subtree:  subtree,
+			}
+			if err := boltStoreQuarantine(b, &record); nil != err {
+				return err
+			}
+			quarantined = append(quarantined, id)
+		}
+		return nil
+	})
+	if nil != err {
+		Log.Debugf("%v", err)
+		return nil, fmt.Errorf("Could not quarantine removed objects")
+	}
+	return quarantined, nil
+}
+
+// HoldQuarantine marks quarantined removals to wait for confirmation
+func (c *Cache) HoldQuarantine(ids []string) error {
+	err := c.db.Update(func(tx *bolt.Tx) error {
+		b := c.namespaceBucket(tx).Bucket(bQuarantine)
+		for _, id := range ids {
+			record := boltGetQuarantine(b, id)
+			if nil == record {
+				continue
+			}
+			record.Held = true
+			if err := boltStoreQuarantine(b, record); nil != err {
+				return err
+			}
+		}
+		return nil
+	})
+	if nil != err {
+		Log.Debugf("%v", err)
+		return fmt.Errorf("Could not hold quarantined removals")
+	}
+	return nil
+}
+
+// GetQuarantine returns all quarantined removals ordered by time
+func (c *Cache) GetQuarantine() ([]*QuarantinedObject, error) {
+	records := make([]*QuarantinedObject, 0)
+	err := c.db.View(func(tx *bolt.Tx) error {
+		b := c.namespaceBucket(tx).Bucket(bQuarantine)
+		if nil == b {
+			return nil
+		}
+		return b.ForEach(func(k, v []byte) error {
+			var record QuarantinedObject
+			if err := json.Unmarshal(v, &record); nil != err {
+				return err
+			}
+			records = append(records, &record)
+			return nil
+		})
+	})
+	if nil != err {
+		Log.Debugf("%v", err)
+		return nil, fmt.Errorf("Could not read quarantine")
+	}
+	sort.Slice(records, func(i, j int) bool {
+		return records[i].Removed.Before(records[j].Removed)
+	})
+	return records, nil
+}
+
+// ApplyQuarantine deletes the quarantined objects matching the filter and
+// returns the number of deleted objects
+func (c *Cache) ApplyQuarantine(filter func(record *QuarantinedObject) bool) (int, error) {
+	return c.updateQuarantine(filter, true)
+}
+
+// ReleaseQuarantine drops the quarantined removals matching the filter and
+// keeps the objects, it returns the number of released removals
+func (c *Cache) ReleaseQuarantine(filter func(record *QuarantinedObject) bool) (int, error) {
+	return c.updateQuarantine(filter, false)
+}
+
+func (c *Cache) updateQuarantine(filter func(record *QuarantinedObject) bool, apply bool) (int, error) {
+	records, err := c.GetQuarantine()
+	if nil != err {
+		return 0, err
+	}
+
+	count := 0
+	deleted := make([]string, 0)
+	err = c.db.Update(func(tx *bolt.Tx) error {
+		ns := c.namespaceBucket(tx)
+		b := ns.Bucket(bQuarantine)
+		for _, record := range records {
+			if !filter(record) {
+				continue
+			}
+			if err := b.Delete([]byte(record.ObjectID)); nil != err {
+				return err
+			}
+			if !apply {
+				count++
+				continue
+			}
+
+			deleted = append(deleted, record.ObjectID)
+			if record.Subtree {
+				n, err := boltDeleteSubtree(ns, record.ObjectID)
+				if nil != err {
+					return err
+				}
+				count += n
+			} else if object, _ := boltGetObject(ns, record.ObjectID); nil != object {
+				if err := boltDeleteObject(ns, object); nil != err {
+					return err
+				}
+				count++
+			}
+		}
+		return nil
+	})
+	c.paths.invalidate(deleted...)
+	if nil != err {
+		Log.Debugf("%v", err)
+		return 0, fmt.Errorf("Could not update quarantine")
+	}
+	return count, nil
+}
+
+// getRemovalShares returns the share of removed children in percent of all
+// folders with removed children and at least minGuardedFolderSize children
+func (c *Cache) getRemovalShares(ids []string) map[string]float64 {
+	shares := make(map[string]float64)
+	c.db.View(func(tx *bolt.Tx) error {
+		ns := c.namespaceBucket(tx)
+		removed := make(map[string]int)
+		for _, id := range ids {
+			if object, _ := boltGetObject(ns, id); nil != object {
+				for _, parent := range object.Parents {
+					removed[parent]++
+				}
+			}
+		}
+		for parent, count := range removed {
+			if children := len(boltGetChildIDs(ns, parent)); children >= minGuardedFolderSize {
+				shares[parent] = float64(count) * 100 / float64(children)
+			}
+		}
+		return nil
+	})
+	return shares
+}
+
+func boltGetQuarantine(b *bolt.Bucket, id string) *QuarantinedObject {
+	v := b.Get([]byte(id))
+	if nil == v {
+		return nil
+	}
+	var record QuarantinedObject
+	if err := json.Unmarshal(v, &record); nil != err {
+		Log.Debugf("%v", err)
+		return nil
+	}
+	return &record
+}
+
+func boltStoreQuarantine(b *bolt.Bucket, record *QuarantinedObject) error {
+	v, err := json.Marshal(record)
+	if nil != err {
+		return err
+	}
+	return b.Put([]byte(record.ObjectID), v)
+}
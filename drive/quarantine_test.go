@@ -0,0 +1,70 @@
+package drive
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestDeletionGuard(t *testing.T) {
+	dir, err := ioutil.TempDir("", "plexdrive")
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cache, err := NewCache(filepath.Join(dir, "cache.bolt"), dir, "", "", false)
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer cache.Close()
+
+	cache.BatchUpdateObjects([]*APIObject{
+		{ObjectID: "root", Name: "My Drive", IsDir: true},
+		{ObjectID: "a", Name: "a.mkv", Parents: []string{"root"}},
+		{ObjectID: "b", Name: "b.mkv", Parents: []string{"root"}},
+		{ObjectID: "c", Name: "c.mkv", Parents: []string{"root"}},
+		{ObjectID: "d", Name: "d.mkv", Parents: []string{"root"}},
+	})
+	client := &Client{
+		cache: cache,
+		guard: DeletionGuard{MaxObjects: 2, GracePeriod: time.Hour},
+	}
+
+	// a mass removal is held, the objects are still served
+	client.guardRemovals(client.quarantineRemovals([]string{"a", "b", "c"}, nil))
+	if _, err := cache.GetObject("a"); nil != err {
+		t.Fatalf("Expected quarantined object to be served")
+	}
+
+	// a small removal waits for the grace period
+	client.guardRemovals(client.quarantineRemovals([]string{"d"}, nil))
+	records, _ := cache.GetQuarantine()
+	if 4 != len(records) || !records[0].Held || records[3].Held {
+		t.Fatalf("Unexpected quarantine %+v", records)
+	}
+
+	// a restored object is released from quarantine
+	client.quarantineRemovals(nil, []*APIObject{{ObjectID: "c", Name: "c.mkv", Parents: []string{"root"}}})
+
+	client.guard.GracePeriod = 0
+	client.guardRemovals(nil)
+	if _, err := cache.GetObject("d"); nil == err {
+		t.Fatalf("Expected removal to be applied after the grace period")
+	}
+
+	deleted, err := cache.ApplyQuarantine(func(record *QuarantinedObject) bool {
+		return record.Held
+	})
+	if nil != err || 2 != deleted {
+		t.Fatalf("Expected 2 confirmed removals, got %v: %v", deleted, err)
+	}
+	if _, err := cache.GetObject("c"); nil != err {
+		t.Fatalf("Expected restored object to be kept")
+	}
+	if records, _ := cache.GetQuarantine(); 0 != len(records) {
+		t.Fatalf("Expected empty quarantine %+v", records)
+	}
+}
@@ -0,0 +1,131 @@
+package drive
+
+import (
+	. "github.com/claudetech/loggo/default"
+)
+
+// filterSubtree returns all changed objects whose ancestry reaches the mounted
+// root, the ancestry is resolved from the changed objects and the cache. Cached
+// objects that were moved out of the subtree are returned as removals, folders
+// that were moved into the subtree are returned separately so that their
+// contents can be fetched.
+func (d *Client) filterSubtree(objects []*APIObject) (filtered []*APIObject, movedIn, movedOut []string) {
+	rootID, err := d.getRootID()
+	if nil != err {
+		Log.Warningf("%v", err)
+		return objects, nil, nil
+	}
+
+	changed := make(map[string]*APIObject, len(objects))
+	for _, object := range objects {
+		changed[object.ObjectID] = object
+	}
+	inSubtree := d.subtreeResolver(rootID, changed)
+	wasInSubtree := d.subtreeResolver(rootID, nil)
+
+	filtered = make([]*APIObject, 0, len(objects))
+	movedIn = make([]string, 0)
+	movedOut = make([]string, 0)
+	for _, object := range objects {
+		_, err := d.cache.GetObject(object.ObjectID)
+		cached := nil == err
+
+		if inSubtree(object.ObjectID) {
+			filtered = append(filtered, object)
+			if object.IsDir && !wasInSubtree(object.ObjectID) {
+				movedIn = append(movedIn, object.ObjectID)
+			}
+		} else if cached {
+			Log.Debugf("Object %v (%v) was moved out of the mounted subtree", object.ObjectID, object.Name)
+			movedOut = append(movedOut, object.ObjectID)
+		} else {
+			Log.Tracef("Ignoring object %v (%v) outside of the mounted subtree", object.ObjectID, object.Name)
+		}
+	}
+
+	return filtered, movedIn, movedOut
+}
+
+// movedIntoSubtree returns the changed folders that were moved into the
+// mounted subtree, the cache only contains the contents of the folders that
+// were crawled from the root
+func (d *Client) movedIntoSubtree(objects []*APIObject) []string {
+	rootID, err := d.getRootID()
+	if nil != err {
+		Log.Warningf("%v", err)
+		return nil
+	}
+
+	changed := make(map[string]*APIObject)
+	for _, object := range objects {
+		changed[object.ObjectID] = object
+	}
+	inSubtree := d.subtreeResolver(rootID, changed)
+	wasInSubtree := d.subtreeResolver(rootID, nil)
+
+	movedIn := make([]string, 0)
+	for _, object := range objects {
+		if object.IsDir && inSubtree(object.ObjectID) && !wasInSubtree(object.ObjectID) {
+			movedIn = append(movedIn, object.ObjectID)
+		}
+	}
+	return movedIn
+}
+
+// subtreeResolver returns a function that checks if the ancestry of an object
+// reaches the root, the ancestry is resolved from the changed objects and the
+// cache
+func (d *Client) subtreeResolver(rootID string, changed map[string]*APIObject) func(id string) bool {
+	resolved := make(map[string]bool)
+	var inSubtree func(id string) bool
+	inSubtree = func(id string) bool {
+		if id == rootID {
+			return true
+		}
+		if result, exists := resolved[id]; exists {
+			return result
+		}
+		// guard against cycles while resolving
+		resolved[id] = false
+		object, exists := changed[id]
+		if !exists {
+			var err error
+			if object, err = d.cache.GetObject(id); nil != err {
+				return false
+			}
+		}
+		result := false
+		for _, parent := range object.Parents {
+			if result = inSubtree(parent); result {
+				break
+			}
+		}
+		resolved[id] = result
+		return result
+	}
+	return inSubtree
+}
+
+// getRootID resolves the id of the mounted root node
+func (d *Client) getRootID() (string, error) {
+	d.lock.Lock()
+	rootID := d.rootID
+	d.lock.Unlock()
+	if "" != rootID {
+		return rootID, nil
+	}
+
+	file, err := d.GetFileById(d.rootNodeID)
+	if nil != err {
+		root, cacheErr := d.getCachedRoot()
+		if nil != cacheErr {
+			return "", err
+		}
+		return root.ObjectID, nil
+	}
+
+	d.lock.Lock()
+	d.rootID = file.Id
+	d.lock.Unlock()
+	return file.Id, nil
+}
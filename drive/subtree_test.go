@@ -0,0 +1,113 @@
+package drive
+
+import (
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestFilterSubtree(t *testing.T) {
+	dir, err := ioutil.TempDir("", "plexdrive")
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cache, err := NewCache(filepath.Join(dir, "cache.bolt"), dir, "", "folder", false)
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer cache.Close()
+	cache.BatchUpdateObjects([]*APIObject{
+		{ObjectID: "folder", Name: "Movies", IsDir: true, Parents: []string{"root"}},
+		{ObjectID: "a", Name: "A", IsDir: true, Parents: []string{"folder"}},
+		{ObjectID: "a-child", Name: "A.mkv", Parents: []string{"a"}},
+		// cached outside of the subtree, e.g. the parent of the root node
+		{ObjectID: "outside", Name: "Outside", IsDir: true, Parents: []string{"elsewhere"}},
+	})
+
+	client := newTestClient(cache, func(req *http.Request) (*http.Response, error) {
+		t.Fatalf("Unexpected API request %v", req.URL)
+		return nil, nil
+	})
+	client.rootID = "folder"
+	client.subtreeOnly = true
+
+	filtered, movedIn, movedOut := client.filterSubtree([]*APIObject{
+		{ObjectID: "a", Name: "A", IsDir: true, Parents: []string{"outside"}},
+		{ObjectID: "new", Name: "New.mkv", Parents: []string{"outside"}},
+		{ObjectID: "dir", Name: "Dir", IsDir: true, Parents: []string{"folder"}},
+		{ObjectID: "child", Name: "Child.mkv", Parents: []string{"dir"}},
+		{ObjectID: "cycle", Name: "Cycle", IsDir: true, Parents: []string{"cycle"}},
+	})
+	ids := make([]string, 0, len(filtered))
+	for _, object := range filtered {
+		ids = append(ids, object.ObjectID)
+	}
+	if !reflect.DeepEqual([]string{"dir", "child"}, ids) {
+		t.Fatalf("Unexpected objects in subtree %v", ids)
+	}
+	if !reflect.DeepEqual([]string{"dir"}, movedIn) {
+		t.Fatalf("Unexpected folders moved in %v", movedIn)
+	}
+	if !reflect.DeepEqual([]string{"a"}, movedOut) {
+		t.Fatalf("Unexpected objects moved out %v", movedOut)
+	}
+
+	// objects moved out of the subtree are quarantined like removals
+	client.guard = DeletionGuard{GracePeriod: time.Hour}
+	if _, quarantined, err := client.applyChanges(nil, []*APIObject{
+		{ObjectID: "a", Name: "A", IsDir: true, Parents: []string{"outside"}},
+	}, nil); nil != err || !reflect.DeepEqual([]string{"a"}, quarantined) {
+		t.Fatalf("Expected moved out object to be quarantined %v: %v", quarantined, err)
+	}
+	if _, err := cache.GetObject("a-child"); nil != err {
+		t.Fatalf("Expected quarantined subtree to be kept: %v", err)
+	}
+}
+
+func TestDeleteSubtree(t *testing.T) {
+	dir, err := ioutil.TempDir("", "plexdrive")
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cache, err := NewCache(filepath.Join(dir, "cache.bolt"), dir, "", "", false)
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer cache.Close()
+	cache.BatchUpdateObjects([]*APIObject{
+		{ObjectID: "root", Name: "My Drive", IsDir: true},
+		{ObjectID: "tv", Name: "TV", IsDir: true, Parents: []string{"root"}},
+		{ObjectID: "show", Name: "Show", IsDir: true, Parents: []string{"tv"}},
+		{ObjectID: "episode", Name: "S01E01.mkv", Parents: []string{"show"}},
+		{ObjectID: "shared", Name: "Shared.mkv", Parents: []string{"show", "root"}},
+	})
+
+	if deleted, err := cache.DeleteSubtree("tv"); nil != err || 3 != deleted {
+		t.Fatalf("Expected 3 deleted objects got %v: %v", deleted, err)
+	}
+	for _, id := range []string{"tv", "show", "episode"} {
+		if _, err := cache.GetObject(id); nil == err {
+			t.Fatalf("Expected object %v to be deleted", id)
+		}
+	}
+
+	// children linked to another cached parent are kept
+	shared, err := cache.GetObject("shared")
+	if nil != err || !reflect.DeepEqual([]string{"root"}, shared.Parents) {
+		t.Fatalf("Expected shared object to be kept below root, got %v: %v", shared, err)
+	}
+	if object, err := cache.GetObjectByParentAndName("root", "Shared.mkv"); nil != err || "shared" != object.ObjectID {
+		t.Fatalf("Expected index entry of shared object to be kept: %v", err)
+	}
+	if _, err := cache.GetObjectByParentAndName("show", "Shared.mkv"); nil == err {
+		t.Fatal("Expected index entry below deleted parent to be removed")
+	}
+}
@@ -0,0 +1,46 @@
+package drive
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+
+	. "github.com/claudetech/loggo/default"
+	"golang.org/x/oauth2"
+)
+
+// loadToken loads a token from the token file
+func loadToken(tokenPath string) (*oauth2.Token, error) {
+	Log.Debugf("Loading token from cache")
+
+	tokenFile, err := ioutil.ReadFile(tokenPath)
+	if nil != err {
+		Log.Debugf("%v", err)
+		return nil, fmt.Errorf("Could not read token file in %v", tokenPath)
+	}
+
+	var token oauth2.Token
+	json.Unmarshal(tokenFile, &token)
+
+	Log.Tracef("Got token from cache %v", token)
+
+	return &token, nil
+}
+
+// storeToken stores a token in the token file
+func storeToken(tokenPath string, token *oauth2.Token) error {
+	Log.Debugf("Storing token to cache")
+
+	tokenJSON, err := json.Marshal(token)
+	if nil != err {
+		Log.Debugf("%v", err)
+		return fmt.Errorf("Could not generate token.json content")
+	}
+
+	if err := ioutil.WriteFile(tokenPath, tokenJSON, 0644); nil != err {
+		Log.Debugf("%v", err)
+		return fmt.Errorf("Could not generate token.json file")
+	}
+
+	return nil
+}
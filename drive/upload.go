@@ -0,0 +1,83 @@
+package drive
+
+import (
+	"fmt"
+	"io"
+	"time"
+
+	. "github.com/claudetech/loggo/default"
+	gdrive "google.golang.org/api/drive/v3"
+	"google.golang.org/api/googleapi"
+)
+
+// CreateFolder creates a new folder in Google Drive without caching it
+func (d *Client) CreateFolder(parent, name string) (*APIObject, error) {
+	client, err := d.getClient()
+	if nil != err {
+		Log.Debugf("%v", err)
+		return nil, fmt.Errorf("Could not get Google Drive client")
+	}
+
+	created, err := client.Files.Create(&gdrive.File{Name: name, Parents: []string{parent}, MimeType: folderMimeType}).SupportsAllDrives(true).Do()
+	if nil != err {
+		Log.Debugf("%v", err)
+		return nil, fmt.Errorf("Could not create object(%v) from API", name)
+	}
+
+	file, err := client.Files.Get(created.Id).Fields(googleapi.Field(fields)).SupportsAllDrives(true).Do()
+	if nil != err {
+		Log.Debugf("%v", err)
+		return nil, fmt.Errorf("Could not get object fields %v from API", created.Id)
+	}
+
+	object, err := d.mapFileToObject(file)
+	if nil != err {
+		Log.Debugf("%v", err)
+		return nil, fmt.Errorf("Could not map file to object %v (%v)", file.Id, file.Name)
+	}
+	return object, nil
+}
+
+// Upload uploads content as a new file into the parent folder or as a new
+// revision of the file replaceID without caching it, content bigger than
+// chunkSize is sent in chunks. The upload session isn't kept, so an
+// interrupted upload starts over.
+func (d *Client) Upload(parent, name, replaceID string, content io.Reader, modified time.Time, chunkSize int) (*APIObject, error) {
+	client, err := d.getClient()
+	if nil != err {
+		Log.Debugf("%v", err)
+		return nil, fmt.Errorf("Could not get Google Drive client")
+	}
+
+	metadata := &gdrive.File{
+		Name:         name,
+		ModifiedTime: modified.UTC().Format(time.RFC3339),
+	}
+	var file *gdrive.File
+	if "" == replaceID {
+		metadata.Parents = []string{parent}
+		file, err = client.Files.Create(metadata).
+			Media(content, googleapi.ChunkSize(chunkSize)).
+			Fields(googleapi.Field(fields)).
+			SupportsAllDrives(true).
+			Do()
+	} else {
+		file, err = client.Files.Update(replaceID, metadata).
+			Media(content, googleapi.ChunkSize(chunkSize)).
+			Fields(googleapi.Field(fields)).
+			SupportsAllDrives(true).
+			Do()
+	}
+	d.updateOnline(err)
+	if nil != err {
+		Log.Debugf("%v", err)
+		return nil, fmt.Errorf("Could not upload %v to API", name)
+	}
+
+	object, err := d.mapFileToObject(file)
+	if nil != err {
+		Log.Debugf("%v", err)
+		return nil, fmt.Errorf("Could not map file to object %v (%v)", file.Id, file.Name)
+	}
+	return object, nil
+}
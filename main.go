@@ -21,6 +21,7 @@ import (
 	. "github.com/claudetech/loggo/default"
 	"github.com/plexdrive/plexdrive/chunk"
 	"github.com/plexdrive/plexdrive/config"
+	"github.com/plexdrive/plexdrive/control"
 	"github.com/plexdrive/plexdrive/drive"
 	"github.com/plexdrive/plexdrive/mount"
 	flag "github.com/spf13/pflag"
@@ -51,21 +52,57 @@ func main() {
 	argDriveID := flag.String("drive-id", "", "The ID of the shared drive to mount (including team drives)")
 	argConfigPath := flag.StringP("config", "c", filepath.Join(home, ".plexdrive"), "The path to the configuration directory")
 	argCacheFile := flag.String("cache-file", "", "Path of the cache file (default \"cache.bolt\" in configuration directory)")
-	argChunkFile := flag.String("chunk-file", "", "Path of the chunk cache file (default \"chunks.dat\" in configuration directory)")
+	argChunkFiles := flag.StringArray("chunk-file", nil, "Path of a chunk cache file with an optional size, e.g. /mnt/ssd1/chunks.dat=100G, repeat to spread the cache over multiple files (default \"chunks.dat\" in configuration directory)")
 	argChunkDiskCache := flag.Bool("chunk-disk-cache", false, "Enable disk based chunk cache to --chunk-file")
 	argChunkSize := flag.String("chunk-size", "10M", "The size of each chunk that is downloaded (units: B, K, M, G)")
 	argChunkLoadThreads := flag.Int("chunk-load-threads", max(runtime.NumCPU()/2, 1), "The number of threads to use for downloading chunks")
 	argChunkCheckThreads := flag.Int("chunk-check-threads", max(runtime.NumCPU()/2, 1), "The number of threads to use for checking chunk existence")
-	argChunkLoadAhead := flag.Int("chunk-load-ahead", max(runtime.NumCPU()-1, 1), "The number of chunks that should be read ahead")
+	argChunkLoadAhead := flag.Int("chunk-load-ahead", max(runtime.NumCPU()-1, 1), "The maximum number of chunks that are read ahead of sequential reads")
 	argMaxChunks := flag.Int("max-chunks", runtime.NumCPU()*2, "The maximum number of chunks to be stored in memory")
+	argCacheSize := flag.String("cache-size", "", "The size of the chunk cache, replaces --max-chunks (units: B, K, M, G, T)")
+	argMaxRAMChunks := flag.Int("max-ram-chunks", 0, "The number of chunks kept in a RAM tier in front of the --chunk-disk-cache (0 to disable)")
+	argChunkEviction := flag.String("chunk-eviction", "lru", "The eviction policy of the chunk cache (lru, lfu, 2q, arc)")
+	argCrawlThreads := flag.Int("crawl-threads", 8, "The number of threads to use for crawling folders on the first cache build")
+	argCacheSubtreeOnly := flag.Bool("cache-subtree-only", false, "Only cache objects inside of --root-node-id instead of the whole drive")
 	argRefreshInterval := flag.Duration("refresh-interval", 1*time.Minute, "The time to wait till checking for changes")
+	argDeleteMaxObjects := flag.Int("delete-max-objects", 0, "Hold removals in quarantine if a change check removes more objects (0 = no limit)")
+	argDeleteMaxFolderPercent := flag.Float64("delete-max-folder-percent", 0, "Hold removals in quarantine if a change check removes more percent of a folder (0 = no limit)")
+	argDeleteGracePeriod := flag.Duration("delete-grace-period", 0, "The time to keep serving removed objects before deleting them from the cache")
+	argDryRun := flag.Bool("dry-run", false, "Only write deletes and renames on the mount to the audit log instead of applying them")
+	argMaxDestructiveOps := flag.Int("max-destructive-ops", 0, "Refuse deletes and renames on the mount after more operations per minute (0 = no limit)")
+	argAuditLog := flag.String("audit-log", "", "Path of the audit log of deletes and renames (default \"audit.log\" in configuration directory)")
 	argMountOptions := flag.StringP("fuse-options", "o", "", "Fuse mount options (e.g. --fuse-options allow_other,direct_io,...)")
 	argVersion := flag.Bool("version", false, "Displays program's version information")
 	argUID := flag.Int64("uid", -1, "Set the mounts UID (-1 = default permissions)")
 	argGID := flag.Int64("gid", -1, "Set the mounts GID (-1 = default permissions)")
 	argUmask := flag.Uint32("umask", 0, "Override the default file permissions")
+
+	// options of the other commands are listed separately in the usage
+	commandFlags := flag.NewFlagSet("commands", flag.ExitOnError)
+	argRepair := commandFlags.Bool("repair", false, "Repair all inconsistencies found by cache fsck")
+	argGetThreads := commandFlags.Int("get-threads", 16, "The number of ranges of --chunk-size that get downloads in parallel")
+	argPutThreads := commandFlags.Int("put-threads", 4, "The number of files that put uploads in parallel")
+	argJSON := commandFlags.Bool("json", false, "Print the output of ls, stat, find and du as JSON")
+	argFindName := commandFlags.String("name", "", "Only find objects whose name matches the pattern (e.g. \"*.mkv\")")
+	argFindType := commandFlags.String("type", "", "Only find files (f) or folders (d)")
+	argFindMinSize := commandFlags.String("min-size", "", "Only find objects with at least this size (units: B, K, M, G)")
+	argFindMaxSize := commandFlags.String("max-size", "", "Only find objects with at most this size (units: B, K, M, G)")
+	argFindModifiedAfter := commandFlags.String("modified-after", "", "Only find objects modified after this time (e.g. 2006-01-02 or RFC 3339)")
+	argFindModifiedBefore := commandFlags.String("modified-before", "", "Only find objects modified before this time (e.g. 2006-01-02 or RFC 3339)")
+
 	argAcknowledgeAbuse := flag.Bool("acknowledge-abuse", false, "Allows files identified as abusive (malware, etc.) to be downloaded in Drive")
 	// argDownloadSpeedLimit := flag.String("speed-limit", "", "This value limits the download speed, e.g. 5M = 5MB/s per chunk (units: B, K, M, G)")
+	flag.CommandLine.AddFlagSet(commandFlags)
+	flag.Usage = func() {
+		mountFlags := flag.NewFlagSet("mount", flag.ExitOnError)
+		flag.VisitAll(func(f *flag.Flag) {
+			if nil == commandFlags.Lookup(f.Name) {
+				mountFlags.AddFlag(f)
+			}
+		})
+		fmt.Fprintf(os.Stderr, "Usage of %v mount:\n%v\nOptions of the other commands:\n%v",
+			os.Args[0], mountFlags.FlagUsages(), commandFlags.FlagUsages())
+	}
 	flag.Parse()
 
 	// display version information
@@ -74,9 +111,39 @@ func main() {
 		return
 	}
 
+	// set default paths, must happen after parsing to get custom config path
+	if !flag.Lookup("cache-file").Changed {
+		*argCacheFile = filepath.Join(*argConfigPath, "cache.bolt")
+	}
+	if !flag.Lookup("chunk-file").Changed {
+		*argChunkFiles = []string{filepath.Join(*argConfigPath, "chunks.dat")}
+	}
+	if !flag.Lookup("audit-log").Changed {
+		*argAuditLog = filepath.Join(*argConfigPath, "audit.log")
+	}
+
+	// initialize the logger with the specific log level
+	var logLevel loggo.Level
+	switch *argLogLevel {
+	case 0:
+		logLevel = loggo.Error
+	case 1:
+		logLevel = loggo.Warning
+	case 2:
+		logLevel = loggo.Info
+	case 3:
+		logLevel = loggo.Debug
+	case 4:
+		logLevel = loggo.Trace
+	default:
+		logLevel = loggo.Warning
+	}
+	Log.SetLevel(logLevel)
+
 	argCommand := flag.Arg(0)
 
-	if argCommand == "mount" {
+	switch argCommand {
+	case "mount":
 		// check if mountpoint is specified
 		argMountPoint := flag.Arg(1)
 		if "" == argMountPoint {
@@ -85,14 +152,6 @@ func main() {
 			panic(fmt.Errorf("Mountpoint not specified"))
 		}
 
-		// set default paths, must happen after parsing to get custom config path
-		if !flag.Lookup("cache-file").Changed {
-			*argCacheFile = filepath.Join(*argConfigPath, "cache.bolt")
-		}
-		if !flag.Lookup("chunk-file").Changed {
-			*argChunkFile = filepath.Join(*argConfigPath, "chunks.dat")
-		}
-
 		// calculate uid / gid
 		uid := uint32(unix.Geteuid())
 		gid := uint32(unix.Getegid())
@@ -112,37 +171,30 @@ func main() {
 			mountOptions = strings.Split(*argMountOptions, ",")
 		}
 
-		// initialize the logger with the specific log level
-		var logLevel loggo.Level
-		switch *argLogLevel {
-		case 0:
-			logLevel = loggo.Error
-		case 1:
-			logLevel = loggo.Warning
-		case 2:
-			logLevel = loggo.Info
-		case 3:
-			logLevel = loggo.Debug
-		case 4:
-			logLevel = loggo.Trace
-		default:
-			logLevel = loggo.Warning
-		}
-		Log.SetLevel(logLevel)
-
 		// debug all given parameters
 		Log.Debugf("verbosity            : %v", logLevel)
 		Log.Debugf("root-node-id         : %v", *argRootNodeID)
 		Log.Debugf("drive-id             : %v", *argDriveID)
 		Log.Debugf("config               : %v", *argConfigPath)
 		Log.Debugf("cache-file           : %v", *argCacheFile)
-		Log.Debugf("chunk-file           : %v", *argChunkFile)
+		Log.Debugf("chunk-file           : %v", *argChunkFiles)
 		Log.Debugf("chunk-disk-cache     : %v", *argChunkDiskCache)
 		Log.Debugf("chunk-size           : %v", *argChunkSize)
 		Log.Debugf("chunk-load-threads   : %v", *argChunkLoadThreads)
 		Log.Debugf("chunk-check-threads  : %v", *argChunkCheckThreads)
 		Log.Debugf("chunk-load-ahead     : %v", *argChunkLoadAhead)
 		Log.Debugf("max-chunks           : %v", *argMaxChunks)
+		Log.Debugf("cache-size           : %v", *argCacheSize)
+		Log.Debugf("max-ram-chunks       : %v", *argMaxRAMChunks)
+		Log.Debugf("chunk-eviction       : %v", *argChunkEviction)
+		Log.Debugf("crawl-threads        : %v", *argCrawlThreads)
+		Log.Debugf("cache-subtree-only   : %v", *argCacheSubtreeOnly)
+		Log.Debugf("delete-max-objects   : %v", *argDeleteMaxObjects)
+		Log.Debugf("delete-max-folder-%%  : %v", *argDeleteMaxFolderPercent)
+		Log.Debugf("delete-grace-period  : %v", *argDeleteGracePeriod)
+		Log.Debugf("dry-run              : %v", *argDryRun)
+		Log.Debugf("max-destructive-ops  : %v", *argMaxDestructiveOps)
+		Log.Debugf("audit-log            : %v", *argAuditLog)
 		Log.Debugf("refresh-interval     : %v", *argRefreshInterval)
 		Log.Debugf("fuse-options         : %v", *argMountOptions)
 		Log.Debugf("UID                  : %v", uid)
@@ -163,15 +215,6 @@ func main() {
 			Log.Debugf("%v", err)
 			os.Exit(1)
 		}
-		if *argChunkDiskCache {
-			if err := os.MkdirAll(filepath.Dir(*argChunkFile), 0766); nil != err {
-				Log.Errorf("Could not create chunk cache file directory")
-				Log.Debugf("%v", err)
-				os.Exit(1)
-			}
-		} else {
-			*argChunkFile = ""
-		}
 
 		// set the global buffer configuration
 		chunkSize, err := parseSizeArg(*argChunkSize)
@@ -180,6 +223,32 @@ func main() {
 			os.Exit(2)
 		}
 
+		if "" != *argCacheSize {
+			*argMaxChunks, err = parseCacheSizeArg(*argCacheSize, chunkSize, *argChunkLoadAhead)
+			if nil != err {
+				Log.Errorf("%v", err)
+				os.Exit(2)
+			}
+		}
+
+		var chunkFiles []chunk.ChunkFile
+		if *argChunkDiskCache {
+			chunkFiles, err = parseChunkFileArgs(*argChunkFiles, chunkSize, *argMaxChunks, "" != *argCacheSize)
+			if nil != err {
+				Log.Errorf("%v", err)
+				os.Exit(2)
+			}
+			// the directories of multiple chunk files must exist, so that the
+			// file of a disk that isn't mounted is skipped
+			if 1 == len(chunkFiles) {
+				if err := os.MkdirAll(filepath.Dir(chunkFiles[0].Path), 0766); nil != err {
+					Log.Errorf("Could not create chunk cache file directory")
+					Log.Debugf("%v", err)
+					os.Exit(1)
+				}
+			}
+		}
+
 		// read the configuration
 		configPath := filepath.Join(*argConfigPath, "config.json")
 		cfg, err := config.Read(configPath)
@@ -192,44 +261,93 @@ func main() {
 			}
 		}
 
-		cache, err := drive.NewCache(*argCacheFile, *argConfigPath, *argLogLevel > 3)
+		cache, err := drive.NewCache(*argCacheFile, *argConfigPath, *argDriveID, *argRootNodeID, *argLogLevel > 3)
 		if nil != err {
 			Log.Errorf("%v", err)
 			os.Exit(4)
 		}
 		defer cache.Close()
 
-		client, err := drive.NewClient(cfg, cache, *argRefreshInterval, *argRootNodeID, *argDriveID)
+		client, err := drive.NewClient(cfg, cache, *argRefreshInterval, *argRootNodeID, *argDriveID, *argCrawlThreads, *argCacheSubtreeOnly, drive.DeletionGuard{
+			MaxObjects:       *argDeleteMaxObjects,
+			MaxFolderPercent: *argDeleteMaxFolderPercent,
+			GracePeriod:      *argDeleteGracePeriod,
+		})
 		if nil != err {
 			Log.Errorf("%v", err)
 			os.Exit(4)
 		}
 
-		if *argChunkDiskCache != true {
-			*argChunkFile = ""
-		}
-
 		chunkManager, err := chunk.NewManager(
-			*argChunkFile,
+			chunkFiles,
 			chunkSize,
 			*argChunkLoadAhead,
 			*argChunkCheckThreads,
 			*argChunkLoadThreads,
 			client,
 			*argMaxChunks,
+			*argMaxRAMChunks,
+			*argChunkEviction,
 			*argAcknowledgeAbuse)
 		if nil != err {
 			Log.Errorf("%v", err)
 			os.Exit(4)
 		}
 
+		controlServer, err := control.Serve(control.SocketPath(*argConfigPath, *argDriveID, *argRootNodeID), cache, chunkManager)
+		if nil != err {
+			Log.Errorf("%v", err)
+			os.Exit(4)
+		}
+		defer controlServer.Close()
+
+		guard, err := mount.NewDestructiveGuard(*argDryRun, *argMaxDestructiveOps, *argAuditLog)
+		if nil != err {
+			Log.Errorf("%v", err)
+			os.Exit(4)
+		}
+		defer guard.Close()
+
 		// check os signals like SIGINT/TERM
 		checkOsSignals(argMountPoint)
-		if err := mount.Mount(client, chunkManager, argMountPoint, mountOptions, uid, gid, umask); nil != err {
+		if err := mount.Mount(client, chunkManager, guard, argMountPoint, mountOptions, uid, gid, umask); nil != err {
 			Log.Debugf("%v", err)
 			os.Exit(5)
 		}
-	} else {
+	case "cache":
+		os.Exit(runCacheCommand(flag.Arg(1), flag.Arg(2), *argCacheFile, *argConfigPath, *argDriveID, *argRootNodeID, *argCacheSubtreeOnly, *argRepair))
+	case "ls", "stat", "find", "du":
+		query, err := parseFindQuery(flag.Arg(1), *argFindName, *argFindType, *argFindMinSize, *argFindMaxSize, *argFindModifiedAfter, *argFindModifiedBefore)
+		if nil != err {
+			Log.Errorf("%v", err)
+			os.Exit(2)
+		}
+		os.Exit(runBrowseCommand(argCommand, query, *argJSON, *argCacheFile, *argConfigPath, *argDriveID, *argRootNodeID))
+	case "get":
+		rangeSize, err := parseSizeArg(*argChunkSize)
+		if nil != err || rangeSize <= 0 {
+			Log.Errorf("Invalid chunk size %v", *argChunkSize)
+			os.Exit(2)
+		}
+		os.Exit(runGetCommand(flag.Arg(1), flag.Arg(2), *argGetThreads, rangeSize, *argAcknowledgeAbuse, *argCacheFile, *argConfigPath, *argDriveID, *argRootNodeID))
+	case "put":
+		uploadChunkSize, err := parseSizeArg(*argChunkSize)
+		if nil != err || uploadChunkSize <= 0 {
+			Log.Errorf("Invalid chunk size %v", *argChunkSize)
+			os.Exit(2)
+		}
+		os.Exit(runPutCommand(flag.Arg(1), flag.Arg(2), *argPutThreads, uploadChunkSize, *argCacheFile, *argConfigPath, *argDriveID, *argRootNodeID))
+	case "quarantine":
+		os.Exit(runQuarantineCommand(flag.Arg(1), flag.Args()[min(2, flag.NArg()):], *argCacheFile, *argConfigPath, *argDriveID, *argRootNodeID))
+	case "outbox":
+		os.Exit(runOutboxCommand(*argCacheFile, *argConfigPath, *argDriveID, *argRootNodeID))
+	case "streams":
+		os.Exit(runStreamsCommand(*argCacheFile, *argConfigPath, *argDriveID, *argRootNodeID))
+	case "path":
+		os.Exit(runPathCommand(flag.Arg(1), *argCacheFile, *argConfigPath, *argDriveID, *argRootNodeID))
+	case "id":
+		os.Exit(runIDCommand(flag.Arg(1), *argCacheFile, *argConfigPath, *argDriveID, *argRootNodeID))
+	default:
 		Log.Errorf("Command %v not found", argCommand)
 	}
 }
@@ -248,6 +366,13 @@ func checkOsSignals(mountpoint string) {
 	}()
 }
 
+func min(x, y int) int {
+	if x < y {
+		return x
+	}
+	return y
+}
+
 func max(x, y int) int {
 	if x > y {
 		return x
@@ -255,6 +380,61 @@ func max(x, y int) int {
 	return y
 }
 
+// parseChunkFileArgs parses the chunk files with their optional size, files
+// without size store maxChunks chunks. If the size of the cache is shared,
+// maxChunks is split between the files without size instead.
+func parseChunkFileArgs(args []string, chunkSize int64, maxChunks int, shared bool) ([]chunk.ChunkFile, error) {
+	files := make([]chunk.ChunkFile, 0, len(args))
+	unsized := make([]int, 0, len(args))
+	for _, arg := range args {
+		file := chunk.ChunkFile{
+			Path:      arg,
+			MaxChunks: maxChunks,
+		}
+		if i := strings.LastIndex(arg, "="); i >= 0 {
+			size, err := parseSizeArg(arg[i+1:])
+			if nil != err {
+				return nil, fmt.Errorf("Invalid size of chunk cache file %v", arg)
+			}
+			file.Path = arg[:i]
+			file.MaxChunks = int(size / chunkSize)
+			if file.MaxChunks < 1 {
+				return nil, fmt.Errorf("Chunk cache file %v must fit at least one chunk", file.Path)
+			}
+		} else {
+			unsized = append(unsized, len(files))
+		}
+		files = append(files, file)
+	}
+
+	if shared && len(unsized) > 1 {
+		share := maxChunks / len(unsized)
+		if share < 1 {
+			return nil, fmt.Errorf("Cache size must fit at least one chunk for each of the %v chunk cache files without size", len(unsized))
+		}
+		for _, i := range unsized {
+			files[i].MaxChunks = share
+		}
+	}
+	return files, nil
+}
+
+// parseCacheSizeArg converts the size of the chunk cache to the number of
+// chunks, the cache must fit at least 2 chunks and at least the chunks read
+// ahead
+func parseCacheSizeArg(input string, chunkSize int64, loadAhead int) (int, error) {
+	cacheSize, err := parseSizeArg(input)
+	if nil != err {
+		return 0, err
+	}
+	minChunks := max(2, loadAhead)
+	if cacheSize/chunkSize < int64(minChunks) {
+		return 0, fmt.Errorf("Cache size %v is too small, it must be at least %v for a chunk size of %v and %v chunks of load ahead",
+			input, formatSize(uint64(int64(minChunks)*chunkSize)), formatSize(uint64(chunkSize)), loadAhead)
+	}
+	return int(cacheSize / chunkSize), nil
+}
+
 func parseSizeArg(input string) (int64, error) {
 	if "" == input {
 		return 0, nil
@@ -265,7 +445,9 @@ func parseSizeArg(input string) (int64, error) {
 	var multiplier float64
 	switch suffix {
 	case '0', '1', '2', '3', '4', '5', '6', '7', '8', '9', '.':
+		// numbers without unit are bytes
 		suffixLen = 0
+		multiplier = 1
 	case 'b', 'B':
 		multiplier = 1
 	case 'k', 'K':
@@ -274,6 +456,8 @@ func parseSizeArg(input string) (int64, error) {
 		multiplier = 1024 * 1024
 	case 'g', 'G':
 		multiplier = 1024 * 1024 * 1024
+	case 't', 'T':
+		multiplier = 1024 * 1024 * 1024 * 1024
 	default:
 		return 0, fmt.Errorf("Invalid unit %v for %v", suffix, input)
 	}
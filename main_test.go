@@ -0,0 +1,41 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseSizeArg(t *testing.T) {
+	tests := map[string]int64{
+		"":     0,
+		"512":  512,
+		"512B": 512,
+		"1.5K": 1536,
+		"10M":  10 << 20,
+		"2G":   2 << 30,
+		"1T":   1 << 40,
+	}
+	for input, expected := range tests {
+		if size, err := parseSizeArg(input); nil != err || expected != size {
+			t.Errorf("Expected %v to be %v bytes got %v: %v", input, expected, size, err)
+		}
+	}
+	for _, input := range []string{"10X", "-1M", "M"} {
+		if _, err := parseSizeArg(input); nil == err {
+			t.Errorf("Expected %v to be invalid", input)
+		}
+	}
+}
+
+func TestParseCacheSizeArg(t *testing.T) {
+	if maxChunks, err := parseCacheSizeArg("100M", 10<<20, 3); nil != err || 10 != maxChunks {
+		t.Fatalf("Expected 10 chunks got %v: %v", maxChunks, err)
+	}
+	// the cache must fit 2 chunks and the chunks read ahead
+	if _, err := parseCacheSizeArg("5M", 10<<20, 1); nil == err || !strings.Contains(err.Error(), "at least 20.0M") {
+		t.Fatalf("Expected the minimum cache size in the error got %v", err)
+	}
+	if _, err := parseCacheSizeArg("30M", 10<<20, 4); nil == err || !strings.Contains(err.Error(), "at least 40.0M") {
+		t.Fatalf("Expected the minimum cache size in the error got %v", err)
+	}
+}
@@ -0,0 +1,103 @@
+package mount
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"bazil.org/fuse"
+	. "github.com/claudetech/loggo/default"
+	"github.com/plexdrive/plexdrive/drive"
+)
+
+// destructiveWindow is the time window of the destructive operation rate limit
+const destructiveWindow = time.Minute
+
+// DestructiveGuard protects Google Drive against mass deletions and renames
+// through the mount, all destructive operations are written to an audit log
+type DestructiveGuard struct {
+	dryRun       bool
+	maxPerMinute int
+	lock         sync.Mutex
+	recent       []time.Time
+	tripped      bool
+	audit        *os.File
+}
+
+// NewDestructiveGuard creates a new guard, destructive operations are only
+// logged in dry run mode and refused after more than maxPerMinute operations
+// per minute (0 = no limit) until the mount is restarted
+func NewDestructiveGuard(dryRun bool, maxPerMinute int, auditLog string) (*DestructiveGuard, error) {
+	guard := DestructiveGuard{
+		dryRun:       dryRun,
+		maxPerMinute: maxPerMinute,
+	}
+	if "" != auditLog {
+		audit, err := os.OpenFile(auditLog, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+		if nil != err {
+			Log.Debugf("%v", err)
+			return nil, fmt.Errorf("Could not open audit log %v", auditLog)
+		}
+		guard.audit = audit
+	}
+	return &guard, nil
+}
+
+// Close closes the audit log
+func (g *DestructiveGuard) Close() error {
+	if nil == g.audit {
+		return nil
+	}
+	return g.audit.Close()
+}
+
+// run runs a destructive operation on an object if it is allowed
+func (g *DestructiveGuard) run(op string, object *drive.APIObject, detail string, fn func() error) error {
+	g.lock.Lock()
+	now := time.Now()
+	if !g.tripped && g.maxPerMinute > 0 {
+		for len(g.recent) > 0 && now.Sub(g.recent[0]) > destructiveWindow {
+			g.recent = g.recent[1:]
+		}
+		g.recent = append(g.recent, now)
+		if len(g.recent) > g.maxPerMinute {
+			g.tripped = true
+			Log.Errorf("More than %v destructive operations per minute, refusing all further deletes and renames until the mount is restarted", g.maxPerMinute)
+		}
+	}
+	if g.tripped {
+		g.log(now, op, "refused", object, detail)
+		g.lock.Unlock()
+		return fuse.EPERM
+	}
+	if g.dryRun {
+		g.log(now, op, "dry-run", object, detail)
+		g.lock.Unlock()
+		Log.Infof("Dry run: %v %v (%v) %v", op, object.ObjectID, object.Name, detail)
+		return nil
+	}
+	g.lock.Unlock()
+
+	err := fn()
+	result := "done"
+	if nil != err {
+		result = "failed"
+	}
+
+	g.lock.Lock()
+	g.log(time.Now(), op, result, object, detail)
+	g.lock.Unlock()
+	return err
+}
+
+// log writes an operation to the audit log, the lock must be held
+func (g *DestructiveGuard) log(t time.Time, op, result string, object *drive.APIObject, detail string) {
+	if nil == g.audit {
+		return
+	}
+	line := fmt.Sprintf("%v %v %v %v %q %v\n", t.Format(time.RFC3339), op, result, object.ObjectID, object.Name, detail)
+	if _, err := g.audit.WriteString(line); nil != err {
+		Log.Warningf("Could not write to audit log: %v", err)
+	}
+}
@@ -0,0 +1,58 @@
+package mount
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"bazil.org/fuse"
+	"github.com/plexdrive/plexdrive/drive"
+)
+
+func TestDestructiveGuard(t *testing.T) {
+	dir, err := ioutil.TempDir("", "plexdrive")
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	auditLog := filepath.Join(dir, "audit.log")
+	guard, err := NewDestructiveGuard(false, 2, auditLog)
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer guard.Close()
+
+	object := &drive.APIObject{ObjectID: "a", Name: "a.mkv"}
+	calls := 0
+	remove := func() error {
+		calls++
+		return nil
+	}
+	for i := 0; i < 2; i++ {
+		if err := guard.run("remove", object, "", remove); nil != err {
+			t.Fatal(err)
+		}
+	}
+	// the limit latches until the mount is restarted
+	for i := 0; i < 2; i++ {
+		if err := guard.run("remove", object, "", remove); fuse.EPERM != err {
+			t.Fatalf("Expected EPERM after exceeding the rate limit, got %v", err)
+		}
+	}
+	if 2 != calls {
+		t.Fatalf("Expected 2 applied operations, got %v", calls)
+	}
+
+	data, _ := ioutil.ReadFile(auditLog)
+	if lines := strings.Split(strings.TrimSpace(string(data)), "\n"); 4 != len(lines) || !strings.Contains(lines[3], "remove refused a") {
+		t.Fatalf("Unexpected audit log %q", data)
+	}
+
+	dryRun, _ := NewDestructiveGuard(true, 0, "")
+	if err := dryRun.run("rename", object, "", remove); nil != err || 2 != calls {
+		t.Fatalf("Expected dry run to skip the operation")
+	}
+}
@@ -24,6 +24,7 @@ import (
 func Mount(
 	client *drive.Client,
 	chunkManager *chunk.Manager,
+	guard *DestructiveGuard,
 	mountpoint string,
 	mountOptions []string,
 	uid, gid uint32,
@@ -110,6 +111,7 @@ func Mount(
 	filesys := &FS{
 		client:       client,
 		chunkManager: chunkManager,
+		guard:        guard,
 		uid:          uid,
 		gid:          gid,
 		umask:        umask,
@@ -179,6 +181,7 @@ func Unmount(mountpoint string, notify bool) error {
 type FS struct {
 	client       *drive.Client
 	chunkManager *chunk.Manager
+	guard        *DestructiveGuard
 	uid          uint32
 	gid          uint32
 	umask        os.FileMode
@@ -264,8 +267,11 @@ func (o Object) Attr(ctx context.Context, attr *fuse.Attr) error {
 	attr.Gid = o.fs.gid
 
 	attr.Mtime = object.LastModified
-	attr.Crtime = object.LastModified
+	attr.Crtime = object.CreatedTime
 	attr.Ctime = object.LastModified
+	if object.CreatedTime.IsZero() {
+		attr.Crtime = object.LastModified
+	}
 
 	attr.Blocks = (attr.Size + 511) >> 9
 
@@ -308,25 +314,17 @@ func (o Object) Lookup(ctx context.Context, name string) (fs.Node, error) {
 	return o.fs.NewObject(object), nil
 }
 
-// Read reads some bytes or the whole file
-func (o Object) Read(ctx context.Context, req *fuse.ReadRequest, resp *fuse.ReadResponse) error {
+// Open a file
+func (o Object) Open(ctx context.Context, req *fuse.OpenRequest, resp *fuse.OpenResponse) (fs.Handle, error) {
 	object, err := o.GetObject()
 	if nil != err {
 		Log.Errorf("%v", err)
-		return fuse.EIO
+		return nil, fuse.ENOENT
 	}
-	data, err := o.fs.chunkManager.GetChunk(object, req.Offset, int64(req.Size))
-	if nil != err {
-		Log.Warningf("%v", err)
-		return fuse.EIO
+	if object.IsDir {
+		return o, nil
 	}
 
-	resp.Data = data
-	return nil
-}
-
-// Open a file
-func (o Object) Open(ctx context.Context, req *fuse.OpenRequest, resp *fuse.OpenResponse) (fs.Handle, error) {
 	if o.fs.directIO {
 		// Force use of Direct I/O, even if the app did not request it (direct_io mount option)
 		resp.Flags |= fuse.OpenDirectIO
@@ -335,7 +333,38 @@ func (o Object) Open(ctx context.Context, req *fuse.OpenRequest, resp *fuse.Open
 		// We can actively invalidate kernel cache, use more aggressive caching
 		resp.Flags |= fuse.OpenKeepCache
 	}
-	return o, nil
+	return &Handle{
+		handle:       o.fs.chunkManager.Open(object),
+		chunkManager: o.fs.chunkManager,
+	}, nil
+}
+
+// Handle is an open file
+type Handle struct {
+	handle       *chunk.Handle
+	chunkManager *chunk.Manager
+}
+
+// Read reads some bytes or the whole file
+func (h *Handle) Read(ctx context.Context, req *fuse.ReadRequest, resp *fuse.ReadResponse) error {
+	data, err := h.chunkManager.GetChunk(ctx, h.handle, req.Offset, int64(req.Size))
+	if nil != err {
+		if nil != ctx.Err() {
+			Log.Debugf("Read of %v at %v has been interrupted", h.handle.Object().ObjectID, req.Offset)
+			return fuse.EINTR
+		}
+		Log.Warningf("%v", err)
+		return fuse.EIO
+	}
+
+	resp.Data = data
+	return nil
+}
+
+// Release closes the file and cancels its preloads
+func (h *Handle) Release(ctx context.Context, req *fuse.ReleaseRequest) error {
+	h.handle.Release()
+	return nil
 }
 
 // Remove deletes an element
@@ -346,8 +375,12 @@ func (o Object) Remove(ctx context.Context, req *fuse.RemoveRequest) error {
 		return fuse.EIO
 	}
 
-	err = o.fs.client.Remove(object, o.objectID)
-	if nil != err {
+	err = o.fs.guard.run("remove", object, fmt.Sprintf("from %v", o.objectID), func() error {
+		return o.fs.client.Remove(object, o.objectID)
+	})
+	if fuse.EPERM == err {
+		return err
+	} else if nil != err {
 		Log.Warningf("%v", err)
 		return fuse.EIO
 	}
@@ -380,8 +413,12 @@ func (o Object) Rename(ctx context.Context, req *fuse.RenameRequest, newDir fs.N
 		return fuse.EIO
 	}
 
-	err = o.fs.client.Rename(obj, o.objectID, destDir.objectID, req.NewName)
-	if nil != err {
+	err = o.fs.guard.run("rename", obj, fmt.Sprintf("from %v to %v/%q", o.objectID, destDir.objectID, req.NewName), func() error {
+		return o.fs.client.Rename(obj, o.objectID, destDir.objectID, req.NewName)
+	})
+	if fuse.EPERM == err {
+		return err
+	} else if nil != err {
 		Log.Warningf("%v", err)
 		return fuse.EIO
 	}